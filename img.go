@@ -1,365 +1,321 @@
 package main
 
 import (
-	"crypto/sha1"
-	"encoding/hex"
+	"context"
+	"encoding/json"
 	"errors"
 	"flag"
-	"fmt"
-	"github.com/bmizerany/pat"
-	"github.com/fzzy/radix/redis"
-	"io"
-	"io/ioutil"
-	"log"
+	"github.com/arnaud-lb/goresize/resize"
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+	"image"
+	"image/png"
+	"log/slog"
 	"net/http"
 	"os"
-	"path"
-	"strconv"
+	"os/signal"
+	"runtime"
 	"strings"
 	"syscall"
 	"time"
-	"crypto/tls"
-	"image"
-	"image/png"
-	_ "image/gif"
-	_ "image/jpeg"
-	"bytes"
-	"math"
 )
 
-// HTTP headers struct
-type Headers struct {
-	contentType  string
-	lastModified string
-	cacheControl string
-}
-
-// The URL for the default avatar
-const defaultAvatarUrl = "//linuxfr.org/images/default-avatar.png"
-
-// The maximal size for an image is 5MB
-const maxSize = 5 * (1 << 20)
-
-// The directory for caching files
-var directory string
-
-// The connection to redis
-var connection *redis.Client
-
-// Check if an URL is valid and not temporary in error
-func urlStatus(uri string) error {
+func main() {
+	// Parse the command-line
+	var addr string
+	var adminAddr string
+	var logs string
+	var logFormat string
+	var logLevel string
+	var conn string
+	var redisPrefix string
+	var redisPool int
+	var maxErrors int
+	var allow string
+	var schemes string
+	var proxy string
+	var upstreamAuth string
+	var formats string
+	var directory string
+	var s3Bucket string
+	var s3Endpoint string
+	var s3AccessKey string
+	var s3SecretKey string
+	var s3Insecure bool
+	var pngCompression string
+	var watermark string
+	var presets string
+	var grace time.Duration
+	var maxCacheBytes int64
+	var cacheTTL time.Duration
+	var shardingDepth int
+	var cacheScanInterval time.Duration
+	var config resize.Config
+	flag.StringVar(&addr, "a", "127.0.0.1:8000", "Bind to this address:port")
+	flag.StringVar(&adminAddr, "admin-addr", "", "Serve status, health, metrics and pprof on this address:port instead, and the cache warming")
+	flag.StringVar(&logs, "l", "-", "Use this file for logs")
+	flag.StringVar(&logFormat, "log-format", "text", "The format of the logs: text or json")
+	flag.StringVar(&logLevel, "log-level", "info", "The minimal level of the logs: debug, info, warn or error")
+	flag.StringVar(&conn, "r", "localhost:6379/0", "The redis database to use for caching meta, as host:port/db or redis://:password@host:port/db (neither TLS nor usernames are supported)")
+	flag.StringVar(&redisPrefix, "redis-prefix", resize.DefaultRedisPrefix, "The prefix of the keys in redis")
+	flag.IntVar(&redisPool, "redis-pool", resize.DefaultRedisPoolCapacity(), "The maximal number of connections to redis")
+	flag.IntVar(&maxErrors, "max-errors", resize.DefaultMaxErrors, "The maximal number of URLs in error cached in redis, or 0 for no limit")
+	flag.StringVar(&directory, "d", "cache", "The directory for the caching files")
+	flag.DurationVar(&config.Timeout, "t", 10*time.Second, "The timeout for fetching images on distant servers")
+	flag.IntVar(&config.MaxAge, "max-age", 600, "The max-age of the original images, in seconds")
+	flag.IntVar(&config.ResizeMaxAge, "resize-max-age", 0, "The max-age of the resized images, in seconds, or 0 for the one of the originals")
+	flag.IntVar(&config.StaleWhileRevalidate, "stale-while-revalidate", 86400, "For how long, in seconds, an original older than its max-age is served while it is revalidated in the background")
+	flag.Int64Var(&config.MaxPixels, "max-pixels", 16000000, "The maximal number of pixels of a resized image")
+	flag.Int64Var(&config.MaxSourcePixels, "max-source-pixels", 100000000, "The maximal number of pixels of an original image, or 0 for no limit")
+	flag.DurationVar(&config.DecodeTimeout, "decode-timeout", 10*time.Second, "The maximal duration of the decoding of an image, or 0 for no limit")
+	flag.IntVar(&config.MaxWidth, "max-width", 4000, "The maximal width of a resized image")
+	flag.IntVar(&config.MaxHeight, "max-height", 4000, "The maximal height of a resized image")
+	flag.StringVar(&pngCompression, "png-compression", "best", "The compression of PNG images: default, speed, best or none")
+	flag.IntVar(&config.MaxFrames, "max-frames", 100, "The maximal number of frames of an animated GIF to resize")
+	flag.StringVar(&proxy, "proxy", "", "The proxy for fetching images, instead of the one of HTTP_PROXY and HTTPS_PROXY")
+	flag.StringVar(&config.HTTPSProxy, "https-proxy", "", "The proxy for fetching images in HTTPS, if different")
+	flag.StringVar(&config.NoProxy, "no-proxy", "", "Comma-separated list of the hosts reached without proxy, instead of NO_PROXY")
+	flag.StringVar(&config.UserAgent, "user-agent", resize.DefaultUserAgent, "The User-Agent of the fetches on the distant servers")
+	flag.StringVar(&upstreamAuth, "upstream-auth", "", "Comma-separated list of host=authorization pairs, for the Authorization header sent to the distant hosts requiring one")
+	flag.BoolVar(&config.Insecure, "insecure", false, "Accept any certificate when fetching images in HTTPS")
+	flag.IntVar(&config.ThumbWidth, "thumb-width", 150, "The width of the images served by /thumb")
+	flag.IntVar(&config.ThumbHeight, "thumb-height", 150, "The height of the images served by /thumb")
+	flag.StringVar(&config.ThumbMode, "thumb-mode", "fill", "Whether the images served by /thumb fit, fill, or are padded to their box")
+	flag.StringVar(&config.DefaultImage, "default-image", resize.DefaultAvatarUrl, "The image served by /avatar when the avatar can't be fetched")
+	flag.StringVar(&presets, "presets", "", "The JSON file mapping the names of the presets to their options")
+	flag.StringVar(&watermark, "watermark", "", "The image drawn over the resized images asking for it with ?wm=position,opacity")
+	flag.StringVar(&config.Secret, "secret", "", "The secret for signing requests, or empty to accept unsigned requests")
+	flag.StringVar(&formats, "formats", "jpeg,png,gif,webp,avif", "Comma-separated list of the formats the images can be served in")
+	flag.StringVar(&schemes, "schemes", "http,https", "Comma-separated list of the schemes of the URLs images can be fetched from")
+	flag.StringVar(&allow, "allow", "", "Comma-separated list of the hosts images can be fetched from")
+	flag.IntVar(&shardingDepth, "sharding-depth", 3, "The number of levels of directories of the cache")
+	flag.DurationVar(&cacheTTL, "cache-ttl", 0, "The time after which the cached images expire, or 0 to keep them")
+	flag.Int64Var(&maxCacheBytes, "max-cache-bytes", 0, "The maximal size of the cache directory, or 0 for no limit")
+	flag.DurationVar(&cacheScanInterval, "cache-scan-interval", 10*time.Minute, "The interval between the evictions of the least recently used files")
+	flag.StringVar(&s3Bucket, "s3-bucket", "", "Cache the images in this S3 bucket instead of on disk")
+	flag.StringVar(&s3Endpoint, "s3-endpoint", "s3.amazonaws.com", "The endpoint of the S3-compatible storage")
+	flag.StringVar(&s3AccessKey, "s3-access-key", "", "The access key for the S3-compatible storage")
+	flag.StringVar(&s3SecretKey, "s3-secret-key", "", "The secret key for the S3-compatible storage")
+	flag.BoolVar(&s3Insecure, "s3-insecure", false, "Connect to the S3-compatible storage without TLS")
+	flag.IntVar(&config.MaxConcurrentResizes, "max-concurrent-resizes", runtime.NumCPU(), "The maximal number of images resized at the same time, or 0 for no limit")
+	flag.DurationVar(&config.ResizeQueueTimeout, "resize-queue-timeout", 5*time.Second, "How long a resize waits for its turn before failing")
+	flag.BoolVar(&config.Pprof, "pprof", false, "Serve the profiles for pprof under /debug/pprof/")
+	flag.IntVar(&config.CacheWorkers, "cache-workers", 4, "The number of workers saving in cache")
+	flag.IntVar(&config.CacheQueueSize, "cache-queue", 1000, "The number of saves waiting for a worker before new ones are dropped")
+	flag.BoolVar(&config.SyncCache, "sync-cache", false, "Save in cache before responding, rather than in the background")
+	flag.Float64Var(&config.FetchRate, "fetch-rate", 0, "The maximal number of fetches per second on each distant host, or 0 for no limit")
+	flag.IntVar(&config.FetchBurst, "fetch-burst", 1, "The number of fetches on a distant host that can be made at once above the rate")
+	flag.IntVar(&config.BreakerThreshold, "breaker-threshold", 5, "The number of consecutive failures of a distant host after which its fetches fail fast, or 0 to always make them")
+	flag.DurationVar(&config.BreakerCooldown, "breaker-cooldown", 30*time.Second, "For how long the fetches on a failing host fail fast before probing it again")
+	flag.IntVar(&config.FetchRetries, "fetch-retries", 2, "The number of times a fetch failing with a transient error is retried")
+	flag.DurationVar(&config.FetchRetryBackoff, "fetch-retry-backoff", 200*time.Millisecond, "The delay before retrying a fetch, doubled for each next retry")
+	flag.BoolVar(&config.StreamOriginals, "stream-originals", false, "Stream the fresh originals served by /proxy/ from the files of the cache")
+	flag.DurationVar(&grace, "grace", 30*time.Second, "The time left to the pending requests on shutdown")
+	flag.Parse()
 
-	str, err := connection.Get("img/err/" + uri).Str()
-	if err == nil {
-		return errors.New(str)
+	switch pngCompression {
+	case "default":
+		config.PNGCompression = png.DefaultCompression
+	case "speed":
+		config.PNGCompression = png.BestSpeed
+	case "best":
+		config.PNGCompression = png.BestCompression
+	case "none":
+		config.PNGCompression = png.NoCompression
+	default:
+		fatal("Invalid PNG compression", errors.New(pngCompression))
 	}
 
-	return nil
-}
-
-// Generate a key for cache from a string
-func generateKeyForCache(s string) string {
-	h := sha1.New()
-	io.WriteString(h, s)
-	key := h.Sum(nil)
-
-	// Use 3 levels of hasing to avoid having too many files in the same directory
-	return fmt.Sprintf("%s/%x/%x/%x/%x", directory, key[0:1], key[1:2], key[2:3], key[3:])
-}
+	if config.ThumbMode != "fit" && config.ThumbMode != "fill" && config.ThumbMode != "pad" {
+		fatal("Invalid thumbnail mode", errors.New(config.ThumbMode))
+	}
 
-// Fetch image from cache
-func fetchImageFromCache(uri, variation string) (headers Headers, body []byte, ok bool) {
-	ok = false
+	config.AllowedSchemes = strings.Split(schemes, ",")
 
-	contentType, err := connection.Hget("img/"+variation+"/"+uri, "type").Str()
-	if err != nil {
-		return
+	if upstreamAuth != "" {
+		config.UpstreamAuth = map[string]string{}
+		for _, pair := range strings.Split(upstreamAuth, ",") {
+			host, auth, ok := strings.Cut(pair, "=")
+			if !ok || host == "" || auth == "" {
+				fatal("Invalid upstream authorization", errors.New(host))
+			}
+			config.UpstreamAuth[host] = auth
+		}
 	}
 
-	filename := generateKeyForCache(uri)
-	stat, err := os.Stat(filename)
-	if err != nil {
-		return
+	config.HTTPProxy = proxy
+	if config.HTTPSProxy == "" {
+		config.HTTPSProxy = proxy
 	}
 
-	headers.contentType = contentType
-	headers.lastModified = stat.ModTime().Format(time.RFC1123)
-
-	body, err = ioutil.ReadFile(filename)
-	ok = err == nil
-
-	return
-}
+	config.OutputFormats = strings.Split(formats, ",")
+	for _, format := range config.OutputFormats {
+		switch format {
+		case "jpeg", "png", "gif", "webp", "avif":
+		default:
+			fatal("Invalid format", errors.New(format))
+		}
+	}
 
-// Save the body and the content-type header in cache
-func saveImageInCache(uri, variation string, headers Headers, body []byte) {
-	go func() {
-		filename := generateKeyForCache(variation+":"+uri)
-		dirname := path.Dir(filename)
-		err := os.MkdirAll(dirname, 0755)
+	if watermark != "" {
+		f, err := os.Open(watermark)
 		if err != nil {
-			return
+			fatal("Watermark", err)
 		}
-
-		// Save the body on disk
-		err = ioutil.WriteFile(filename, body, 0644)
+		config.Watermark, _, err = image.Decode(f)
+		f.Close()
 		if err != nil {
-			log.Printf("Error while writing %s\n", filename)
-			return
+			fatal("Watermark", err)
 		}
-
-		// And other infos in redis
-		connection.Hset("img/"+variation+"/"+uri, "type", headers.contentType)
-	}()
-}
-
-// Save the error in redis for 10 minutes
-func saveErrorInCache(uri string, err error) {
-	go func() {
-		connection.Set("img/err/"+uri, err.Error())
-		connection.Expire("img/err/"+uri, 600)
-	}()
-}
-
-// Fetch the image from the distant server
-func fetchImageFromServer(uri string) (headers Headers, body []byte, err error) {
-	// Accepts any certificate in HTTPS
-	cfg := &tls.Config{InsecureSkipVerify: true}
-	tr := &http.Transport{TLSClientConfig: cfg}
-	client := &http.Client{Transport: tr}
-	res, err := client.Get(uri)
-	if err != nil {
-		return
-	}
-	if res.StatusCode != 200 {
-		log.Printf("Status code of %s is: %d\n", uri, res.StatusCode)
-		err = errors.New("Unexpected status code")
-		saveErrorInCache(uri, err)
-		return
-	}
-
-	defer res.Body.Close()
-	body, err = ioutil.ReadAll(res.Body)
-	if err != nil {
-		return
-	}
-	if res.ContentLength > maxSize {
-		log.Printf("Exceeded max size for %s: %d\n", uri, res.ContentLength)
-		err = errors.New("Exceeded max size")
-		saveErrorInCache(uri, err)
-		return
-	}
-	contentType := res.Header.Get("Content-Type")
-	if contentType[0:5] != "image" {
-		log.Printf("%s has an invalid content-type: %s\n", uri, contentType)
-		err = errors.New("Invalid content-type")
-		saveErrorInCache(uri, err)
-		return
 	}
-	log.Printf("Fetch %s (%s)\n", uri, contentType)
 
-	headers.contentType = contentType
-	headers.lastModified = time.Now().Format(time.RFC1123)
-	if urlStatus(uri) == nil {
-		saveImageInCache(uri, "orig", headers, body)
+	if presets != "" {
+		var err error
+		config.Presets, err = loadPresets(presets)
+		if err != nil {
+			fatal("Presets", err)
+		}
 	}
-	return
-}
 
-// Fetch image from cache if available, or from the server
-func fetchImage(uri string) (headers Headers, body []byte, err error) {
-	err = urlStatus(uri)
-	if err != nil {
-		return
+	if allow != "" {
+		config.AllowedHosts = strings.Split(allow, ",")
 	}
 
-	headers, body, ok := fetchImageFromCache(uri, "orig")
-	if !ok {
-		headers, body, err = fetchImageFromServer(uri)
+	// Logging
+	if logs != "-" {
+		f, err := os.OpenFile(logs, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0644)
+		if err != nil {
+			fatal("OpenFile", err)
+		}
+		syscall.Dup2(int(f.Fd()), int(os.Stdout.Fd()))
+		syscall.Dup2(int(f.Fd()), int(os.Stderr.Fd()))
 	}
 
-	headers.cacheControl = "public, max-age=600"
-
-	return
-}
-
-func fetchResizedImage(uri string, width, height int) (headers Headers, body []byte, err error) {
-
-	variation := fmt.Sprintf("resize/%d/%d", width, height)
-	if err != nil {
-		return
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(logLevel)); err != nil {
+		fatal("Invalid log level", err)
 	}
-	
-	headers, body, ok := fetchImageFromCache(uri, variation)
-
-	if ok {
-		return
+	handlerOptions := &slog.HandlerOptions{Level: level}
+	switch logFormat {
+	case "json":
+		slog.SetDefault(slog.New(slog.NewJSONHandler(os.Stderr, handlerOptions)))
+	case "text":
+		slog.SetDefault(slog.New(slog.NewTextHandler(os.Stderr, handlerOptions)))
+	default:
+		fatal("Invalid log format", errors.New(logFormat))
 	}
 
-	headers, body, err = fetchImage(uri)
+	// Redis
+	cfg, err := resize.ParseRedisURL(conn)
 	if err != nil {
-		return
-	}
-
-	headers, body, err = resizeImage(uri, string(body), headers, width, height)
-	if (err != nil) {
-		return
+		fatal("Invalid redis", err)
 	}
+	cfg.PoolCapacity = redisPool
+	connection := resize.NewRedisConn(cfg)
+	defer connection.Close()
 
-	saveImageInCache(uri, variation, headers, body)
-
-	return
-}
-
-func resizeImage(uri, origBody string, origHeaders Headers, width, height int) (headers Headers, body []byte, err error) {
-
-	m, _, err := image.Decode(strings.NewReader(origBody))
-
-	if err != nil {
-		return
+	// Caching
+	var cache resize.Cache
+	janitorCtx, stopJanitor := context.WithCancel(context.Background())
+	var janitorStopped <-chan struct{}
+	if s3Bucket == "" {
+		diskCache := resize.NewDiskCache(directory, connection, redisPrefix)
+		diskCache.SetTTL(cacheTTL)
+		diskCache.SetMaxErrors(maxErrors)
+		if err := diskCache.SetShardingDepth(shardingDepth); err != nil {
+			fatal("Sharding depth", err)
+		}
+		if maxCacheBytes > 0 {
+			janitorStopped = diskCache.StartJanitor(janitorCtx, maxCacheBytes, cacheScanInterval)
+		}
+		cache = diskCache
+	} else {
+		client, err := minio.New(s3Endpoint, &minio.Options{
+			Creds:  credentials.NewStaticV4(s3AccessKey, s3SecretKey, ""),
+			Secure: !s3Insecure,
+		})
+		if err != nil {
+			fatal("S3", err)
+		}
+		s3Cache := resize.NewS3Cache(client, s3Bucket, connection, redisPrefix)
+		s3Cache.SetMaxErrors(maxErrors)
+		cache = s3Cache
 	}
-
-	bounds := m.Bounds()
-	origWidth, origHeight := bounds.Dx(), bounds.Dy()
-
-	if width >= origWidth && height >= origHeight {
-		headers = origHeaders
-		body = []byte(origBody)
-		return
+	server := resize.NewServer(config, cache)
+
+	// Start the HTTP servers
+	httpServers := []*http.Server{{Addr: addr, Handler: server.Handler()}}
+	if adminAddr != "" {
+		httpServers = []*http.Server{
+			{Addr: addr, Handler: server.PublicHandler()},
+			{Addr: adminAddr, Handler: server.AdminHandler()},
+		}
 	}
-
-	ratio := math.Max(float64(origWidth), float64(origHeight)) / math.Min(float64(width), float64(height))
-
-	newWidth := int(math.Floor(float64(origWidth) / ratio))
-	newHeight := int(math.Floor(float64(origHeight) / ratio))
-
-	log.Printf("Resize: %s to %vx%v: orig: %vx%v; new: %vx%v; ratio: %v\n", uri, width, height, origWidth, origHeight, newWidth, newHeight, ratio)
-
-	m = Resample(m, m.Bounds(), newWidth, newHeight)
-	writter := new(bytes.Buffer)
-
-	err = png.Encode(writter, m)
-
-	if err != nil {
-		return
+	for _, httpServer := range httpServers {
+		go func(httpServer *http.Server) {
+			slog.Info("Listening", "addr", "http://"+httpServer.Addr+"/")
+			err := httpServer.ListenAndServe()
+			if err != nil && err != http.ErrServerClosed {
+				fatal("ListenAndServe", err)
+			}
+		}(httpServer)
 	}
 
-	body = []byte(writter.String())
-
-	headers = origHeaders
-	headers.contentType = "image/png"
-
-	return
-}
-
-
-// Receive an HTTP request, fetch the image and respond with it
-func Image(w http.ResponseWriter, r *http.Request, fn func()) {
-	query := r.URL.Query()
-	encoded_url := query.Get(":encoded_url")
-
-	strWidth, strHeight := query.Get(":width"), query.Get(":height")
-
-	width, err := strconv.ParseInt(strWidth, 10, 32)
-	if err != nil {
-		log.Printf("Invalid width %s\n", strWidth)
-		http.Error(w, "Invalid parameters", 400)
-		return
+	// Stop on SIGTERM or SIGINT, letting the pending requests and the saves
+	// in cache complete
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+	sig := <-signals
+	slog.Info("Shutting down", "signal", sig.String())
+
+	ctx, cancel := context.WithTimeout(context.Background(), grace)
+	defer cancel()
+	for _, httpServer := range httpServers {
+		if err := httpServer.Shutdown(ctx); err != nil {
+			slog.Error("Shutdown", "addr", httpServer.Addr, "error", err)
+		}
 	}
-
-	height, err := strconv.ParseInt(strHeight, 10, 32)
-	if err != nil {
-		log.Printf("Invalid width %s\n", strHeight)
-		http.Error(w, "Invalid parameters", 400)
-		return
+	if err := server.WaitForSaves(ctx); err != nil {
+		slog.Error("Pending saves in cache", "error", err)
 	}
-
-	if (width * height > maxSize) {
-		log.Printf("Requested resized image exceeds max size\n")
-		http.Error(w, "Requested resized image exceeds max size", 400)
-		return
+	stopJanitor()
+	if janitorStopped != nil {
+		select {
+		case <-janitorStopped:
+		case <-ctx.Done():
+			slog.Error("Eviction in progress", "error", ctx.Err())
+		}
 	}
+}
 
-	chars, err := hex.DecodeString(encoded_url)
+// Load the presets from a JSON file mapping their names to their options
+func loadPresets(filename string) (presets map[string]resize.Preset, err error) {
+	f, err := os.Open(filename)
 	if err != nil {
-		log.Printf("Invalid URL %s\n", encoded_url)
-		http.Error(w, "Invalid parameters", 400)
 		return
 	}
-	uri := string(chars)
+	defer f.Close()
 
-	headers, body, err := fetchResizedImage(uri, int(width), int(height))
+	err = json.NewDecoder(f).Decode(&presets)
 	if err != nil {
-		fn()
-		return
-	}
-
-	if headers.lastModified == r.Header.Get("If-Modified-Since") {
-		w.WriteHeader(http.StatusNotModified)
 		return
 	}
 
-	w.Header().Add("Content-Type", headers.contentType)
-	w.Header().Add("Last-Modified", headers.lastModified)
-	w.Header().Add("Cache-Control", headers.cacheControl)
-	w.Write(body)
-}
-
-// Receive an HTTP request for an image and respond with it
-func Img(w http.ResponseWriter, r *http.Request) {
-	fn := func() {
-		http.NotFound(w, r)
-	}
-	Image(w, r, fn)
-}
-
-// Returns 200 OK if the server is running (for monitoring)
-func Status(w http.ResponseWriter, r *http.Request) {
-	fmt.Fprintf(w, "OK")
-}
-
-func main() {
-	// Parse the command-line
-	var addr string
-	var logs string
-	var conn string
-	flag.StringVar(&addr, "a", "127.0.0.1:8000", "Bind to this address:port")
-	flag.StringVar(&logs, "l", "-", "Use this file for logs")
-	flag.StringVar(&conn, "r", "localhost:6379/0", "The redis database to use for caching meta")
-	flag.StringVar(&directory, "d", "cache", "The directory for the caching files")
-	flag.Parse()
-
-	// Logging
-	if logs != "-" {
-		f, err := os.OpenFile(logs, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0644)
-		if err != nil {
-			log.Fatal("OpenFile: ", err)
+	for name, preset := range presets {
+		switch preset.Format {
+		case "", "jpeg", "png", "webp", "avif":
+		default:
+			return nil, errors.New("Invalid format for the preset " + name)
+		}
+		if preset.Mode != "" && preset.Mode != "fit" && preset.Mode != "fill" && preset.Mode != "pad" {
+			return nil, errors.New("Invalid mode for the preset " + name)
 		}
-		syscall.Dup2(int(f.Fd()), int(os.Stdout.Fd()))
-		syscall.Dup2(int(f.Fd()), int(os.Stderr.Fd()))
-	}
-
-	// Redis
-	parts := strings.Split(conn, "/")
-	host := parts[0]
-	db := 0
-	if len(parts) >= 2 {
-		db, _ = strconv.Atoi(parts[1])
 	}
-	cfg := redis.Config{Database: db, Address: host, PoolCapacity: 4}
-	connection = redis.NewClient(cfg)
-	defer connection.Close()
-
-	// Routing
-	m := pat.New()
-	m.Get("/status", http.HandlerFunc(Status))
-	m.Get("/resize/:encoded_url/:width/:height", http.HandlerFunc(Img))
-	http.Handle("/", m)
+	return
+}
 
-	// Start the HTTP server
-	log.Printf("Listening on http://%s/\n", addr)
-	err := http.ListenAndServe(addr, nil)
-	if err != nil {
-		log.Fatal("ListenAndServe: ", err)
-	}
+// Log the error and exit
+func fatal(msg string, err error) {
+	slog.Error(msg, "error", err)
+	os.Exit(1)
 }
@@ -0,0 +1,15 @@
+package resize
+
+import (
+	"os"
+	"syscall"
+	"time"
+)
+
+// Return the last access time of a file
+func accessTime(info os.FileInfo) time.Time {
+	if stat, ok := info.Sys().(*syscall.Stat_t); ok {
+		return time.Unix(stat.Atim.Unix())
+	}
+	return info.ModTime()
+}
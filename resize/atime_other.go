@@ -0,0 +1,14 @@
+//go:build !linux
+
+package resize
+
+import (
+	"os"
+	"time"
+)
+
+// Return the last access time of a file, approximated by its last
+// modification time on the systems where it isn't portable
+func accessTime(info os.FileInfo) time.Time {
+	return info.ModTime()
+}
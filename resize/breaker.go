@@ -0,0 +1,116 @@
+package resize
+
+import (
+	"net/url"
+	"time"
+)
+
+// The default time during which the fetches on a failing host fail fast
+const defaultBreakerCooldown = 30 * time.Second
+
+// The states of a circuit breaker counted by the metric, which doesn't count
+// the closed ones
+const (
+	breakerClosed   = ""
+	breakerOpen     = "open"
+	breakerHalfOpen = "half_open"
+)
+
+// The circuit breaker of a distant host, opened after too many consecutive
+// failures
+type breaker struct {
+	failures  int
+	openUntil time.Time
+
+	// A fetch is probing whether the host has recovered
+	probing bool
+
+	// The state counted by the metric
+	state string
+}
+
+// Change the state of a breaker, counting it in its new state
+func (b *breaker) setState(state string) {
+	if b.state != breakerClosed {
+		circuitBreakers.WithLabelValues(b.state).Dec()
+	}
+	if state != breakerClosed {
+		circuitBreakers.WithLabelValues(state).Inc()
+	}
+	b.state = state
+}
+
+// Return the host of an URL, for its circuit breaker
+func breakerHost(uri string) string {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return ""
+	}
+	return u.Hostname()
+}
+
+// Check if a fetch can be made on a host: always when its breaker is closed,
+// only once to probe it when its cooldown is over, and never when it is open
+func (s *Server) breakerAllow(host string) error {
+	if s.config.BreakerThreshold <= 0 {
+		return nil
+	}
+
+	s.breakersMu.Lock()
+	defer s.breakersMu.Unlock()
+
+	b, ok := s.breakers[host]
+	if !ok || b.failures < s.config.BreakerThreshold {
+		return nil
+	}
+	if b.probing || time.Now().Before(b.openUntil) {
+		return errCircuitOpen
+	}
+
+	b.probing = true
+	b.setState(breakerHalfOpen)
+	return nil
+}
+
+// Record the result of a fetch on a host: a failure of the host itself, or
+// not. The fetches interrupted before knowing it are not recorded.
+func (s *Server) breakerRecord(host string, failed, interrupted bool) {
+	if s.config.BreakerThreshold <= 0 {
+		return
+	}
+
+	s.breakersMu.Lock()
+	defer s.breakersMu.Unlock()
+
+	b, ok := s.breakers[host]
+	if interrupted {
+		if ok && b.probing {
+			b.probing = false
+			b.setState(breakerOpen)
+		}
+		return
+	}
+
+	if !failed {
+		if ok {
+			delete(s.breakers, host)
+			b.setState(breakerClosed)
+		}
+		return
+	}
+
+	if !ok {
+		b = &breaker{}
+		s.breakers[host] = b
+	}
+	b.failures++
+	b.probing = false
+	if b.failures >= s.config.BreakerThreshold {
+		cooldown := s.config.BreakerCooldown
+		if cooldown <= 0 {
+			cooldown = defaultBreakerCooldown
+		}
+		b.openUntil = time.Now().Add(cooldown)
+		b.setState(breakerOpen)
+	}
+}
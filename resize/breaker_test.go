@@ -0,0 +1,69 @@
+package resize
+
+import (
+	"context"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	var requests int32
+	var status int32 = 503
+	upstream := func(r *http.Request) (*http.Response, error) {
+		atomic.AddInt32(&requests, 1)
+		if atomic.LoadInt32(&status) == 200 {
+			return respondWithImage(pngImage(t, 10, 10), "")(r)
+		}
+		return respondWith(int(atomic.LoadInt32(&status)))(r)
+	}
+	config := Config{BreakerThreshold: 2, BreakerCooldown: 50 * time.Millisecond, HTTPClient: &http.Client{Transport: roundTripFunc(upstream)}}
+	s := NewServer(config, newMemoryCache())
+	open := testutil.ToFloat64(circuitBreakers.WithLabelValues(breakerOpen))
+	fetch := func(path string) error {
+		_, _, err := s.fetchImageFromServer(context.Background(), "http://93.184.216.36"+path, Headers{}, nil)
+		return err
+	}
+
+	// Open after 2 failures
+	for _, path := range []string{"/a.png", "/b.png"} {
+		if err := fetch(path); err == nil || err == errCircuitOpen {
+			t.Fatalf("%s: err = %v, want the error of the host", path, err)
+		}
+	}
+	if err := fetch("/c.png"); err != errCircuitOpen {
+		t.Errorf("err = %v, want %v", err, errCircuitOpen)
+	}
+	if requests != 2 {
+		t.Errorf("%d requests, want none once open", requests)
+	}
+	if n := testutil.ToFloat64(circuitBreakers.WithLabelValues(breakerOpen)); n != open+1 {
+		t.Errorf("%v open breakers, want %v", n, open+1)
+	}
+	w := serve(s.Handler(), "GET", "/metrics")
+	if strings.Contains(w.Body.String(), "93.184.216.36") {
+		t.Error("the host is reported in the metrics")
+	}
+
+	// Probed after the cooldown, and closed once the host has recovered
+	time.Sleep(60 * time.Millisecond)
+	atomic.StoreInt32(&status, 200)
+	if err := fetch("/d.png"); err != nil {
+		t.Fatalf("probe: err = %v", err)
+	}
+	if err := fetch("/e.png"); err != nil {
+		t.Errorf("closed: err = %v", err)
+	}
+	if requests != 4 {
+		t.Errorf("%d requests, want 4", requests)
+	}
+	if n := testutil.ToFloat64(circuitBreakers.WithLabelValues(breakerOpen)); n != open {
+		t.Errorf("%v open breakers, want %v once closed", n, open)
+	}
+	if n := testutil.ToFloat64(circuitBreakers.WithLabelValues(breakerHalfOpen)); n != 0 {
+		t.Errorf("%v half-open breakers, want none once closed", n)
+	}
+}
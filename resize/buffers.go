@@ -0,0 +1,42 @@
+package resize
+
+import (
+	"bytes"
+	"io"
+	"sync"
+)
+
+// The buffers reused to read and encode the images, sparing the garbage
+// collector the ones growing with each request
+var bufferPool = sync.Pool{New: func() interface{} { return new(bytes.Buffer) }}
+
+// The buffers larger than this are left to the garbage collector, rather
+// than kept in the pool
+const maxPooledBuffer = 2 * maxSize
+
+// Take an empty buffer from the pool
+func getBuffer() *bytes.Buffer {
+	buf := bufferPool.Get().(*bytes.Buffer)
+	buf.Reset()
+	return buf
+}
+
+// Give a buffer back to the pool. Its bytes must not be used anymore.
+func putBuffer(buf *bytes.Buffer) {
+	if buf.Cap() <= maxPooledBuffer {
+		bufferPool.Put(buf)
+	}
+}
+
+// Read at most max bytes from a reader in a pooled buffer, and return a copy
+// of exactly their size
+func readBody(r io.Reader, max int64) ([]byte, error) {
+	buf := getBuffer()
+	defer putBuffer(buf)
+
+	_, err := buf.ReadFrom(io.LimitReader(r, max))
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte(nil), buf.Bytes()...), nil
+}
@@ -0,0 +1,94 @@
+package resize
+
+import (
+	"bytes"
+	"context"
+	"image/jpeg"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestReadBody(t *testing.T) {
+	body, err := readBody(strings.NewReader("0123456789"), 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(body) != "0123" {
+		t.Errorf("body = %q, want the first 4 bytes", body)
+	}
+
+	// Not overwritten by the next read in the same buffer
+	if _, err = readBody(strings.NewReader("abcdefghij"), 4); err != nil {
+		t.Fatal(err)
+	}
+	if string(body) != "0123" {
+		t.Errorf("body = %q after another read, want 0123", body)
+	}
+}
+
+func TestPooledBuffersAreNotShared(t *testing.T) {
+	s := newTestServer(Config{MaxPixels: 1 << 20}, newMemoryCache())
+	opts := ResizeOptions{Width: 30, Height: 30, Quality: defaultQuality}
+	origs := [][]byte{pngImage(t, 40, 20), jpegImage(t, 60, 50), pngImage(t, 80, 90), jpegImage(t, 50, 70)}
+
+	// Resized one at a time first, to compare with the concurrent resizes
+	want := make([][]byte, len(origs))
+	for i, orig := range origs {
+		_, body, err := s.resizeImage(context.Background(), "", string(orig), Headers{}, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want[i] = body
+	}
+
+	var wg sync.WaitGroup
+	for n := 0; n < 20; n++ {
+		for i, orig := range origs {
+			wg.Add(1)
+			go func(i int, orig []byte) {
+				defer wg.Done()
+				_, body, err := s.resizeImage(context.Background(), "", string(orig), Headers{}, opts)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				if !bytes.Equal(body, want[i]) {
+					t.Errorf("image %d: the concurrent resize differs", i)
+				}
+			}(i, orig)
+		}
+	}
+	wg.Wait()
+
+	// Nor changed by the resizes after them
+	for i, orig := range origs {
+		_, body, err := s.resizeImage(context.Background(), "", string(orig), Headers{}, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(body, want[i]) {
+			t.Errorf("image %d: the resize differs from the first one", i)
+		}
+	}
+}
+
+// The encode buffers come from the pool: the allocations per resize don't
+// include a buffer growing to the size of the image
+func BenchmarkResize(b *testing.B) {
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, gradient(1000, 1000), nil); err != nil {
+		b.Fatal(err)
+	}
+	orig := buf.String()
+	s := newTestServer(Config{}, newMemoryCache())
+	opts := ResizeOptions{Width: 500, Height: 500, Quality: defaultQuality}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, _, err := s.resizeImage(context.Background(), "", orig, Headers{}, opts); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
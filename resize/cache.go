@@ -0,0 +1,579 @@
+package resize
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log/slog"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"time"
+)
+
+// A cache for the images and the errors of their URLs
+type Cache interface {
+	// Get the headers and the body cached under the key
+	Get(key string) (Headers, []byte, bool)
+
+	// Cache the headers and the body under the key. It is called in the
+	// background, so it may block.
+	Set(key string, headers Headers, body []byte)
+
+	// Get the error cached for an URL, nil if there is none
+	GetError(uri string) error
+
+	// Cache the error of an URL for ttl seconds, in the background too
+	SetError(uri string, err error, ttl int)
+}
+
+// A cache able to report the health of its components
+type HealthChecker interface {
+	// Check each component, mapping their names to an error or nil
+	Check() map[string]error
+}
+
+// A cache able to remove all the variations of an image
+type Purger interface {
+	// Remove the variations of the image at uri, returning how many were removed
+	Purge(uri string) (int, error)
+}
+
+// A cache able to open the files of its images, to stream them rather than
+// read them in memory
+type Opener interface {
+	// Open the file cached under the key, with its headers. The file must be
+	// closed by the caller.
+	Open(key string) (Headers, *os.File, bool)
+}
+
+// A cache able to track the resized variations of an image, to remove them
+// when the original changes
+type VariationTracker interface {
+	// Remember a resized variation of the image at uri
+	AddVariation(uri, variation string)
+
+	// Remove the resized variations of the image at uri, returning how many
+	// were removed
+	RemoveVariations(uri string) (int, error)
+}
+
+// The errors of the URLs, stored in redis
+type redisErrors struct {
+	// The connection to redis
+	connection *RedisConn
+
+	// The prefix of the keys in redis, to share it between deployments
+	prefix string
+
+	// The maximal number of errors, or 0 for no limit
+	maxErrors int
+}
+
+// The default maximal number of errors in redis, as each URL failing has its
+// own key
+const DefaultMaxErrors = 100000
+
+// Set the maximal number of errors kept in redis, the ones expiring first
+// being removed beyond it, or 0 for no limit
+func (c *redisErrors) SetMaxErrors(max int) {
+	c.maxErrors = max
+}
+
+// The default number of levels of directories of the disk cache
+const defaultShardingDepth = 3
+
+// The error returned for a number of levels of directories beyond the hash
+var errInvalidDepth = errors.New("Invalid sharding depth")
+
+// The default prefix of the keys in redis
+const DefaultRedisPrefix = "img/"
+
+// Return the redis key for a name, in the namespace of the cache
+func (c redisErrors) redisKey(name string) string {
+	return c.prefix + name
+}
+
+// The cache storing the bodies in files and the other infos in redis
+type DiskCache struct {
+	redisErrors
+
+	// The directory for caching files
+	directory string
+
+	// The time after which the images expire, or 0 to keep them
+	ttl time.Duration
+
+	// The number of levels of directories
+	depth int
+
+	// Whether the files are evicted by the janitor, which needs their keys
+	// to forget their infos in redis
+	evicting bool
+}
+
+// Create a cache storing its files in directory, and the other infos in
+// redis under keys starting with prefix
+func NewDiskCache(directory string, connection *RedisConn, prefix string) *DiskCache {
+	return &DiskCache{redisErrors: redisErrors{connection, prefix, DefaultMaxErrors}, directory: directory, depth: defaultShardingDepth}
+}
+
+// Set the number of levels of directories, each one named after a byte of
+// the hash of the keys. The files already cached with another depth are lost.
+func (c *DiskCache) SetShardingDepth(depth int) error {
+	if depth < 0 || depth >= sha256.Size {
+		return errInvalidDepth
+	}
+	c.depth = depth
+	return nil
+}
+
+// Make the cached images expire after ttl. They are removed from disk
+// when they are requested after that, or evicted.
+func (c *DiskCache) SetTTL(ttl time.Duration) {
+	c.ttl = ttl
+}
+
+// Generate the key identifying a variation of an image
+func cacheKey(uri, variation string) string {
+	return variation + "/" + uri
+}
+
+// The version of the scheme of the hashed paths, to bump when the keys of the
+// same variations change, so that the files cached with the previous scheme
+// are not reused. Version 1 prefixed the SHA-256 of the keys with it, where
+// the SHA-1 of the bare keys was used before: these files are no longer
+// found, and are only removed by the evictions.
+const cacheKeyVersion = 1
+
+// Generate a hashed path for cache from a string, with a directory level
+// for each of the first depth bytes of the hash
+func hashKey(s string, depth int) string {
+	return hashVersionedKey(s, cacheKeyVersion, depth)
+}
+
+// Generate a hashed path for cache from a string with a version of the
+// scheme of the paths
+func hashVersionedKey(s string, version byte, depth int) string {
+	h := sha256.New()
+	h.Write([]byte{version})
+	io.WriteString(h, s)
+	key := h.Sum(nil)
+
+	// Use levels of hashing to avoid having too many files in the same directory
+	parts := make([]string, 0, depth+1)
+	for i := 0; i < depth; i++ {
+		parts = append(parts, fmt.Sprintf("%x", key[i:i+1]))
+	}
+	parts = append(parts, fmt.Sprintf("%x", key[depth:]))
+	return strings.Join(parts, "/")
+}
+
+// Generate a filename for cache from a string
+func (c *DiskCache) generateKeyForCache(s string) string {
+	return c.directory + "/" + hashKey(s, c.depth)
+}
+
+// Fetch image from cache
+func (c *DiskCache) Get(key string) (headers Headers, body []byte, ok bool) {
+	filename, stat, infos, ok := c.lookup(key)
+	if !ok {
+		return
+	}
+
+	body, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return headers, nil, false
+	}
+
+	// The file is enough to serve the image if redis is unavailable or has
+	// lost its infos
+	if infos["type"] == "" {
+		slog.Debug("Missing infos in cache", "key", key)
+		infos = map[string]string{"type": detectContentType(body)}
+	}
+
+	return fileHeaders(stat, infos), body, true
+}
+
+// Open the cached file of an image to stream it, rather than reading it
+func (c *DiskCache) Open(key string) (headers Headers, file *os.File, ok bool) {
+	filename, stat, infos, ok := c.lookup(key)
+	if !ok {
+		return
+	}
+
+	file, err := os.Open(filename)
+	if err != nil {
+		return headers, nil, false
+	}
+
+	if infos["type"] == "" {
+		slog.Debug("Missing infos in cache", "key", key)
+		// The type is detected from the beginning of the file, long enough
+		// for the prolog of most SVG files
+		head := make([]byte, 4096)
+		n, _ := io.ReadFull(file, head)
+		if _, err = file.Seek(0, io.SeekStart); err != nil {
+			file.Close()
+			return headers, nil, false
+		}
+		infos = map[string]string{"type": detectContentType(head[:n])}
+	}
+
+	return fileHeaders(stat, infos), file, true
+}
+
+// Find the file of an image and its infos in redis, forgetting the file if
+// its infos expired
+func (c *DiskCache) lookup(key string) (filename string, stat os.FileInfo, infos map[string]string, ok bool) {
+	filename = c.generateKeyForCache(key)
+	stat, err := os.Stat(filename)
+	if err != nil {
+		return
+	}
+
+	infos, err = c.connection.Call("HGETALL", c.redisKey(key)).Hash()
+
+	// The infos in redis expire with the image
+	if err == nil && infos["type"] == "" && c.ttl > 0 {
+		slog.Debug("Expired in cache", "key", key)
+		os.Remove(filename)
+		c.forgetKey(key)
+		return
+	}
+	if infos == nil {
+		infos = map[string]string{}
+	}
+	ok = true
+
+	return
+}
+
+// The headers of a cached file, from its infos in redis
+func fileHeaders(stat os.FileInfo, infos map[string]string) (headers Headers) {
+	headers.ContentType = infos["type"]
+	headers.CacheControl = infos["cache_control"]
+	headers.ETag = infos["etag"]
+	headers.FetchedAt = stat.ModTime()
+	headers.LastModified = infos["last_modified"]
+	if headers.LastModified == "" {
+		headers.LastModified = stat.ModTime().Format(time.RFC1123)
+	}
+	return
+}
+
+// Save the body on disk, and the headers in redis
+func (c *DiskCache) Set(key string, headers Headers, body []byte) {
+	filename := c.generateKeyForCache(key)
+	dirname := path.Dir(filename)
+	err := os.MkdirAll(dirname, 0755)
+	if err != nil {
+		return
+	}
+
+	// Save the body on disk
+	err = ioutil.WriteFile(filename, body, 0644)
+	if err != nil {
+		slog.Error("Error while writing", "filename", filename, "error", err)
+		return
+	}
+
+	// And other infos in redis
+	c.connection.Call("HMSET", c.redisKey(key), "type", headers.ContentType, "cache_control", headers.CacheControl,
+		"last_modified", headers.LastModified, "etag", headers.ETag)
+	if c.ttl > 0 {
+		c.connection.Call("EXPIRE", c.redisKey(key), int(c.ttl.Seconds()))
+	}
+
+	// Remember the key of the file, to forget its infos when it is evicted
+	if c.evicting {
+		c.connection.Call("HSET", c.redisKey("files"), hashKey(key, c.depth), key)
+	}
+}
+
+// Remember a resized variation of an image in a set of its variations in
+// redis, expiring with the variations
+func (c *DiskCache) AddVariation(uri, variation string) {
+	c.connection.Call("SADD", c.redisKey("variations/"+uri), variation)
+	if c.ttl > 0 {
+		c.connection.Call("EXPIRE", c.redisKey("variations/"+uri), int(c.ttl.Seconds()))
+	}
+}
+
+// Remove the resized variations of an image remembered in redis
+func (c *DiskCache) RemoveVariations(uri string) (int, error) {
+	variations, err := c.connection.Call("SMEMBERS", c.redisKey("variations/"+uri)).List()
+	if err != nil {
+		return 0, err
+	}
+
+	count := 0
+	for _, variation := range variations {
+		if err = c.remove(cacheKey(uri, variation)); err != nil {
+			return count, err
+		}
+		count++
+	}
+	c.connection.Call("DEL", c.redisKey("variations/"+uri))
+
+	return count, nil
+}
+
+// Remove a variation of an image: its file and its infos in redis
+func (c *DiskCache) remove(key string) error {
+	err := os.Remove(c.generateKeyForCache(key))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	err = c.connection.Call("DEL", c.redisKey(key)).Err
+	if err != nil {
+		return err
+	}
+	c.forgetKey(key)
+	return nil
+}
+
+// Forget the key of a removed file, remembered for the janitor
+func (c *DiskCache) forgetKey(key string) {
+	if c.evicting {
+		c.connection.Call("HDEL", c.redisKey("files"), hashKey(key, c.depth))
+	}
+}
+
+// Remove all the variations of an image, and the error of its URL. The
+// resized variations are found in the set of its variations, rather than by
+// scanning all the keys in redis.
+func (c *DiskCache) Purge(uri string) (int, error) {
+	count, err := c.RemoveVariations(uri)
+	if err != nil {
+		return count, err
+	}
+
+	// The original is only counted if it was cached
+	key := cacheKey(uri, "orig")
+	if _, err = os.Stat(c.generateKeyForCache(key)); err == nil {
+		count++
+	}
+	if err = c.remove(key); err != nil {
+		return count, err
+	}
+	c.connection.Call("DEL", c.redisKey("err/"+uri))
+
+	return count, nil
+}
+
+// An error cached in redis, with the HTTP status to respond with
+type cachedError struct {
+	Status  int    `json:"status"`
+	Message string `json:"message"`
+}
+
+// Check if an URL is valid and not temporary in error
+func (c redisErrors) GetError(uri string) error {
+
+	str, err := c.connection.Call("GET", c.redisKey("err/"+uri)).Str()
+	if err != nil {
+		return nil
+	}
+
+	// The errors cached by the previous versions are only a message
+	var cached cachedError
+	if json.Unmarshal([]byte(str), &cached) != nil || cached.Status == 0 {
+		return errors.New(str)
+	}
+	return &FetchError{cached.Status, cached.Message}
+}
+
+// Save the error in redis for ttl seconds, with its status
+func (c redisErrors) SetError(uri string, err error, ttl int) {
+	value, _ := json.Marshal(cachedError{errorStatus(err), err.Error()})
+	key := c.redisKey("err/" + uri)
+	// Set with its expiry at once, so that it can't be left without one
+	c.connection.Call("SET", key, string(value), "EX", ttl)
+	if c.maxErrors > 0 {
+		c.limitErrors(key, ttl)
+	}
+}
+
+// Index an error by its expiry in a sorted set, and remove the ones expiring
+// first when there are too many
+func (c redisErrors) limitErrors(key string, ttl int) {
+	index := c.redisKey("errors")
+	now := time.Now().Unix()
+	c.connection.Call("ZADD", index, now+int64(ttl), key)
+	c.connection.Call("ZREMRANGEBYSCORE", index, "-inf", now)
+
+	count, err := c.connection.Call("ZCARD", index).Int()
+	if err != nil || count <= c.maxErrors {
+		return
+	}
+	keys, err := c.connection.Call("ZRANGE", index, 0, count-c.maxErrors-1).List()
+	if err != nil || len(keys) == 0 {
+		return
+	}
+	args := make([]interface{}, len(keys))
+	for i, key := range keys {
+		args[i] = key
+	}
+	c.connection.Call("DEL", args...)
+	c.connection.Call("ZREM", append([]interface{}{index}, args...)...)
+}
+
+// Check that redis answers and that the cache directory is writable
+func (c *DiskCache) Check() map[string]error {
+	return map[string]error{
+		"redis":     c.pingRedis(time.Second),
+		"cache_dir": c.checkDirectory(),
+	}
+}
+
+// Ping redis, failing if it doesn't answer before the timeout
+func (c redisErrors) pingRedis(timeout time.Duration) error {
+	done := make(chan error, 1)
+	go func() {
+		done <- c.connection.Call("PING").Err
+	}()
+
+	select {
+	case err := <-done:
+		return err
+	case <-time.After(timeout):
+		return errTimeout
+	}
+}
+
+// Check that files can be written in the cache directory
+func (c *DiskCache) checkDirectory() error {
+	err := os.MkdirAll(c.directory, 0755)
+	if err != nil {
+		return err
+	}
+
+	f, err := ioutil.TempFile(c.directory, ".health")
+	if err != nil {
+		return err
+	}
+	f.Close()
+
+	return os.Remove(f.Name())
+}
+
+// Check if an URL is valid and not temporary in error
+func (s *Server) urlStatus(uri string) error {
+	err := s.cache.GetError(uri)
+	if err == nil {
+		return nil
+	}
+
+	// Restore the errors compared by identity
+	if e, ok := fetchErrors[err.Error()]; ok {
+		return e
+	}
+	if e, ok := err.(*FetchError); ok {
+		return e
+	}
+	return &FetchError{http.StatusBadGateway, err.Error()}
+}
+
+// Fetch a variation of an image from cache
+func (s *Server) fetchImageFromCache(uri, variation string) (headers Headers, body []byte, ok bool) {
+	headers, body, ok = s.cache.Get(cacheKey(uri, variation))
+
+	result := "miss"
+	if ok {
+		result = "hit"
+		headers.CacheStatus = "HIT"
+	}
+	cacheLookups.WithLabelValues(variationKind(variation), result).Inc()
+
+	return
+}
+
+// Save a variation of an image in cache, in the background unless the saves
+// are synchronous
+func (s *Server) saveImageInCache(uri, variation string, headers Headers, body []byte) {
+	s.enqueueSave(func() {
+		s.cache.Set(cacheKey(uri, variation), headers, body)
+		if tracker, ok := s.cache.(VariationTracker); ok && variation != "orig" {
+			tracker.AddVariation(uri, variation)
+		}
+	})
+}
+
+// Remove the resized variations of an image whose original changed, in the
+// background unless the saves are synchronous. With several workers, a
+// variation of the previous original queued before may still be saved after.
+func (s *Server) removeVariations(ctx context.Context, uri string) {
+	tracker, ok := s.cache.(VariationTracker)
+	if !ok {
+		return
+	}
+	s.enqueueSave(func() {
+		count, err := tracker.RemoveVariations(uri)
+		if err != nil {
+			logger(ctx).Error("Error while removing the variations", "uri", uri, "error", err)
+			return
+		}
+		logger(ctx).Info("Original changed", "uri", uri, "removed", count)
+	})
+}
+
+// Save the error of an URL in cache for ttl seconds, in the background
+// unless the saves are synchronous
+func (s *Server) saveErrorInCache(uri string, err error, ttl int) {
+	s.enqueueSave(func() {
+		s.cache.SetError(uri, err, ttl)
+	})
+}
+
+// Queue a save for the workers, or drop it if the queue is full as the
+// cache is only an optimization. Synchronous saves are run right away.
+func (s *Server) enqueueSave(save func()) {
+	if s.config.SyncCache {
+		save()
+		return
+	}
+
+	s.saves.Add(1)
+	select {
+	case s.saveQueue <- save:
+		cacheQueueDepth.Inc()
+	default:
+		s.saves.Done()
+		cacheSavesDropped.Inc()
+		slog.Warn("Cache queue full, dropping save")
+	}
+}
+
+// Run the queued saves, one at a time
+func (s *Server) saveWorker() {
+	for save := range s.saveQueue {
+		cacheQueueDepth.Dec()
+		save()
+		s.saves.Done()
+	}
+}
+
+// Wait for the background saves in cache to complete, or for the context
+// to be done
+func (s *Server) WaitForSaves(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		s.saves.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,489 @@
+package resize
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestDiskCacheRoundTrip(t *testing.T) {
+	c := newTestDiskCache(t)
+	uri := "http://example.com/a.png"
+	orig := []byte("original")
+	resized := []byte("resized")
+
+	c.Set(cacheKey(uri, "orig"), Headers{ContentType: "image/png", LastModified: "Mon, 01 Jan 2024 00:00:00 GMT"}, orig)
+	c.Set(cacheKey(uri, "resize/10/10/q85"), Headers{ContentType: "image/jpeg"}, resized)
+
+	headers, body, ok := c.Get(cacheKey(uri, "orig"))
+	if !ok || !bytes.Equal(body, orig) || headers.ContentType != "image/png" || headers.LastModified != "Mon, 01 Jan 2024 00:00:00 GMT" {
+		t.Fatalf("orig: ok=%v body=%q headers=%+v", ok, body, headers)
+	}
+	headers, body, ok = c.Get(cacheKey(uri, "resize/10/10/q85"))
+	if !ok || !bytes.Equal(body, resized) || headers.ContentType != "image/jpeg" {
+		t.Fatalf("resized: ok=%v body=%q headers=%+v", ok, body, headers)
+	}
+	if _, _, ok = c.Get(cacheKey(uri, "resize/20/20/q85")); ok {
+		t.Fatal("another variation was found")
+	}
+}
+
+func TestFetchResizedFromCache(t *testing.T) {
+	ts, requests := newUpstream(t, "image/png", pngImage(t, 40, 20))
+	c := newTestDiskCache(t)
+	s := newTestServer(Config{MaxPixels: 1 << 20}, c)
+	opts := ResizeOptions{Width: 10, Height: 10, Quality: defaultQuality}
+
+	headers, body, err := s.FetchResized(context.Background(), ts.URL, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if headers.CacheStatus != "MISS" {
+		t.Errorf("first X-Cache = %s, want MISS", headers.CacheStatus)
+	}
+	s.WaitForSaves(context.Background())
+
+	_, cached, ok := s.fetchImageFromCache(ts.URL, opts.variation())
+	if !ok || !bytes.Equal(cached, body) {
+		t.Fatal("the resized image was not found in cache")
+	}
+	if _, _, ok = s.fetchImageFromCache(ts.URL, "orig"); !ok {
+		t.Fatal("the original was not found in cache")
+	}
+
+	headers, again, err := s.FetchResized(context.Background(), ts.URL, opts)
+	if err != nil || !bytes.Equal(again, body) || headers.CacheStatus != "HIT" {
+		t.Fatalf("second fetch: err=%v X-Cache=%s", err, headers.CacheStatus)
+	}
+	if *requests != 1 {
+		t.Errorf("%d requests to the distant server, want 1", *requests)
+	}
+}
+
+func TestHandlerUsesTheCacheInterface(t *testing.T) {
+	// Any file written in the working directory would be found here
+	dir := t.TempDir()
+	t.Chdir(dir)
+
+	c := newMemoryCache()
+	s := NewServer(Config{MaxPixels: 1 << 20}, c)
+	uri := testOrigin + "/a.png"
+	cacheOriginal(c, uri, "image/png", pngImage(t, 400, 200))
+
+	w := serve(s.Handler(), "GET", "/resize/"+encodeURL(uri)+"/100/50")
+	if w.Code != 200 {
+		t.Fatalf("status = %d", w.Code)
+	}
+	s.WaitForSaves(context.Background())
+
+	opts := ResizeOptions{Width: 100, Height: 50, Quality: defaultQuality, Mode: "fit", Filter: "nearest"}
+	if _, body, ok := c.Get(cacheKey(uri, opts.variation())); !ok || !bytes.Equal(body, w.Body.Bytes()) {
+		t.Errorf("the resized image was not saved in the cache")
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 0 {
+		t.Errorf("%d files written on disk", len(entries))
+	}
+}
+
+func TestCachedContentType(t *testing.T) {
+	ts, _ := newUpstream(t, "image/jpeg", jpegImage(t, 400, 200))
+	s := newTestServer(Config{MaxPixels: 1 << 20}, newMemoryCache())
+	opts := ResizeOptions{Width: 100, Height: 100, Quality: defaultQuality}
+
+	if _, _, err := s.FetchResized(context.Background(), ts.URL, opts); err != nil {
+		t.Fatal(err)
+	}
+	s.WaitForSaves(context.Background())
+
+	headers, body, ok := s.fetchImageFromCache(ts.URL, opts.variation())
+	if !ok {
+		t.Fatal("the resized image was not found in cache")
+	}
+	if headers.ContentType != "image/jpeg" {
+		t.Errorf("cached Content-Type = %s, want image/jpeg", headers.ContentType)
+	}
+	decodeImage(t, body, "jpeg")
+}
+
+func TestPurge(t *testing.T) {
+	c := newTestDiskCache(t)
+	s := NewServer(Config{MaxPixels: 1 << 20, SyncCache: true}, c)
+	uri := testOrigin + "/a.png"
+	cacheOriginal(c, uri, "image/png", pngImage(t, 400, 200))
+	for _, size := range []string{"/100/50", "/50/25"} {
+		if w := serve(s.Handler(), "GET", "/resize/"+encodeURL(uri)+size); w.Code != 200 {
+			t.Fatalf("%s: status = %d", size, w.Code)
+		}
+	}
+	variations := []string{"orig", ResizeOptions{Width: 100, Height: 50, Quality: defaultQuality, Mode: "fit", Gravity: "center", Filter: "nearest"}.variation(), ResizeOptions{Width: 50, Height: 25, Quality: defaultQuality, Mode: "fit", Gravity: "center", Filter: "nearest"}.variation()}
+	for _, variation := range variations {
+		if _, _, ok := c.Get(cacheKey(uri, variation)); !ok {
+			t.Fatalf("%s not cached", variation)
+		}
+	}
+
+	w := serve(s.Handler(), "DELETE", "/cache/"+encodeURL(uri))
+	var result map[string]int
+	decodeJSON(t, w, &result)
+	if w.Code != 200 || result["removed"] != 3 {
+		t.Fatalf("status = %d, removed = %d, want 3", w.Code, result["removed"])
+	}
+	for _, variation := range variations {
+		key := cacheKey(uri, variation)
+		if _, err := os.Stat(c.generateKeyForCache(key)); !os.IsNotExist(err) {
+			t.Errorf("%s: file still on disk", variation)
+		}
+		if infos, _ := c.connection.Call("HGETALL", c.redisKey(key)).Hash(); len(infos) != 0 {
+			t.Errorf("%s: infos still in redis: %v", variation, infos)
+		}
+	}
+
+	if w := serve(s.Handler(), "DELETE", "/cache/"+encodeURL(uri)); w.Code != 404 {
+		t.Errorf("second purge: status = %d, want 404", w.Code)
+	}
+}
+
+func TestS3CachePurge(t *testing.T) {
+	c := NewS3Cache(newMockS3Client(t), "images", newTestRedis(t), testPrefix(t))
+	s := NewServer(Config{MaxPixels: 1 << 20, SyncCache: true}, c)
+	uri := testOrigin + "/a.png"
+	cacheOriginal(c, uri, "image/png", pngImage(t, 400, 200))
+	for _, size := range []string{"/100/50", "/50/25"} {
+		if w := serve(s.Handler(), "GET", "/resize/"+encodeURL(uri)+size); w.Code != 200 {
+			t.Fatalf("%s: status = %d", size, w.Code)
+		}
+	}
+	variations := []string{"orig", ResizeOptions{Width: 100, Height: 50, Quality: defaultQuality, Mode: "fit", Gravity: "center", Filter: "nearest"}.variation(), ResizeOptions{Width: 50, Height: 25, Quality: defaultQuality, Mode: "fit", Gravity: "center", Filter: "nearest"}.variation()}
+	for _, variation := range variations {
+		if _, _, ok := c.Get(cacheKey(uri, variation)); !ok {
+			t.Fatalf("%s not cached", variation)
+		}
+	}
+
+	w := serve(s.Handler(), "DELETE", "/cache/"+encodeURL(uri))
+	var result map[string]int
+	decodeJSON(t, w, &result)
+	if w.Code != 200 || result["removed"] != 3 {
+		t.Fatalf("status = %d, removed = %d, want 3", w.Code, result["removed"])
+	}
+	for _, variation := range variations {
+		if _, _, ok := c.Get(cacheKey(uri, variation)); ok {
+			t.Errorf("%s: object still in the bucket", variation)
+		}
+	}
+
+	if w := serve(s.Handler(), "DELETE", "/cache/"+encodeURL(uri)); w.Code != 404 {
+		t.Errorf("second purge: status = %d, want 404", w.Code)
+	}
+}
+
+// A cache whose saves block until it is released
+type blockingCache struct {
+	*memoryCache
+	release chan struct{}
+	saves   int32
+}
+
+func (c *blockingCache) Set(key string, headers Headers, body []byte) {
+	<-c.release
+	atomic.AddInt32(&c.saves, 1)
+	c.memoryCache.Set(key, headers, body)
+}
+
+func (c *blockingCache) SetError(uri string, err error, ttl int) {
+	<-c.release
+	atomic.AddInt32(&c.saves, 1)
+	c.memoryCache.SetError(uri, err, ttl)
+}
+
+func TestSaveQueueIsBounded(t *testing.T) {
+	c := &blockingCache{memoryCache: newMemoryCache(), release: make(chan struct{})}
+	s := NewServer(Config{CacheWorkers: 2, CacheQueueSize: 10}, c)
+	before := runtime.NumGoroutine()
+
+	for i := 0; i < 1000; i++ {
+		uri := fmt.Sprintf("%s/%d.png", testOrigin, i)
+		s.saveImageInCache(uri, "orig", Headers{ContentType: "image/png"}, []byte("png"))
+		s.saveErrorInCache(uri, errNotFound, errorTTL)
+	}
+	// With some slack for the goroutines of the other tests
+	if n := runtime.NumGoroutine(); n > before+10 {
+		t.Errorf("%d goroutines after the saves, %d before", n, before)
+	}
+
+	close(c.release)
+	if err := s.WaitForSaves(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	// The saves being run by the workers, and the ones in the queue
+	if saves := atomic.LoadInt32(&c.saves); saves == 0 || saves > 12 {
+		t.Errorf("%d saves, want at most 12", saves)
+	}
+}
+
+func TestRedisPrefix(t *testing.T) {
+	connection := newTestRedis(t)
+	prefix := testPrefix(t)
+	c := NewDiskCache(t.TempDir(), connection, prefix+"a/")
+	other := NewDiskCache(t.TempDir(), connection, prefix+"b/")
+	uri := "http://example.com/a.png"
+
+	c.Set(cacheKey(uri, "orig"), Headers{ContentType: "image/png"}, []byte("png"))
+	c.SetError(uri, errNotFound, errorTTL)
+
+	if infos, _ := connection.Call("HGETALL", prefix+"a/orig/"+uri).Hash(); infos["type"] != "image/png" {
+		t.Errorf("infos under the prefix = %v", infos)
+	}
+	if value, _ := connection.Call("GET", prefix+"a/err/"+uri).Str(); value == "" {
+		t.Error("no error under the prefix")
+	}
+	if err := c.GetError(uri); err == nil || errorStatus(err) != 404 {
+		t.Errorf("err = %v, want %v", err, errNotFound)
+	}
+
+	// Nothing is shared with another namespace
+	if err := other.GetError(uri); err != nil {
+		t.Errorf("err in another namespace = %v", err)
+	}
+	if infos, _ := connection.Call("HGETALL", prefix+"b/orig/"+uri).Hash(); len(infos) != 0 {
+		t.Errorf("infos in another namespace = %v", infos)
+	}
+}
+
+func TestDiskCacheWithoutInfos(t *testing.T) {
+	c := newTestDiskCache(t)
+	key := cacheKey("http://example.com/a.png", "orig")
+	png := pngImage(t, 10, 10)
+	c.Set(key, Headers{ContentType: "image/x-png"}, png)
+	c.connection.Call("DEL", c.redisKey(key))
+
+	headers, body, ok := c.Get(key)
+	if !ok || !bytes.Equal(body, png) {
+		t.Fatal("miss without the infos in redis")
+	}
+	if headers.ContentType != "image/png" {
+		t.Errorf("Content-Type = %s, want the sniffed image/png", headers.ContentType)
+	}
+}
+
+func TestDiskCacheWithoutRedis(t *testing.T) {
+	// A connection waiting to reconnect fails the commands
+	unavailable := &RedisConn{retryAt: time.Now().Add(time.Hour)}
+	c := NewDiskCache(t.TempDir(), unavailable, DefaultRedisPrefix)
+	key := cacheKey("http://example.com/a.jpg", "orig")
+	jpeg := jpegImage(t, 10, 10)
+	c.Set(key, Headers{ContentType: "image/jpeg"}, jpeg)
+
+	headers, body, ok := c.Get(key)
+	if !ok || !bytes.Equal(body, jpeg) || headers.ContentType != "image/jpeg" {
+		t.Errorf("ok = %v, Content-Type = %s", ok, headers.ContentType)
+	}
+}
+
+func TestDiskCacheTTL(t *testing.T) {
+	c := newTestDiskCache(t)
+	c.SetTTL(time.Minute)
+	key := cacheKey("http://example.com/a.png", "orig")
+	c.Set(key, Headers{ContentType: "image/png"}, []byte("png"))
+	if _, _, ok := c.Get(key); !ok {
+		t.Fatal("miss before the expiry")
+	}
+
+	// As if the infos had expired in redis
+	c.connection.Call("DEL", c.redisKey(key))
+
+	if _, _, ok := c.Get(key); ok {
+		t.Error("hit after the expiry")
+	}
+	if _, err := os.Stat(c.generateKeyForCache(key)); !os.IsNotExist(err) {
+		t.Error("the expired file was not removed")
+	}
+}
+
+func TestShardingDepth(t *testing.T) {
+	for _, depth := range []int{0, 2, 3} {
+		c := newTestDiskCache(t)
+		if err := c.SetShardingDepth(depth); err != nil {
+			t.Fatal(err)
+		}
+		uri := "http://example.com/a.png"
+		key := cacheKey(uri, "orig")
+		c.Set(key, Headers{ContentType: "image/png"}, []byte("png"))
+
+		if _, body, ok := c.Get(key); !ok || string(body) != "png" {
+			t.Errorf("depth %d: miss after saving", depth)
+		}
+		rel, _ := filepath.Rel(c.directory, c.generateKeyForCache(key))
+		if levels := strings.Count(filepath.ToSlash(rel), "/"); levels != depth {
+			t.Errorf("depth %d: file at %s", depth, rel)
+		}
+		if count, err := c.Purge(uri); err != nil || count != 1 {
+			t.Errorf("depth %d: purged %d (err = %v)", depth, count, err)
+		}
+		if _, _, ok := c.Get(key); ok {
+			t.Errorf("depth %d: hit after the purge", depth)
+		}
+	}
+
+	c := newTestDiskCache(t)
+	for _, depth := range []int{-1, sha256.Size} {
+		if err := c.SetShardingDepth(depth); err != errInvalidDepth {
+			t.Errorf("depth %d: err = %v, want %v", depth, err, errInvalidDepth)
+		}
+	}
+}
+
+func TestCacheKeyVersion(t *testing.T) {
+	key := cacheKey("http://example.com/a.png", "orig")
+	current := hashKey(key, 2)
+
+	if current != hashVersionedKey(key, cacheKeyVersion, 2) {
+		t.Errorf("path = %s, want the one of version %d", current, cacheKeyVersion)
+	}
+	bumped := hashVersionedKey(key, cacheKeyVersion+1, 2)
+	if bumped == current {
+		t.Errorf("same path %s after bumping the version", bumped)
+	}
+	// Still sharded
+	if levels := strings.Count(bumped, "/"); levels != 2 {
+		t.Errorf("path = %s, want 2 levels of directories", bumped)
+	}
+}
+
+func TestCachedErrorStatus(t *testing.T) {
+	connection := newTestRedis(t)
+	prefix := testPrefix(t)
+	c := NewDiskCache(t.TempDir(), connection, prefix)
+	uri := "http://example.com/a.png"
+
+	for _, cached := range []error{errNotFound, errUnexpectedStatus, errTimeout} {
+		c.SetError(uri, cached, errorTTL)
+		if err := c.GetError(uri); err == nil || errorStatus(err) != errorStatus(cached) || err.Error() != cached.Error() {
+			t.Errorf("err = %v with status %d, want %v with status %d", err, errorStatus(err), cached, errorStatus(cached))
+		}
+	}
+
+	// Cached as a bare message by the previous versions
+	connection.Call("SET", prefix+"err/"+uri, "Not found", "EX", errorTTL)
+	if err := c.GetError(uri); err == nil || errorStatus(err) != 502 {
+		t.Errorf("err = %v with status %d, want a 502", err, errorStatus(err))
+	}
+}
+
+func TestSyncCache(t *testing.T) {
+	ts, requests := newUpstream(t, "image/png", pngImage(t, 40, 20))
+	s := newTestServer(Config{MaxPixels: 1 << 20, SyncCache: true}, newTestDiskCache(t))
+	opts := ResizeOptions{Width: 10, Height: 10, Quality: defaultQuality}
+
+	if _, _, err := s.FetchResized(context.Background(), ts.URL, opts); err != nil {
+		t.Fatal(err)
+	}
+	// Without waiting for the saves
+	headers, _, err := s.FetchResized(context.Background(), ts.URL, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if headers.CacheStatus != "HIT" || *requests != 1 {
+		t.Errorf("X-Cache = %s after %d requests, want a HIT after 1", headers.CacheStatus, *requests)
+	}
+	if _, _, ok := s.cache.Get(cacheKey(ts.URL, "orig")); !ok {
+		t.Error("the original is not cached yet")
+	}
+}
+
+func TestMaxErrors(t *testing.T) {
+	connection := newTestRedis(t)
+	prefix := testPrefix(t)
+	c := NewDiskCache(t.TempDir(), connection, prefix)
+	c.SetMaxErrors(10)
+
+	for i := 0; i < 50; i++ {
+		c.SetError(fmt.Sprintf("http://example.com/%d.png", i), errNotFound, errorTTL)
+	}
+
+	if count, _ := connection.Call("ZCARD", prefix+"errors").Int(); count != 10 {
+		t.Errorf("%d errors indexed, want 10", count)
+	}
+	// The oldest ones are removed, the last ones kept
+	if err := c.GetError("http://example.com/0.png"); err != nil {
+		t.Errorf("oldest error still cached: %v", err)
+	}
+	if err := c.GetError("http://example.com/49.png"); err == nil {
+		t.Error("last error not cached")
+	}
+	// With their expiry
+	if ttl, _ := connection.Call("TTL", prefix+"err/http://example.com/49.png").Int(); ttl <= 0 || ttl > errorTTL {
+		t.Errorf("TTL = %d, want at most %d", ttl, errorTTL)
+	}
+}
+
+// Answer with a new version of an image on every request, stale right away
+func changingUpstream(t *testing.T) http.RoundTripper {
+	var requests int32
+	return roundTripFunc(func(r *http.Request) (*http.Response, error) {
+		body := pngImage(t, 20+int(atomic.AddInt32(&requests, 1)), 20)
+		header := http.Header{"Content-Type": {"image/png"}, "Cache-Control": {"max-age=0"}}
+		return &http.Response{StatusCode: 200, Header: header, Body: io.NopCloser(bytes.NewReader(body)), Request: r}, nil
+	})
+}
+
+func TestChangedOriginalRemovesVariations(t *testing.T) {
+	c := newTestDiskCache(t)
+	s := NewServer(Config{MaxPixels: 1 << 20, SyncCache: true, HTTPClient: &http.Client{Transport: changingUpstream(t)}}, c)
+	uri := testOrigin + "/a.png"
+	opts := ResizeOptions{Width: 10, Height: 10, Quality: defaultQuality}
+
+	if _, _, err := s.FetchResized(context.Background(), uri, opts); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, ok := c.Get(cacheKey(uri, opts.variation())); !ok {
+		t.Fatal("the resized image was not cached")
+	}
+
+	// Revalidated as stale, and changed
+	time.Sleep(10 * time.Millisecond)
+	if _, _, err := s.FetchImage(context.Background(), uri); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, ok := c.Get(cacheKey(uri, opts.variation())); ok {
+		t.Error("the variation of the previous original is still cached")
+	}
+}
+
+func TestCachedVariationRevalidatesTheOriginal(t *testing.T) {
+	c := newTestDiskCache(t)
+	s := NewServer(Config{MaxPixels: 1 << 20, SyncCache: true, HTTPClient: &http.Client{Transport: changingUpstream(t)}}, c)
+	uri := testOrigin + "/a.png"
+	opts := ResizeOptions{Width: 10, Height: 10, Quality: defaultQuality}
+
+	if _, _, err := s.FetchResized(context.Background(), uri, opts); err != nil {
+		t.Fatal(err)
+	}
+
+	// Still served from cache, while the stale original is revalidated
+	time.Sleep(10 * time.Millisecond)
+	headers, _, err := s.FetchResized(context.Background(), uri, opts)
+	if err != nil || headers.CacheStatus != "HIT" {
+		t.Fatalf("err = %v, X-Cache = %s, want a HIT", err, headers.CacheStatus)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if _, _, ok := c.Get(cacheKey(uri, opts.variation())); !ok {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("the variation of the previous original is still cached")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
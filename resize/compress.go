@@ -0,0 +1,92 @@
+package resize
+
+import (
+	"compress/gzip"
+	"mime"
+	"net/http"
+	"strings"
+)
+
+// Check if a content-type is worth compressing: the images other than SVG
+// are already compressed
+func isCompressible(contentType string) bool {
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	return strings.HasPrefix(mediaType, "text/") || mediaType == "application/json" ||
+		mediaType == "image/svg+xml"
+}
+
+// A response writer compressing the body with gzip if its content-type is
+// compressible, decided when the headers are written. The partial responses
+// are never compressed: their ranges are the ones of the uncompressed body.
+type gzipResponseWriter struct {
+	http.ResponseWriter
+	gz          *gzip.Writer
+	wroteHeader bool
+
+	// The client accepts gzip
+	accepted bool
+}
+
+func (w *gzipResponseWriter) WriteHeader(status int) {
+	if w.wroteHeader {
+		return
+	}
+	w.wroteHeader = true
+
+	h := w.Header()
+	if h.Get("Content-Encoding") == "" && isCompressible(h.Get("Content-Type")) {
+		h.Add("Vary", "Accept-Encoding")
+		if w.accepted && status != http.StatusNoContent && status != http.StatusNotModified &&
+			status != http.StatusPartialContent && h.Get("Content-Range") == "" {
+			h.Set("Content-Encoding", "gzip")
+			h.Del("Content-Length")
+			w.gz = gzip.NewWriter(w.ResponseWriter)
+		}
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *gzipResponseWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		if w.Header().Get("Content-Type") == "" {
+			w.Header().Set("Content-Type", http.DetectContentType(b))
+		}
+		w.WriteHeader(http.StatusOK)
+	}
+	if w.gz != nil {
+		return w.gz.Write(b)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *gzipResponseWriter) Flush() {
+	if w.gz != nil {
+		w.gz.Flush()
+	}
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Compress the text and JSON responses for the clients accepting gzip
+func withCompression(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gw := &gzipResponseWriter{ResponseWriter: w, accepted: acceptsEncoding(r, "gzip")}
+		defer func() {
+			if gw.gz != nil {
+				gw.gz.Close()
+			}
+		}()
+		h.ServeHTTP(gw, r)
+	})
+}
+
+// Check if the client accepts a content-coding
+func acceptsEncoding(r *http.Request, coding string) bool {
+	for _, encoding := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		if strings.TrimSpace(strings.Split(encoding, ";")[0]) == coding {
+			return true
+		}
+	}
+	return false
+}
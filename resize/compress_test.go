@@ -0,0 +1,79 @@
+package resize
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestCompression(t *testing.T) {
+	c := newMemoryCache()
+	uri := testOrigin + "/a.jpg"
+	cacheOriginal(c, uri, "image/jpeg", jpegImage(t, 80, 40))
+	s := NewServer(Config{MaxPixels: 1 << 20}, c)
+
+	w := serve(s.Handler(), "GET", "/info/"+encodeURL(uri), "Accept-Encoding: gzip")
+	if w.Header().Get("Content-Encoding") != "gzip" || w.Header().Get("Content-Length") != "" {
+		t.Fatalf("JSON: Content-Encoding = %q, Content-Length = %q, want gzip without a length", w.Header().Get("Content-Encoding"), w.Header().Get("Content-Length"))
+	}
+	if !strings.Contains(w.Header().Get("Vary"), "Accept-Encoding") {
+		t.Errorf("JSON: Vary = %q, want Accept-Encoding", w.Header().Get("Vary"))
+	}
+	gz, err := gzip.NewReader(w.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var info imageInfo
+	if err := json.NewDecoder(gz).Decode(&info); err != nil || info.Width != 80 {
+		t.Errorf("JSON: info = %+v, err = %v once decompressed", info, err)
+	}
+
+	// Not without the client accepting it
+	w = serve(s.Handler(), "GET", "/info/"+encodeURL(uri))
+	if w.Header().Get("Content-Encoding") != "" {
+		t.Errorf("JSON without Accept-Encoding: Content-Encoding = %q", w.Header().Get("Content-Encoding"))
+	}
+
+	// Nor for the images, already compressed
+	w = serve(s.Handler(), "GET", "/resize/"+encodeURL(uri)+"/20/20", "Accept-Encoding: gzip")
+	if w.Code != 200 || w.Header().Get("Content-Encoding") != "" {
+		t.Fatalf("JPEG: %d, Content-Encoding = %q", w.Code, w.Header().Get("Content-Encoding"))
+	}
+	decodeImage(t, w.Body.Bytes(), "jpeg")
+}
+
+func TestNoCompressionOfRanges(t *testing.T) {
+	uri := testOrigin + "/a.svg"
+	for _, stream := range []bool{false, true} {
+		var c Cache = newMemoryCache()
+		if stream {
+			c = newTestDiskCache(t)
+		}
+		cacheOriginal(c, uri, "image/svg+xml", []byte(testSVG))
+		s := NewServer(Config{StreamOriginals: stream}, c)
+
+		w := serve(s.Handler(), "GET", "/proxy/"+encodeURL(uri), "Accept-Encoding: gzip", "Range: bytes=0-9")
+		if w.Code != 206 || w.Body.String() != testSVG[:10] {
+			t.Fatalf("stream=%v: status = %d, body = %q, want a 206 with the first 10 bytes", stream, w.Code, w.Body.Bytes())
+		}
+		if w.Header().Get("Content-Encoding") != "" || w.Header().Get("Content-Length") != "10" {
+			t.Errorf("stream=%v: Content-Encoding = %q, Content-Length = %q", stream, w.Header().Get("Content-Encoding"), w.Header().Get("Content-Length"))
+		}
+
+		// Still compressed as a whole
+		w = serve(s.Handler(), "GET", "/proxy/"+encodeURL(uri), "Accept-Encoding: gzip")
+		if w.Code != 200 || w.Header().Get("Content-Encoding") != "gzip" {
+			t.Fatalf("stream=%v: status = %d, Content-Encoding = %q, want gzip", stream, w.Code, w.Header().Get("Content-Encoding"))
+		}
+		gz, err := gzip.NewReader(w.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var body bytes.Buffer
+		if _, err := body.ReadFrom(gz); err != nil || body.String() != testSVG {
+			t.Errorf("stream=%v: the decompressed body differs, err = %v", stream, err)
+		}
+	}
+}
@@ -0,0 +1,215 @@
+package resize
+
+import (
+	"encoding/hex"
+	"image"
+	"image/color"
+	"image/draw"
+	"math"
+	"strings"
+)
+
+// The maximal radius of the blur. Its cost is proportional to the radius
+// for each pixel, so large radii on large images are slow: blurring is
+// meant for small placeholders.
+const maxBlur = 50
+
+// Check if the options ask for effects, that apply even when the image
+// isn't resized
+func (opts ResizeOptions) hasEffects() bool {
+	return opts.Grayscale || opts.Blur > 0 || opts.Background != "" || opts.Watermark != ""
+}
+
+// Apply the effects asked by the options to a resized image
+func applyEffects(m image.Image, opts ResizeOptions) image.Image {
+	if opts.Background != "" {
+		m = flatten(m, opts.background())
+	}
+	if opts.Blur > 0 {
+		m = blur(m, opts.Blur)
+	}
+	if opts.Grayscale {
+		m = grayscale(m)
+	}
+	return m
+}
+
+// Return the color of the background, white by default
+func (opts ResizeOptions) background() color.Color {
+	rgb, err := hex.DecodeString(opts.Background)
+	if err != nil || len(rgb) != 3 {
+		return color.White
+	}
+	return color.RGBA{rgb[0], rgb[1], rgb[2], 255}
+}
+
+// Composite an image over a background color, unless it is opaque
+func flatten(m image.Image, bg color.Color) image.Image {
+	if o, ok := m.(interface{ Opaque() bool }); ok && o.Opaque() {
+		return m
+	}
+	bounds := m.Bounds()
+	flat := image.NewRGBA(bounds)
+	draw.Draw(flat, bounds, image.NewUniform(bg), image.Point{}, draw.Src)
+	draw.Draw(flat, bounds, m, bounds.Min, draw.Over)
+	return flat
+}
+
+// Convert an image to grayscale, weighting the channels by their luminance
+func grayscale(m image.Image) image.Image {
+	if _, ok := m.(*image.Gray); ok {
+		return m
+	}
+	gray := image.NewGray(m.Bounds())
+	draw.Draw(gray, gray.Bounds(), m, m.Bounds().Min, draw.Src)
+	return gray
+}
+
+// Convert the colors of a palette to grayscale, keeping the transparent ones
+func grayscalePalette(p color.Palette) color.Palette {
+	gray := make(color.Palette, len(p))
+	for i, c := range p {
+		if _, _, _, a := c.RGBA(); a == 0 {
+			gray[i] = c
+			continue
+		}
+		gray[i] = color.GrayModel.Convert(c)
+	}
+	return gray
+}
+
+// Apply a gaussian blur spreading each pixel over radius pixels, in two
+// passes: horizontal then vertical
+func blur(m image.Image, radius int) image.Image {
+	bounds := m.Bounds()
+	src := image.NewRGBA(bounds)
+	draw.Draw(src, bounds, m, bounds.Min, draw.Src)
+
+	// Most of a gaussian is within 3 standard deviations
+	sigma := float64(radius) / 3
+	kernel := make([]float64, 2*radius+1)
+	sum := 0.0
+	for i := range kernel {
+		x := float64(i - radius)
+		kernel[i] = math.Exp(-x * x / (2 * sigma * sigma))
+		sum += kernel[i]
+	}
+	for i := range kernel {
+		kernel[i] /= sum
+	}
+
+	tmp := blurPass(src, kernel, 1, 0)
+	return blurPass(tmp, kernel, 0, 1)
+}
+
+// Convolve an image with a kernel in the direction (dx, dy), clamping the
+// coordinates to the edges
+func blurPass(src *image.RGBA, kernel []float64, dx, dy int) *image.RGBA {
+	bounds := src.Bounds()
+	dst := image.NewRGBA(bounds)
+	radius := len(kernel) / 2
+
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			var r, g, b, a float64
+			for i, k := range kernel {
+				sx := clampInt(x+(i-radius)*dx, bounds.Min.X, bounds.Max.X-1)
+				sy := clampInt(y+(i-radius)*dy, bounds.Min.Y, bounds.Max.Y-1)
+				off := src.PixOffset(sx, sy)
+				r += k * float64(src.Pix[off])
+				g += k * float64(src.Pix[off+1])
+				b += k * float64(src.Pix[off+2])
+				a += k * float64(src.Pix[off+3])
+			}
+			off := dst.PixOffset(x, y)
+			dst.Pix[off] = uint8(r + 0.5)
+			dst.Pix[off+1] = uint8(g + 0.5)
+			dst.Pix[off+2] = uint8(b + 0.5)
+			dst.Pix[off+3] = uint8(a + 0.5)
+		}
+	}
+
+	return dst
+}
+
+// The maximal amount of sharpening, in percents of the difference with the
+// blurred image added back
+const maxSharpen = 200
+
+// The radius of the blur of the unsharp mask, enough for the details
+// softened by a downscale
+const sharpenRadius = 2
+
+// Sharpen an image with an unsharp mask: the difference between the image
+// and a blurred copy is added back, amplified by amount percents
+func sharpen(m image.Image, amount int) image.Image {
+	bounds := m.Bounds()
+	src := image.NewRGBA(bounds)
+	draw.Draw(src, bounds, m, bounds.Min, draw.Src)
+	blurred := blur(src, sharpenRadius).(*image.RGBA)
+
+	dst := image.NewRGBA(bounds)
+	k := float64(amount) / 100
+	for i := 0; i < len(src.Pix); i += 4 {
+		for c := 0; c < 3; c++ {
+			v := float64(src.Pix[i+c]) + k*(float64(src.Pix[i+c])-float64(blurred.Pix[i+c]))
+			// The colors are premultiplied by the alpha
+			dst.Pix[i+c] = uint8(clampInt(int(v+0.5), 0, int(src.Pix[i+3])))
+		}
+		dst.Pix[i+3] = src.Pix[i+3]
+	}
+
+	return dst
+}
+
+// Clamp an integer to [min, max]
+func clampInt(v, min, max int) int {
+	if v < min {
+		return min
+	}
+	if v > max {
+		return max
+	}
+	return v
+}
+
+// The positions of the watermark
+var watermarkPositions = map[string]bool{
+	"center":    true,
+	"north":     true,
+	"south":     true,
+	"east":      true,
+	"west":      true,
+	"northeast": true,
+	"northwest": true,
+	"southeast": true,
+	"southwest": true,
+}
+
+// Draw a watermark over an image, at a position and with an opacity in
+// percents
+func overlay(m, watermark image.Image, position string, opacity int) image.Image {
+	bounds := m.Bounds()
+	dst := image.NewRGBA(bounds)
+	draw.Draw(dst, bounds, m, bounds.Min, draw.Src)
+
+	size := watermark.Bounds().Size()
+	x := bounds.Min.X + (bounds.Dx()-size.X)/2
+	y := bounds.Min.Y + (bounds.Dy()-size.Y)/2
+	if strings.HasPrefix(position, "north") {
+		y = bounds.Min.Y
+	} else if strings.HasPrefix(position, "south") {
+		y = bounds.Max.Y - size.Y
+	}
+	if strings.HasSuffix(position, "west") {
+		x = bounds.Min.X
+	} else if strings.HasSuffix(position, "east") {
+		x = bounds.Max.X - size.X
+	}
+
+	mask := image.NewUniform(color.Alpha{uint8(opacity * 255 / 100)})
+	r := image.Rectangle{image.Pt(x, y), image.Pt(x, y).Add(size)}
+	draw.DrawMask(dst, r, watermark, watermark.Bounds().Min, mask, image.Point{}, draw.Over)
+
+	return dst
+}
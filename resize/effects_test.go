@@ -0,0 +1,186 @@
+package resize
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/gif"
+	"image/png"
+	"testing"
+)
+
+// Check that all the pixels of an image are gray
+func isGray(m image.Image) bool {
+	bounds := m.Bounds()
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			r, g, b, _ := m.At(x, y).RGBA()
+			if r != g || g != b {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func TestGrayscale(t *testing.T) {
+	s := newTestServer(Config{MaxPixels: 1 << 20, MaxFrames: 10}, newMemoryCache())
+	opts := ResizeOptions{Width: 20, Height: 20, Quality: defaultQuality, Grayscale: true}
+
+	tests := []struct {
+		contentType string
+		body        []byte
+	}{
+		{"image/jpeg", jpegImage(t, 80, 40)},
+		{"image/png", pngImage(t, 80, 40)},
+	}
+	for _, test := range tests {
+		headers, body := resizeFrom(t, s, test.contentType, test.body, opts)
+		if m, _, err := image.Decode(bytes.NewReader(body)); err != nil || !isGray(m) {
+			t.Errorf("%s: not gray (err = %v)", headers.ContentType, err)
+		}
+	}
+
+	_, body := resizeFrom(t, s, "image/gif", animatedGIF(t, 80, 40, 3), opts)
+	g, err := gif.DecodeAll(bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, frame := range g.Image {
+		if !isGray(frame) {
+			t.Errorf("GIF frame %d not gray", i)
+		}
+	}
+
+	// Unless asked
+	opts.Grayscale = false
+	_, body = resizeFrom(t, s, "image/png", pngImage(t, 80, 40), opts)
+	if isGray(decodeImage(t, body, "png")) {
+		t.Error("gray without the option")
+	}
+}
+
+func TestBlur(t *testing.T) {
+	m := checkerboard(40, 4)
+
+	if d := meanDifference(m, blur(m, 3)); d < 10 {
+		t.Errorf("mean difference = %.2f after a blur", d)
+	}
+	if d := meanDifference(m, applyEffects(m, ResizeOptions{Blur: 0})); d != 0 {
+		t.Errorf("mean difference = %.2f without a blur", d)
+	}
+
+	// And when resizing
+	s := newTestServer(Config{MaxPixels: 1 << 20}, newMemoryCache())
+	_, sharp := resizeFrom(t, s, "image/png", pngImage(t, 80, 40), ResizeOptions{Width: 40, Height: 40, Quality: defaultQuality})
+	_, blurred := resizeFrom(t, s, "image/png", pngImage(t, 80, 40), ResizeOptions{Width: 40, Height: 40, Quality: defaultQuality, Blur: 5})
+	if bytes.Equal(sharp, blurred) {
+		t.Error("same image with a blur")
+	}
+}
+
+// Encode in PNG a transparent image with an opaque red square in its middle
+func transparentPNG(t *testing.T, size int) []byte {
+	t.Helper()
+	m := image.NewNRGBA(image.Rect(0, 0, size, size))
+	for y := size / 4; y < size*3/4; y++ {
+		for x := size / 4; x < size*3/4; x++ {
+			m.SetNRGBA(x, y, color.NRGBA{255, 0, 0, 255})
+		}
+	}
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, m); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestBackground(t *testing.T) {
+	s := newTestServer(Config{MaxPixels: 1 << 20}, newMemoryCache())
+	tests := []struct {
+		background string
+		want       color.NRGBA
+	}{
+		{"ffffff", color.NRGBA{255, 255, 255, 255}},
+		{"0000ff", color.NRGBA{0, 0, 255, 255}},
+		// White by default, rather than black
+		{"", color.NRGBA{255, 255, 255, 255}},
+	}
+	for _, test := range tests {
+		_, body := resizeFrom(t, s, "image/png", transparentPNG(t, 80), ResizeOptions{Width: 40, Height: 40, Quality: defaultQuality, Format: "jpeg", Background: test.background})
+		m := decodeImage(t, body, "jpeg")
+		if !isClose(m.At(0, 0), test.want) {
+			t.Errorf("bg=%s: corner = %v, want %v", test.background, m.At(0, 0), test.want)
+		}
+		if !isClose(m.At(20, 20), color.NRGBA{255, 0, 0, 255}) {
+			t.Errorf("bg=%s: center = %v, want red", test.background, m.At(20, 20))
+		}
+	}
+}
+
+func TestWatermark(t *testing.T) {
+	watermark := image.NewNRGBA(image.Rect(0, 0, 10, 10))
+	draw.Draw(watermark, watermark.Bounds(), image.NewUniform(color.NRGBA{255, 0, 0, 255}), image.Point{}, draw.Src)
+	c := newMemoryCache()
+	s := NewServer(Config{MaxPixels: 1 << 20, Watermark: watermark}, c)
+	uri := testOrigin + "/a.png"
+	cacheOriginal(c, uri, "image/png", pngImage(t, 80, 80))
+	path := "/resize/" + encodeURL(uri) + "/40/40"
+
+	plain := decodeImage(t, serve(s.Handler(), "GET", path).Body.Bytes(), "png")
+	marked := decodeImage(t, serve(s.Handler(), "GET", path+"?wm=southeast,100").Body.Bytes(), "png")
+
+	stamped := image.Rect(30, 30, 40, 40)
+	for y := 0; y < 40; y++ {
+		for x := 0; x < 40; x++ {
+			p := image.Pt(x, y)
+			r1, g1, b1, _ := plain.At(x, y).RGBA()
+			r2, g2, b2, _ := marked.At(x, y).RGBA()
+			same := r1 == r2 && g1 == g2 && b1 == b2
+			if p.In(stamped) && (same || !isClose(marked.At(x, y), color.NRGBA{255, 0, 0, 255})) {
+				t.Fatalf("%v not stamped", p)
+			}
+			if !p.In(stamped) && !same {
+				t.Fatalf("%v changed outside of the watermark", p)
+			}
+		}
+	}
+}
+
+// Return the mean absolute difference of the luminance of the neighbouring
+// pixels of an image
+func localContrast(m image.Image) float64 {
+	bounds := m.Bounds()
+	shifted := image.NewRGBA(bounds)
+	draw.Draw(shifted, bounds, m, bounds.Min.Add(image.Pt(1, 0)), draw.Src)
+	inner := image.Rect(bounds.Min.X, bounds.Min.Y, bounds.Max.X-1, bounds.Max.Y)
+	return meanDifference(subImage(m, inner), subImage(shifted, inner))
+}
+
+// Return the part of an image within a rectangle
+func subImage(m image.Image, r image.Rectangle) image.Image {
+	dst := image.NewRGBA(r)
+	draw.Draw(dst, r, m, r.Min, draw.Src)
+	return dst
+}
+
+func TestSharpen(t *testing.T) {
+	// Soft edges, as after a downscale
+	m := blur(checkerboard(40, 8), 2)
+
+	if before, after := localContrast(m), localContrast(sharpen(m, 100)); after <= before {
+		t.Errorf("local contrast = %.2f after sharpening, %.2f before", after, before)
+	}
+	if d := meanDifference(m, sharpen(m, 0)); d != 0 {
+		t.Errorf("mean difference = %.2f with an amount of 0", d)
+	}
+
+	// And when resizing
+	s := newTestServer(Config{MaxPixels: 1 << 20}, newMemoryCache())
+	_, soft := resizeFrom(t, s, "image/png", pngImage(t, 80, 40), ResizeOptions{Width: 40, Height: 40, Quality: defaultQuality})
+	_, sharpened := resizeFrom(t, s, "image/png", pngImage(t, 80, 40), ResizeOptions{Width: 40, Height: 40, Quality: defaultQuality, Sharpen: 100})
+	if bytes.Equal(soft, sharpened) {
+		t.Error("same image with sharpening")
+	}
+}
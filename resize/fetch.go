@@ -0,0 +1,553 @@
+package resize
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// An error while fetching an image, with the HTTP status to respond with
+type FetchError struct {
+	StatusCode int
+	Message    string
+}
+
+func (e *FetchError) Error() string {
+	return e.Message
+}
+
+// The errors returned while fetching images
+var (
+	errInvalidURL       = &FetchError{http.StatusBadRequest, "Invalid URL"}
+	errForbiddenHost    = &FetchError{http.StatusForbidden, "Forbidden host"}
+	errNotFound         = &FetchError{http.StatusNotFound, "Not found"}
+	errUnexpectedStatus = &FetchError{http.StatusBadGateway, "Unexpected status code"}
+	errTimeout          = &FetchError{http.StatusBadGateway, "Timeout"}
+	errMaxSize          = &FetchError{http.StatusBadGateway, "Exceeded max size"}
+	errContentType      = &FetchError{http.StatusBadGateway, "Invalid content-type"}
+	errInvalidImage     = &FetchError{http.StatusBadGateway, "Invalid image"}
+	errTooBusy          = &FetchError{http.StatusServiceUnavailable, "Too many concurrent resizes"}
+	errMaxPixels        = &FetchError{http.StatusBadRequest, "Exceeded max pixels"}
+	errRateLimited      = &FetchError{http.StatusTooManyRequests, "Too many fetches on this host"}
+	errImageTooLarge    = &FetchError{http.StatusBadGateway, "Image too large"}
+	errDecodeTimeout    = &FetchError{http.StatusBadGateway, "Decode timeout"}
+	errCircuitOpen      = &FetchError{http.StatusServiceUnavailable, "Host failing"}
+	errTooManyRedirects = &FetchError{http.StatusBadGateway, "Too many redirects"}
+	errRedirectLoop     = &FetchError{http.StatusBadGateway, "Redirect loop"}
+)
+
+// The errors restored from their message when they are cached
+var fetchErrors = map[string]*FetchError{}
+
+func init() {
+	for _, err := range []*FetchError{errInvalidURL, errForbiddenHost, errNotFound, errUnexpectedStatus, errTimeout, errMaxSize, errContentType, errInvalidImage, errImageTooLarge, errDecodeTimeout, errTooManyRedirects, errRedirectLoop} {
+		fetchErrors[err.Message] = err
+	}
+}
+
+// Return the HTTP status to respond with for an error
+func errorStatus(err error) int {
+	if e, ok := err.(*FetchError); ok {
+		return e.StatusCode
+	}
+	return http.StatusBadGateway
+}
+
+// The schemes of the URLs images are fetched from, unless configured
+var defaultSchemes = []string{"http", "https"}
+
+// Check if the scheme of an URL is allowed
+func (s *Server) isAllowedScheme(scheme string) bool {
+	schemes := s.config.AllowedSchemes
+	if len(schemes) == 0 {
+		schemes = defaultSchemes
+	}
+
+	for _, allowed := range schemes {
+		if strings.EqualFold(scheme, allowed) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Check if a host is in the allowlist
+func (s *Server) isAllowedHost(host string) bool {
+	if len(s.config.AllowedHosts) == 0 {
+		return true
+	}
+
+	for _, allowed := range s.config.AllowedHosts {
+		allowed = strings.TrimPrefix(allowed, ".")
+		if host == allowed || strings.HasSuffix(host, "."+allowed) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Return the Authorization header to send to a distant host, or empty if it
+// doesn't require one
+func (s *Server) upstreamAuth(host string) string {
+	for h, auth := range s.config.UpstreamAuth {
+		if strings.EqualFold(h, host) {
+			return auth
+		}
+	}
+	return ""
+}
+
+// Check if an IP is in a private, loopback or link-local range
+func isPrivateIP(ip net.IP) bool {
+	return ip.IsPrivate() || ip.IsLoopback() || ip.IsLinkLocalUnicast() ||
+		ip.IsLinkLocalMulticast() || ip.IsUnspecified()
+}
+
+// Check that an URL is absolute, with an allowed scheme, and points to an
+// allowed host that doesn't resolve to a private address, to avoid being
+// used to reach internal services or files
+func (s *Server) validateURL(ctx context.Context, uri string) error {
+	if err := s.urlStatus(uri); err != nil {
+		if err == errForbiddenHost || err == errInvalidURL {
+			return err
+		}
+		return nil
+	}
+
+	u, err := url.Parse(uri)
+	if err != nil {
+		err = errInvalidURL
+	} else {
+		err = s.checkURL(u)
+	}
+
+	switch err {
+	case errInvalidURL:
+		logger(ctx).Warn("Invalid URL", "uri", uri)
+		s.saveErrorInCache(uri, err, errorTTL)
+	case errForbiddenHost:
+		logger(ctx).Warn("Forbidden host", "uri", uri)
+		s.saveErrorInCache(uri, err, errorTTL)
+	}
+	return err
+}
+
+// Refuse to connect to a private address, checked on the address actually
+// dialed: the host of an URL may resolve to another address than when the
+// URL was checked
+func checkDialedAddress(network, address string, conn syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	if ip := net.ParseIP(host); ip == nil || isPrivateIP(ip) {
+		return errForbiddenHost
+	}
+	return nil
+}
+
+// Check that an URL is absolute, with an allowed scheme, and points to an
+// allowed host that doesn't resolve to a private address
+func (s *Server) checkURL(u *url.URL) error {
+	if !u.IsAbs() || u.Host == "" || !s.isAllowedScheme(u.Scheme) {
+		return errInvalidURL
+	}
+
+	host := u.Hostname()
+	if !s.isAllowedHost(host) {
+		return errForbiddenHost
+	}
+	ips, err := net.LookupIP(host)
+	if err != nil {
+		return err
+	}
+	for _, ip := range ips {
+		if isPrivateIP(ip) {
+			return errForbiddenHost
+		}
+	}
+
+	return nil
+}
+
+// The maximal number of redirects followed when fetching an image
+const maxRedirects = 5
+
+// Follow the redirects like the default policy, but only to the URLs that
+// could be fetched directly, and never send the credentials of a host to
+// another one, even a subdomain
+func (s *Server) checkRedirect(req *http.Request, via []*http.Request) error {
+	if len(via) >= maxRedirects {
+		return errTooManyRedirects
+	}
+	for _, previous := range via {
+		if previous.URL.String() == req.URL.String() {
+			return errRedirectLoop
+		}
+	}
+	if err := s.checkURL(req.URL); err != nil {
+		return err
+	}
+	if !strings.EqualFold(req.URL.Hostname(), via[0].URL.Hostname()) {
+		req.Header.Del("Authorization")
+	}
+	return nil
+}
+
+// Check if an error is a timeout
+func isTimeout(err error) bool {
+	e, ok := err.(net.Error)
+	return ok && e.Timeout()
+}
+
+// Fetch the image from the distant server. If the image is cached, the
+// server is asked to only send it if it was modified since.
+func (s *Server) fetchImageFromServer(ctx context.Context, uri string, cachedHeaders Headers, cachedBody []byte) (headers Headers, body []byte, err error) {
+	defer func() {
+		result := "success"
+		if err != nil {
+			result = "error"
+		}
+		upstreamFetches.WithLabelValues(result).Inc()
+	}()
+
+	// Don't even try the hosts failing repeatedly, until they may have
+	// recovered. Not cached, as the host will accept the next fetches.
+	host := breakerHost(uri)
+	if err = s.breakerAllow(host); err != nil {
+		logger(ctx).Warn("Circuit open", "uri", uri)
+		return
+	}
+	down := false
+	defer func() {
+		s.breakerRecord(host, down, !down && err != nil && (ctx.Err() != nil || err == errRateLimited))
+	}()
+
+	if err = s.waitFetchTurn(ctx, uri); err != nil {
+		logger(ctx).Warn("Rate limited", "uri", uri, "error", err)
+		return
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "GET", uri, nil)
+	if err != nil {
+		return
+	}
+	req.Header.Set("User-Agent", s.config.UserAgent)
+	if auth := s.upstreamAuth(req.URL.Hostname()); auth != "" {
+		req.Header.Set("Authorization", auth)
+	}
+	if cachedBody != nil {
+		if cachedHeaders.ETag != "" {
+			req.Header.Set("If-None-Match", cachedHeaders.ETag)
+		}
+		if cachedHeaders.LastModified != "" {
+			req.Header.Set("If-Modified-Since", cachedHeaders.LastModified)
+		}
+	}
+
+	res, err := s.doWithRetries(ctx, uri, req)
+	if err != nil {
+		// Don't cache an error when the client gave up
+		if ctx.Err() != nil {
+			err = ctx.Err()
+			return
+		}
+		// The redirects to the URLs that can't be fetched, and the hosts
+		// resolving to private addresses
+		var fetchErr *FetchError
+		if errors.As(err, &fetchErr) {
+			logger(ctx).Warn("Refused fetch", "uri", uri, "error", fetchErr)
+			err = fetchErr
+			s.saveErrorInCache(uri, err, errorTTL)
+			return
+		}
+		down = true
+		if isTimeout(err) {
+			logger(ctx).Warn("Timeout while fetching", "uri", uri)
+			err = errTimeout
+			s.saveErrorInCache(uri, err, transientErrorTTL)
+		}
+		return
+	}
+	defer res.Body.Close()
+
+	// The cached image is still valid
+	if res.StatusCode == http.StatusNotModified && cachedBody != nil {
+		logger(ctx).Info("Not modified", "uri", uri)
+		headers, body = cachedHeaders, cachedBody
+		if cacheControl := res.Header.Get("Cache-Control"); cacheControl != "" {
+			headers.CacheControl = cacheControl
+		}
+		headers.FetchedAt = time.Now()
+		s.saveImageInCache(uri, "orig", headers, body)
+		headers.CacheStatus = "REVALIDATED"
+		return
+	}
+
+	if res.StatusCode != 200 {
+		logger(ctx).Warn("Unexpected status code", "uri", uri, "status", res.StatusCode)
+		switch {
+		case res.StatusCode == http.StatusNotFound:
+			err = errNotFound
+			s.saveErrorInCache(uri, err, notFoundErrorTTL)
+		case res.StatusCode >= 500:
+			down = true
+			err = errUnexpectedStatus
+			s.saveErrorInCache(uri, err, transientErrorTTL)
+		default:
+			err = errUnexpectedStatus
+			s.saveErrorInCache(uri, err, errorTTL)
+		}
+		return
+	}
+
+	if res.ContentLength > maxSize {
+		logger(ctx).Warn("Exceeded max size", "uri", uri, "size", res.ContentLength)
+		err = errMaxSize
+		s.saveErrorInCache(uri, err, errorTTL)
+		return
+	}
+
+	// Read at most one byte more than allowed to detect oversized bodies
+	// without buffering them entirely
+	body, err = readBody(res.Body, maxSize+1)
+	if err != nil {
+		if ctx.Err() != nil {
+			err = ctx.Err()
+			return
+		}
+		down = true
+		if isTimeout(err) {
+			logger(ctx).Warn("Timeout while reading", "uri", uri)
+			err = errTimeout
+			s.saveErrorInCache(uri, err, transientErrorTTL)
+		}
+		return
+	}
+	if len(body) > maxSize {
+		logger(ctx).Warn("Exceeded max size", "uri", uri)
+		err = errMaxSize
+		s.saveErrorInCache(uri, err, errorTTL)
+		return
+	}
+	contentType := res.Header.Get("Content-Type")
+	if contentType == "" {
+		contentType = detectContentType(body)
+	}
+	if !strings.HasPrefix(contentType, "image/") {
+		logger(ctx).Warn("Invalid content-type", "uri", uri, "content_type", contentType)
+		err = errContentType
+		s.saveErrorInCache(uri, err, errorTTL)
+		return
+	}
+	// Only the headers are decoded, to reject the images too large before
+	// caching them
+	if config, _, err := image.DecodeConfig(bytes.NewReader(body)); err == nil && s.checkSourcePixels(config) != nil {
+		logger(ctx).Warn("Image too large", "uri", uri, "width", config.Width, "height", config.Height)
+		s.saveErrorInCache(uri, errImageTooLarge, errorTTL)
+		return headers, nil, errImageTooLarge
+	}
+	logger(ctx).Info("Fetch", "uri", uri, "status", res.StatusCode, "content_type", contentType)
+
+	headers.ContentType = contentType
+	headers.LastModified = res.Header.Get("Last-Modified")
+	if headers.LastModified == "" {
+		headers.LastModified = time.Now().Format(time.RFC1123)
+	}
+	headers.CacheControl = res.Header.Get("Cache-Control")
+	headers.ETag = res.Header.Get("ETag")
+	headers.FetchedAt = time.Now()
+	if s.urlStatus(uri) == nil {
+		s.saveImageInCache(uri, "orig", headers, body)
+	}
+	// The variations resized from the previous version are outdated
+	if cachedBody != nil && !bytes.Equal(body, cachedBody) {
+		s.removeVariations(ctx, uri)
+	}
+	headers.CacheStatus = "MISS"
+	return
+}
+
+// Send a request to the distant server, sending it again after a growing
+// delay on the errors that may be transient: network errors, timeouts, and
+// bad gateway or unavailable statuses
+func (s *Server) doWithRetries(ctx context.Context, uri string, req *http.Request) (*http.Response, error) {
+	backoff := s.config.FetchRetryBackoff
+	if backoff <= 0 {
+		backoff = defaultFetchRetryBackoff
+	}
+
+	for attempt := 0; ; attempt++ {
+		res, err := s.httpClient.Do(req)
+		if attempt >= s.config.FetchRetries || ctx.Err() != nil || !isTransient(res, err) {
+			return res, err
+		}
+
+		if err == nil {
+			io.Copy(ioutil.Discard, io.LimitReader(res.Body, maxSize))
+			res.Body.Close()
+			err = fmt.Errorf("Status code %d", res.StatusCode)
+		}
+		logger(ctx).Warn("Retrying fetch", "uri", uri, "attempt", attempt+1, "error", err)
+
+		select {
+		case <-time.After(backoff << attempt):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// Check if the result of a request may be different if it is sent again
+func isTransient(res *http.Response, err error) bool {
+	var fetchErr *FetchError
+	if errors.As(err, &fetchErr) {
+		return false
+	}
+	if err != nil {
+		return true
+	}
+	switch res.StatusCode {
+	case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+// Fetch image from cache if available, or from the server
+func (s *Server) FetchImage(ctx context.Context, uri string) (headers Headers, body []byte, err error) {
+	headers, body, err = s.fetchImage(ctx, uri)
+	headers.CacheControl = s.cacheControl(headers.CacheControl, s.config.MaxAge)
+	return
+}
+
+// Fetch image from cache if available, or from the server, with the
+// cache-control header sent by the server
+func (s *Server) fetchImage(ctx context.Context, uri string) (headers Headers, body []byte, err error) {
+	headers, body, ok := s.fetchImageFromCache(uri, "orig")
+
+	// The error cached when the revalidation of a stale original failed
+	// doesn't prevent serving it either
+	if err = s.urlStatus(uri); err != nil {
+		if ok && s.isStale(headers) && isUpstreamFailure(err) {
+			return staleHeaders(headers), body, nil
+		}
+		return Headers{}, nil, err
+	}
+
+	if ok && !s.isStale(headers) {
+		return
+	}
+	if ok && s.canServeStale(headers) {
+		s.revalidateInBackground(ctx, uri, headers, body)
+		return
+	}
+	if !ok {
+		headers, body = Headers{}, nil
+	}
+
+	newHeaders, newBody, err := s.fetchImageFromServer(ctx, uri, headers, body)
+	if err != nil && ok {
+		// Better serve a stale image than an error
+		logger(ctx).Warn("Error while revalidating", "uri", uri, "error", err)
+		return staleHeaders(headers), body, nil
+	}
+
+	return newHeaders, newBody, err
+}
+
+// Mark a stale original served in place of an error, to be cached only
+// briefly
+func staleHeaders(headers Headers) Headers {
+	headers.CacheStatus = "STALE"
+	headers.CacheControl = fmt.Sprintf("max-age=%d", staleIfErrorMaxAge)
+	return headers
+}
+
+// Check if an error is a failure of the distant server to serve an image,
+// rather than a rejection of its URL or of the image itself
+func isUpstreamFailure(err error) bool {
+	switch err {
+	case errInvalidURL, errForbiddenHost, errImageTooLarge, errDecodeTimeout:
+		return false
+	}
+	return true
+}
+
+// Check if a cached original is older than its max-age, and should be
+// revalidated with the distant server
+func (s *Server) isStale(headers Headers) bool {
+	maxAge := s.maxAge(headers.CacheControl, s.config.MaxAge)
+	return time.Since(headers.FetchedAt) > time.Duration(maxAge)*time.Second
+}
+
+// Check if a stale original can still be served while it is revalidated in
+// the background
+func (s *Server) canServeStale(headers Headers) bool {
+	if s.config.StaleWhileRevalidate <= 0 {
+		return false
+	}
+	maxAge := s.maxAge(headers.CacheControl, s.config.MaxAge) + s.config.StaleWhileRevalidate
+	return time.Since(headers.FetchedAt) <= time.Duration(maxAge)*time.Second
+}
+
+// Revalidate a stale original with the distant server without waiting for
+// it, only once for the concurrent requests
+func (s *Server) revalidateInBackground(ctx context.Context, uri string, headers Headers, body []byte) {
+	// The revalidation outlives the request, but keeps its logger
+	ctx = context.WithoutCancel(ctx)
+	go s.revalidateGroup.Do(uri, func() (interface{}, error) {
+		_, _, err := s.fetchImageFromServer(ctx, uri, headers, body)
+		if err != nil {
+			logger(ctx).Warn("Error while revalidating", "uri", uri, "error", err)
+		}
+		return nil, err
+	})
+}
+
+// Revalidate the stale original of a cached variation in the background, so
+// that its variations are removed if it changed rather than served until
+// they expire
+func (s *Server) revalidateVariations(ctx context.Context, uri string) {
+	if _, ok := s.cache.(VariationTracker); !ok {
+		return
+	}
+	headers, body, ok := s.cache.Get(cacheKey(uri, "orig"))
+	if ok && s.isStale(headers) && s.urlStatus(uri) == nil {
+		s.revalidateInBackground(ctx, uri, headers, body)
+	}
+}
+
+// Generate the cache-control header of a response, with the given max-age
+// or the one of the distant server if it is shorter
+func (s *Server) cacheControl(upstream string, maxAge int) string {
+	return fmt.Sprintf("public, max-age=%d", s.maxAge(upstream, maxAge))
+}
+
+// Return the given max-age, or the one of the cache-control header of the
+// distant server if it is shorter
+func (s *Server) maxAge(upstream string, maxAge int) int {
+	for _, directive := range strings.Split(upstream, ",") {
+		name, value, _ := strings.Cut(strings.TrimSpace(directive), "=")
+		if !strings.EqualFold(name, "max-age") {
+			continue
+		}
+		if age, err := strconv.Atoi(strings.Trim(value, `"`)); err == nil && age >= 0 && age < maxAge {
+			maxAge = age
+		}
+	}
+	return maxAge
+}
@@ -0,0 +1,641 @@
+package resize
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"image/png"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestFetchContentType(t *testing.T) {
+	png := pngImage(t, 10, 10)
+	tests := []struct {
+		contentType string
+		want        string
+		err         error
+	}{
+		{"", "image/png", nil},
+		{"im", "", errContentType},
+		{"text/html", "", errContentType},
+		{"image/png", "image/png", nil},
+	}
+	for _, test := range tests {
+		ts, _ := newUpstream(t, test.contentType, png)
+		s := newTestServer(Config{}, newMemoryCache())
+		headers, _, err := s.FetchImage(context.Background(), ts.URL)
+		if err != test.err || headers.ContentType != test.want {
+			t.Errorf("%q: Content-Type = %q, err = %v, want %q, %v", test.contentType, headers.ContentType, err, test.want, test.err)
+		}
+	}
+}
+
+func TestFetchTimeout(t *testing.T) {
+	release := make(chan struct{})
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+	}))
+	defer ts.Close()
+	defer close(release)
+
+	c := newMemoryCache()
+	s := newTestServer(Config{Timeout: 50 * time.Millisecond}, c)
+	start := time.Now()
+	_, _, err := s.FetchImage(context.Background(), ts.URL)
+	if err != errTimeout {
+		t.Fatalf("err = %v, want %v", err, errTimeout)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("gave up after %s", elapsed)
+	}
+
+	s.WaitForSaves(context.Background())
+	if cached, ttl := c.cachedError(ts.URL); cached != errTimeout || ttl != transientErrorTTL {
+		t.Errorf("cached %v for %ds, want %v for %ds", cached, ttl, errTimeout, transientErrorTTL)
+	}
+}
+
+func TestFetchMaxSize(t *testing.T) {
+	var written int64
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Streamed without Content-Length, way beyond the limit
+		w.Header().Set("Content-Type", "image/png")
+		chunk := make([]byte, 64<<10)
+		for i := 0; i < 20*maxSize/len(chunk); i++ {
+			n, err := w.Write(chunk)
+			atomic.AddInt64(&written, int64(n))
+			if err != nil {
+				return
+			}
+			w.(http.Flusher).Flush()
+		}
+	}))
+	defer ts.Close()
+
+	c := newMemoryCache()
+	s := newTestServer(Config{}, c)
+	_, _, err := s.FetchImage(context.Background(), ts.URL)
+	if err != errMaxSize {
+		t.Fatalf("err = %v, want %v", err, errMaxSize)
+	}
+	ts.CloseClientConnections()
+	if n := atomic.LoadInt64(&written); n > 4*maxSize {
+		t.Errorf("%d bytes were sent before giving up", n)
+	}
+
+	s.WaitForSaves(context.Background())
+	if cached, ttl := c.cachedError(ts.URL); cached != errMaxSize || ttl != errorTTL {
+		t.Errorf("cached %v for %ds, want %v for %ds", cached, ttl, errMaxSize, errorTTL)
+	}
+}
+
+func TestFetchTLSVerification(t *testing.T) {
+	png := pngImage(t, 10, 10)
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/png")
+		w.Write(png)
+	}))
+	defer ts.Close()
+
+	// The certificate of the test server is self-signed
+	s := newTestServer(Config{}, newMemoryCache())
+	if _, _, err := s.FetchImage(context.Background(), ts.URL); err == nil {
+		t.Error("a self-signed certificate was accepted by default")
+	}
+
+	s = newTestServer(Config{Insecure: true}, newMemoryCache())
+	if _, body, err := s.FetchImage(context.Background(), ts.URL); err != nil || !bytes.Equal(body, png) {
+		t.Errorf("insecure fetch: err = %v", err)
+	}
+}
+
+func TestValidateURL(t *testing.T) {
+	tests := []struct {
+		allowed []string
+		uri     string
+		err     error
+	}{
+		{nil, "http://93.184.216.34/a.png", nil},
+		{[]string{"93.184.216.34"}, "http://93.184.216.34/a.png", nil},
+		{[]string{"93.184.216.34"}, "http://93.184.216.35/a.png", errForbiddenHost},
+		{nil, "http://127.0.0.1/a.png", errForbiddenHost},
+		{nil, "http://10.0.0.1/a.png", errForbiddenHost},
+		{nil, "http://169.254.169.254/latest/meta-data/", errForbiddenHost},
+		{nil, "http://[::1]/a.png", errForbiddenHost},
+		{nil, "file:///etc/passwd", errInvalidURL},
+		{nil, "/a.png", errInvalidURL},
+	}
+	for _, test := range tests {
+		c := newMemoryCache()
+		s := NewServer(Config{AllowedHosts: test.allowed}, c)
+		if err := s.validateURL(context.Background(), test.uri); err != test.err {
+			t.Errorf("%s allowing %v: err = %v, want %v", test.uri, test.allowed, err, test.err)
+		}
+		s.WaitForSaves(context.Background())
+		if cached, _ := c.cachedError(test.uri); cached != test.err {
+			t.Errorf("%s: cached %v, want %v", test.uri, cached, test.err)
+		}
+	}
+}
+
+func TestForbiddenHostStatus(t *testing.T) {
+	s := NewServer(Config{MaxPixels: 1 << 20}, newMemoryCache())
+	w := serve(s.Handler(), "GET", "/resize/"+encodeURL("http://169.254.169.254/a.png")+"/10/10")
+	if w.Code != 403 {
+		t.Errorf("status = %d, want 403", w.Code)
+	}
+}
+
+func TestDialRefusesPrivateAddresses(t *testing.T) {
+	// The URL is not checked, like one whose host resolved to a public
+	// address when it was, but to this one when it is dialed
+	ts, requests := newUpstream(t, "image/png", pngImage(t, 10, 10))
+	c := newMemoryCache()
+	s := NewServer(Config{}, c)
+	if _, _, err := s.FetchImage(context.Background(), ts.URL); err != errForbiddenHost {
+		t.Fatalf("err = %v, want %v", err, errForbiddenHost)
+	}
+	if *requests != 0 {
+		t.Errorf("%d requests reached the private address", *requests)
+	}
+	s.WaitForSaves(context.Background())
+	if cached, _ := c.cachedError(ts.URL); cached != errForbiddenHost {
+		t.Errorf("cached %v, want %v", cached, errForbiddenHost)
+	}
+
+	for address, want := range map[string]error{
+		"169.254.169.254:80": errForbiddenHost,
+		"127.0.0.1:8080":     errForbiddenHost,
+		"[fe80::1]:443":      errForbiddenHost,
+		"93.184.216.34:80":   nil,
+	} {
+		if err := checkDialedAddress("tcp", address, nil); err != want {
+			t.Errorf("%s: err = %v, want %v", address, err, want)
+		}
+	}
+}
+
+func TestDialAllowsPrivateProxies(t *testing.T) {
+	png := pngImage(t, 10, 10)
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.String() != "http://93.184.216.34/a.png" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "image/png")
+		w.Write(png)
+	}))
+	defer proxy.Close()
+
+	s := NewServer(Config{HTTPProxy: proxy.URL}, newMemoryCache())
+	if _, body, err := s.FetchImage(context.Background(), "http://93.184.216.34/a.png"); err != nil || !bytes.Equal(body, png) {
+		t.Errorf("err = %v", err)
+	}
+}
+
+func TestProxyPerScheme(t *testing.T) {
+	proxy := proxyFunc(Config{HTTPProxy: "http://proxy:3128", HTTPSProxy: "http://secure-proxy:3128", NoProxy: "images.internal"})
+
+	tests := []struct {
+		uri   string
+		proxy string
+	}{
+		{"http://example.com/a.png", "http://proxy:3128"},
+		{"https://example.com/a.png", "http://secure-proxy:3128"},
+		{"http://images.internal/a.png", ""},
+	}
+	for _, test := range tests {
+		req := httptest.NewRequest("GET", test.uri, nil)
+		u, err := proxy(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := ""
+		if u != nil {
+			got = u.String()
+		}
+		if got != test.proxy {
+			t.Errorf("%s: proxy = %q, want %q", test.uri, got, test.proxy)
+		}
+	}
+}
+
+// A transport answering every request with an image, without network
+type imageTransport struct {
+	body     []byte
+	requests int32
+}
+
+func (tr *imageTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	atomic.AddInt32(&tr.requests, 1)
+	return &http.Response{
+		StatusCode: 200,
+		Header:     http.Header{"Content-Type": {"image/png"}},
+		Body:       io.NopCloser(bytes.NewReader(tr.body)),
+		Request:    r,
+	}, nil
+}
+
+func TestInjectedHTTPClient(t *testing.T) {
+	tr := &imageTransport{body: pngImage(t, 10, 10)}
+	s := NewServer(Config{HTTPClient: &http.Client{Transport: tr}}, newMemoryCache())
+	if _, body, err := s.FetchImage(context.Background(), "http://93.184.216.34/a.png"); err != nil || !bytes.Equal(body, tr.body) {
+		t.Fatalf("err = %v", err)
+	}
+	if tr.requests != 1 {
+		t.Errorf("%d requests through the injected client, want 1", tr.requests)
+	}
+}
+
+func TestFetchReusesConnections(t *testing.T) {
+	png := pngImage(t, 10, 10)
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/png")
+		w.Write(png)
+	}))
+	var conns int32
+	ts.Config.ConnState = func(conn net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			atomic.AddInt32(&conns, 1)
+		}
+	}
+	ts.Start()
+	defer ts.Close()
+
+	s := newTestServer(Config{}, newMemoryCache())
+	for i := 0; i < 10; i++ {
+		if _, _, err := s.fetchImageFromServer(context.Background(), ts.URL, Headers{}, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := atomic.LoadInt32(&conns); n != 1 {
+		t.Errorf("%d connections for 10 fetches, want 1", n)
+	}
+}
+
+func BenchmarkFetchImage(b *testing.B) {
+	var buf bytes.Buffer
+	png.Encode(&buf, gradient(100, 100))
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/png")
+		w.Write(buf.Bytes())
+	}))
+	defer ts.Close()
+
+	s := newTestServer(Config{}, newMemoryCache())
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, _, err := s.fetchImageFromServer(context.Background(), ts.URL, Headers{}, nil); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestFetchLogs(t *testing.T) {
+	ts, _ := newUpstream(t, "image/png", pngImage(t, 10, 10))
+	s := newTestServer(Config{MaxPixels: 1 << 20}, newMemoryCache())
+	var buf bytes.Buffer
+	ctx := context.WithValue(context.Background(), loggerKey{}, slog.New(slog.NewJSONHandler(&buf, nil)))
+
+	if _, _, err := s.FetchImage(ctx, ts.URL); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, line := range bytes.Split(bytes.TrimSpace(buf.Bytes()), []byte("\n")) {
+		var record map[string]interface{}
+		if err := json.Unmarshal(line, &record); err != nil {
+			t.Fatalf("invalid JSON log line %q: %s", line, err)
+		}
+		if record["msg"] == "Fetch" {
+			if record["uri"] != ts.URL || record["status"] != 200.0 || record["level"] != "INFO" {
+				t.Errorf("fetch log line = %s", line)
+			}
+			return
+		}
+	}
+	t.Errorf("no fetch log line in %q", buf.String())
+}
+
+func TestURLSchemes(t *testing.T) {
+	c := newMemoryCache()
+	s := NewServer(Config{MaxPixels: 1 << 20}, c)
+	cacheOriginal(c, "https://93.184.216.34/a.png", "image/png", pngImage(t, 40, 20))
+
+	tests := []struct {
+		uri    string
+		status int
+	}{
+		{"file:///etc/passwd", 400},
+		{"/a.png", 400},
+		{"ftp://93.184.216.34/a.png", 400},
+		{"https://93.184.216.34/a.png", 200},
+	}
+	for _, test := range tests {
+		if w := serve(s.Handler(), "GET", "/resize/"+encodeURL(test.uri)+"/10/10"); w.Code != test.status {
+			t.Errorf("%s: status = %d, want %d", test.uri, w.Code, test.status)
+		}
+	}
+
+	// Unless configured otherwise
+	s = NewServer(Config{MaxPixels: 1 << 20, AllowedSchemes: []string{"https"}}, c)
+	if w := serve(s.Handler(), "GET", "/resize/"+encodeURL(testOrigin+"/a.png")+"/10/10"); w.Code != 400 {
+		t.Errorf("http not allowed: status = %d, want 400", w.Code)
+	}
+}
+
+func TestRevalidation(t *testing.T) {
+	png := pngImage(t, 10, 10)
+	var conditions http.Header
+	upstream := func(r *http.Request) (*http.Response, error) {
+		conditions = r.Header.Clone()
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			return &http.Response{StatusCode: 304, Header: http.Header{}, Body: http.NoBody, Request: r}, nil
+		}
+		header := http.Header{"Content-Type": {"image/png"}, "Etag": {`"v1"`}, "Last-Modified": {testLastModified}, "Cache-Control": {"max-age=0"}}
+		return &http.Response{StatusCode: 200, Header: header, Body: io.NopCloser(bytes.NewReader(png)), Request: r}, nil
+	}
+	c := newMemoryCache()
+	s := NewServer(Config{SyncCache: true, HTTPClient: &http.Client{Transport: roundTripFunc(upstream)}}, c)
+	uri := testOrigin + "/a.png"
+
+	headers, _, err := s.FetchImage(context.Background(), uri)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if headers.ETag != `"v1"` || headers.LastModified != testLastModified {
+		t.Errorf("ETag = %s, Last-Modified = %s, want the ones of the distant server", headers.ETag, headers.LastModified)
+	}
+
+	// Stale right away with a max-age of 0
+	time.Sleep(10 * time.Millisecond)
+	headers, body, err := s.FetchImage(context.Background(), uri)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if conditions.Get("If-None-Match") != `"v1"` || conditions.Get("If-Modified-Since") != testLastModified {
+		t.Errorf("conditional headers = %v", conditions)
+	}
+	if headers.CacheStatus != "REVALIDATED" || !bytes.Equal(body, png) {
+		t.Errorf("X-Cache = %s, want the cached body REVALIDATED", headers.CacheStatus)
+	}
+}
+
+func TestFetchCancellation(t *testing.T) {
+	started, aborted := make(chan struct{}), make(chan struct{})
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		select {
+		case <-r.Context().Done():
+			close(aborted)
+		case <-time.After(5 * time.Second):
+		}
+	}))
+	defer ts.Close()
+	c := newMemoryCache()
+	s := newTestServer(Config{MaxPixels: 1 << 20}, c)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		<-started
+		cancel()
+	}()
+	if _, _, err := s.FetchResized(ctx, ts.URL, ResizeOptions{Width: 10, Height: 10, Quality: defaultQuality}); err != context.Canceled {
+		t.Errorf("err = %v, want %v", err, context.Canceled)
+	}
+
+	select {
+	case <-aborted:
+	case <-time.After(time.Second):
+		t.Error("the upstream request was not aborted")
+	}
+	s.WaitForSaves(context.Background())
+	if err, _ := c.cachedError(ts.URL); err != nil {
+		t.Errorf("cached %v", err)
+	}
+}
+
+func TestFetchRateLimit(t *testing.T) {
+	transport := roundTripFunc(func(r *http.Request) (*http.Response, error) {
+		return &http.Response{StatusCode: 200, Header: http.Header{"Content-Type": {"image/png"}}, Body: io.NopCloser(bytes.NewReader(pngImage(t, 10, 10))), Request: r}, nil
+	})
+	s := NewServer(Config{MaxPixels: 1 << 20, FetchRate: 0.01, FetchBurst: 1, HTTPClient: &http.Client{Transport: transport}}, newMemoryCache())
+
+	tests := []struct {
+		uri    string
+		status int
+	}{
+		{"http://93.184.216.34/a.png", 200},
+		{"http://93.184.216.34/b.png", 429},
+		{"http://93.184.216.35/a.png", 200},
+	}
+	for _, test := range tests {
+		if w := serve(s.Handler(), "GET", "/resize/"+encodeURL(test.uri)+"/10/10"); w.Code != test.status {
+			t.Errorf("%s: status = %d, want %d", test.uri, w.Code, test.status)
+		}
+	}
+}
+
+// Start a distant server answering with a status, then with an image once
+// it failed a number of times, and count its requests
+func newFlakyUpstream(t *testing.T, status, failures int) (*httptest.Server, *int32) {
+	png := pngImage(t, 10, 10)
+	requests := new(int32)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(requests, 1) <= int32(failures) {
+			w.WriteHeader(status)
+			return
+		}
+		w.Header().Set("Content-Type", "image/png")
+		w.Write(png)
+	}))
+	t.Cleanup(ts.Close)
+	return ts, requests
+}
+
+func TestFetchRetries(t *testing.T) {
+	ts, requests := newFlakyUpstream(t, 503, 2)
+	s := newTestServer(Config{FetchRetries: 2, FetchRetryBackoff: time.Millisecond}, newMemoryCache())
+	if _, _, err := s.FetchImage(context.Background(), ts.URL); err != nil {
+		t.Fatalf("err = %v after the retries", err)
+	}
+	if *requests != 3 {
+		t.Errorf("%d requests, want 3", *requests)
+	}
+
+	// Not on the errors that wouldn't be different
+	ts, requests = newFlakyUpstream(t, 404, 2)
+	if _, _, err := s.FetchImage(context.Background(), ts.URL); err != errNotFound {
+		t.Errorf("err = %v, want %v", err, errNotFound)
+	}
+	if *requests != 1 {
+		t.Errorf("%d requests on a 404, want 1", *requests)
+	}
+}
+
+func TestStaleWhileRevalidate(t *testing.T) {
+	versions := [][]byte{pngImage(t, 10, 10), pngImage(t, 20, 20)}
+	var requests int32
+	upstream := func(r *http.Request) (*http.Response, error) {
+		body := versions[0]
+		if atomic.AddInt32(&requests, 1) > 1 {
+			body = versions[1]
+		}
+		header := http.Header{"Content-Type": {"image/png"}, "Cache-Control": {"max-age=0"}}
+		return &http.Response{StatusCode: 200, Header: header, Body: io.NopCloser(bytes.NewReader(body)), Request: r}, nil
+	}
+	c := newMemoryCache()
+	s := NewServer(Config{SyncCache: true, StaleWhileRevalidate: 60, HTTPClient: &http.Client{Transport: roundTripFunc(upstream)}}, c)
+	uri := testOrigin + "/a.png"
+
+	if _, _, err := s.FetchImage(context.Background(), uri); err != nil {
+		t.Fatal(err)
+	}
+
+	// The stale copy is served right away, and replaced in the background
+	time.Sleep(10 * time.Millisecond)
+	_, body, err := s.FetchImage(context.Background(), uri)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(body, versions[0]) {
+		t.Error("the stale copy was not served while revalidating")
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if _, cached, ok := c.Get(cacheKey(uri, "orig")); ok && bytes.Equal(cached, versions[1]) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("the cache was not updated by the revalidation")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	_, body, err = s.FetchImage(context.Background(), uri)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(body, versions[1]) {
+		t.Error("the new version is not served after the revalidation")
+	}
+}
+
+func TestUpstreamAuth(t *testing.T) {
+	png := pngImage(t, 10, 10)
+	var mu sync.Mutex
+	auths := map[string]string{}
+	upstream := func(r *http.Request) (*http.Response, error) {
+		mu.Lock()
+		auths[r.URL.Path] = r.Header.Get("Authorization")
+		mu.Unlock()
+		if r.URL.Path == "/redirect.png" {
+			return &http.Response{StatusCode: 302, Header: http.Header{"Location": {"http://93.184.216.35/redirected.png"}}, Body: http.NoBody, Request: r}, nil
+		}
+		return &http.Response{StatusCode: 200, Header: http.Header{"Content-Type": {"image/png"}}, Body: io.NopCloser(bytes.NewReader(png)), Request: r}, nil
+	}
+	config := Config{
+		UpstreamAuth: map[string]string{"93.184.216.34": "Bearer secret"},
+		HTTPClient:   &http.Client{Transport: roundTripFunc(upstream)},
+	}
+	s := NewServer(config, newMemoryCache())
+
+	for _, uri := range []string{"http://93.184.216.34/a.png", "http://93.184.216.35/b.png", "http://93.184.216.34/redirect.png"} {
+		if _, _, err := s.FetchImage(context.Background(), uri); err != nil {
+			t.Fatalf("%s: %v", uri, err)
+		}
+	}
+
+	want := map[string]string{
+		"/a.png":          "Bearer secret",
+		"/b.png":          "",
+		"/redirect.png":   "Bearer secret",
+		"/redirected.png": "",
+	}
+	for path, auth := range want {
+		if auths[path] != auth {
+			t.Errorf("%s: Authorization = %q, want %q", path, auths[path], auth)
+		}
+	}
+}
+
+func TestUserAgent(t *testing.T) {
+	png := pngImage(t, 10, 10)
+	agents := make(chan string, 2)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		agents <- r.Header.Get("User-Agent")
+		w.Header().Set("Content-Type", "image/png")
+		w.Write(png)
+	}))
+	defer ts.Close()
+
+	for _, test := range []struct{ configured, sent string }{
+		{"", DefaultUserAgent},
+		{"thumbnailer/2.0", "thumbnailer/2.0"},
+	} {
+		s := newTestServer(Config{UserAgent: test.configured}, newMemoryCache())
+		if _, _, err := s.FetchImage(context.Background(), ts.URL); err != nil {
+			t.Fatal(err)
+		}
+		if agent := <-agents; agent != test.sent {
+			t.Errorf("User-Agent = %q, want %q", agent, test.sent)
+		}
+	}
+}
+
+func TestRedirects(t *testing.T) {
+	png := pngImage(t, 10, 10)
+	redirects := map[string]string{
+		"/redirect.png": "/a.png",
+		"/private.png":  "http://10.0.0.1/a.png",
+		"/loop.png":     "/loop2.png",
+		"/loop2.png":    "/loop.png",
+	}
+	upstream := func(r *http.Request) (*http.Response, error) {
+		if location, ok := redirects[r.URL.Path]; ok {
+			return &http.Response{StatusCode: 302, Header: http.Header{"Location": {location}}, Body: http.NoBody, Request: r}, nil
+		}
+		if n, err := strconv.Atoi(strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/hop"), ".png")); err == nil && n > 0 {
+			location := fmt.Sprintf("/hop%d.png", n-1)
+			return &http.Response{StatusCode: 302, Header: http.Header{"Location": {location}}, Body: http.NoBody, Request: r}, nil
+		}
+		return &http.Response{StatusCode: 200, Header: http.Header{"Content-Type": {"image/png"}}, Body: io.NopCloser(bytes.NewReader(png)), Request: r}, nil
+	}
+	// The redirects of the injected clients are not checked
+	s := NewServer(Config{}, newMemoryCache())
+	s.httpClient.Transport = roundTripFunc(upstream)
+
+	tests := []struct {
+		path string
+		err  error
+	}{
+		{"/redirect.png", nil},
+		{fmt.Sprintf("/hop%d.png", maxRedirects-1), nil},
+		{"/private.png", errForbiddenHost},
+		{"/loop.png", errRedirectLoop},
+		{fmt.Sprintf("/hop%d.png", maxRedirects+1), errTooManyRedirects},
+	}
+	for _, test := range tests {
+		_, body, err := s.FetchImage(context.Background(), testOrigin+test.path)
+		if err != test.err {
+			t.Errorf("%s: err = %v, want %v", test.path, err, test.err)
+		}
+		if test.err == nil && !bytes.Equal(body, png) {
+			t.Errorf("%s: the redirect was not followed", test.path)
+		}
+	}
+}
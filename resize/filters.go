@@ -0,0 +1,167 @@
+package resize
+
+import (
+	"image"
+	"image/color"
+	"math"
+)
+
+// An interpolation kernel, null outside of [-support, support]
+type filter struct {
+	support float64
+	kernel  func(x float64) float64
+}
+
+// The filters available in addition to the default nearest-neighbor
+var filters = map[string]*filter{
+	"bilinear": {1, triangle},
+	"lanczos":  {3, lanczos3},
+}
+
+func triangle(x float64) float64 {
+	x = math.Abs(x)
+	if x < 1 {
+		return 1 - x
+	}
+	return 0
+}
+
+func sinc(x float64) float64 {
+	if x == 0 {
+		return 1
+	}
+	x *= math.Pi
+	return math.Sin(x) / x
+}
+
+func lanczos3(x float64) float64 {
+	if x > -3 && x < 3 {
+		return sinc(x) * sinc(x/3)
+	}
+	return 0
+}
+
+// Check if a filter name is known
+func isValidFilter(name string) bool {
+	return name == "nearest" || filters[name] != nil
+}
+
+// Resample the image slice r of m to w x h with the named filter,
+// nearest-neighbor being the default
+func resample(m image.Image, r image.Rectangle, w, h int, name string) image.Image {
+	if f, ok := filters[name]; ok {
+		return resampleFilter(m, r, w, h, f)
+	}
+	return Resample(m, r, w, h)
+}
+
+// The contribution of a source pixel to a destination pixel
+type contribution struct {
+	index  int
+	weight float64
+}
+
+// Compute the contributions of the source pixels to each destination pixel
+// along one axis. When downscaling, the kernel is stretched to cover all the
+// source pixels.
+func computeContributions(srcSize, dstSize int, f *filter) [][]contribution {
+	scale := float64(srcSize) / float64(dstSize)
+	filterScale := math.Max(scale, 1)
+	support := f.support * filterScale
+
+	contributions := make([][]contribution, dstSize)
+	for i := range contributions {
+		center := (float64(i) + 0.5) * scale
+		start := int(math.Max(math.Floor(center-support), 0))
+		end := int(math.Min(math.Ceil(center+support), float64(srcSize)))
+
+		total := 0.0
+		for j := start; j < end; j++ {
+			weight := f.kernel((float64(j) + 0.5 - center) / filterScale)
+			if weight != 0 {
+				contributions[i] = append(contributions[i], contribution{j, weight})
+				total += weight
+			}
+		}
+
+		// Normalize so that the weights sum to 1
+		if total != 0 {
+			for k := range contributions[i] {
+				contributions[i][k].weight /= total
+			}
+		}
+	}
+	return contributions
+}
+
+// resampleFilter returns a copy of the image slice r of m, convolved
+// with the filter horizontally then vertically.
+// The returned image has width w and height h.
+func resampleFilter(m image.Image, r image.Rectangle, w, h int, f *filter) image.Image {
+	if w < 0 || h < 0 {
+		return nil
+	}
+	if w == 0 || h == 0 || r.Dx() <= 0 || r.Dy() <= 0 {
+		return image.NewRGBA64(image.Rect(0, 0, w, h))
+	}
+	srcw, srch := r.Dx(), r.Dy()
+
+	// Horizontal pass, from the source to a w x srch intermediate image
+	tmp := make([]float64, 4*w*srch)
+	row := make([]float64, 4*srcw)
+	cols := computeContributions(srcw, w, f)
+	for y := 0; y < srch; y++ {
+		for x := 0; x < srcw; x++ {
+			r32, g32, b32, a32 := m.At(r.Min.X+x, r.Min.Y+y).RGBA()
+			row[4*x+0] = float64(r32)
+			row[4*x+1] = float64(g32)
+			row[4*x+2] = float64(b32)
+			row[4*x+3] = float64(a32)
+		}
+		for x := 0; x < w; x++ {
+			index := 4 * (y*w + x)
+			for _, c := range cols[x] {
+				tmp[index+0] += row[4*c.index+0] * c.weight
+				tmp[index+1] += row[4*c.index+1] * c.weight
+				tmp[index+2] += row[4*c.index+2] * c.weight
+				tmp[index+3] += row[4*c.index+3] * c.weight
+			}
+		}
+	}
+
+	// Vertical pass, from the intermediate image to the destination
+	img := image.NewRGBA(image.Rect(0, 0, w, h))
+	rows := computeContributions(srch, h, f)
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			var sum [4]float64
+			for _, c := range rows[y] {
+				index := 4 * (c.index*w + x)
+				sum[0] += tmp[index+0] * c.weight
+				sum[1] += tmp[index+1] * c.weight
+				sum[2] += tmp[index+2] * c.weight
+				sum[3] += tmp[index+3] * c.weight
+			}
+			// Negative lobes can overshoot, and colors are premultiplied
+			a := clamp(sum[3], 0xffff)
+			img.SetRGBA(x, y, color.RGBA{
+				uint8(clamp(sum[0], a)/0x101 + 0.5),
+				uint8(clamp(sum[1], a)/0x101 + 0.5),
+				uint8(clamp(sum[2], a)/0x101 + 0.5),
+				uint8(a/0x101 + 0.5),
+			})
+		}
+	}
+	return img
+}
+
+// Clamp v to [0, max]
+func clamp(v, max float64) float64 {
+	if v < 0 {
+		return 0
+	}
+	if v > max {
+		return max
+	}
+	return v
+}
@@ -0,0 +1,63 @@
+package resize
+
+import (
+	"image"
+	"image/color"
+	"testing"
+)
+
+// Create a checkerboard of black and white squares
+func checkerboard(size, square int) *image.Gray {
+	m := image.NewGray(image.Rect(0, 0, size, size))
+	for y := 0; y < size; y++ {
+		for x := 0; x < size; x++ {
+			if (x/square+y/square)%2 == 0 {
+				m.SetGray(x, y, color.Gray{255})
+			}
+		}
+	}
+	return m
+}
+
+// Return the mean absolute difference of the luminance of two images of
+// the same size
+func meanDifference(a, b image.Image) float64 {
+	bounds := a.Bounds()
+	total := 0.0
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			ya := color.GrayModel.Convert(a.At(x, y)).(color.Gray).Y
+			yb := color.GrayModel.Convert(b.At(x, y)).(color.Gray).Y
+			if ya > yb {
+				total += float64(ya - yb)
+			} else {
+				total += float64(yb - ya)
+			}
+		}
+	}
+	return total / float64(bounds.Dx()*bounds.Dy())
+}
+
+func TestFiltersDiffer(t *testing.T) {
+	src := checkerboard(64, 4)
+	resized := map[string]image.Image{}
+	for _, name := range []string{"nearest", "bilinear", "lanczos"} {
+		resized[name] = resample(src, src.Bounds(), 24, 24, name)
+	}
+
+	pairs := [][2]string{{"nearest", "bilinear"}, {"nearest", "lanczos"}, {"bilinear", "lanczos"}}
+	for _, pair := range pairs {
+		if d := meanDifference(resized[pair[0]], resized[pair[1]]); d < 1 {
+			t.Errorf("%s and %s: mean difference = %.2f", pair[0], pair[1], d)
+		}
+	}
+}
+
+func TestFilterVariation(t *testing.T) {
+	nearest := ResizeOptions{Width: 100, Height: 100, Quality: defaultQuality, Mode: "fit", Gravity: "center", Filter: "nearest"}
+	lanczos := nearest
+	lanczos.Filter = "lanczos"
+	if nearest.variation() == lanczos.variation() {
+		t.Errorf("same variation %s for both filters", nearest.variation())
+	}
+}
@@ -0,0 +1,172 @@
+package resize
+
+import (
+	"context"
+	"image"
+	"image/draw"
+	"image/gif"
+	"math"
+	"strings"
+	"time"
+)
+
+// Decode all the frames of an animated GIF, giving up after the decode
+// timeout. g is nil if the image is not an animated GIF, or if it has too many
+// frames or pixels to be resized: in this case only its first frame is kept.
+func (s *Server) decodeAnimatedGIF(ctx context.Context, uri, body string, config image.Config) (g *gif.GIF, err error) {
+	if !strings.HasPrefix(body, "GIF8") {
+		return
+	}
+
+	// The frames are counted before decoding them, as each of them may be as
+	// large as the image
+	frames := countGIFFrames(body)
+	if frames <= 1 {
+		return
+	}
+	if frames > s.config.MaxFrames {
+		logger(ctx).Warn("Too many frames, keeping the first one", "uri", uri, "frames", frames)
+		return
+	}
+	if s.config.MaxSourcePixels > 0 && int64(frames)*int64(config.Width)*int64(config.Height) > s.config.MaxSourcePixels {
+		logger(ctx).Warn("Too many pixels in the frames, keeping the first one", "uri", uri, "frames", frames,
+			"width", config.Width, "height", config.Height)
+		return
+	}
+
+	g, err = withDecodeTimeout(ctx, s.config.DecodeTimeout, func() (*gif.GIF, error) {
+		return gif.DecodeAll(strings.NewReader(body))
+	})
+	if err == errDecodeTimeout || (err != nil && ctx.Err() != nil) {
+		return nil, err
+	}
+	if err != nil || len(g.Image) <= 1 {
+		return nil, nil
+	}
+	return g, nil
+}
+
+// Count the frames of a GIF from the structure of its blocks, without
+// decompressing them. Returns 0 if the image is malformed.
+func countGIFFrames(body string) int {
+	// The header and the logical screen descriptor, then the global color
+	// table if any
+	if len(body) < 13 {
+		return 0
+	}
+	pos := 13
+	if flags := body[10]; flags&0x80 != 0 {
+		pos += 3 << (flags&7 + 1)
+	}
+
+	frames := 0
+	for pos < len(body) {
+		switch body[pos] {
+		case 0x21:
+			// An extension: its label, then its data sub-blocks
+			pos += 2
+		case 0x2c:
+			// An image descriptor, its local color table if any, and the LZW
+			// minimum code size before its data sub-blocks
+			if pos+10 > len(body) {
+				return 0
+			}
+			flags := body[pos+9]
+			pos += 10
+			if flags&0x80 != 0 {
+				pos += 3 << (flags&7 + 1)
+			}
+			pos++
+			frames++
+		case 0x3b:
+			// The trailer
+			return frames
+		default:
+			return 0
+		}
+
+		for {
+			if pos >= len(body) {
+				return 0
+			}
+			size := int(body[pos])
+			pos += 1 + size
+			if size == 0 {
+				break
+			}
+		}
+	}
+	return 0
+}
+
+// Resize each frame of an animated GIF, preserving their timing and disposal
+func (s *Server) resizeAnimatedGIF(ctx context.Context, uri, origBody string, origHeaders Headers, g *gif.GIF, opts ResizeOptions) (headers Headers, body []byte, err error) {
+	start := time.Now()
+
+	bounds := image.Rect(0, 0, g.Config.Width, g.Config.Height)
+	crop, newWidth, newHeight, ok := opts.geometry(bounds)
+	if err = s.checkPixels(newWidth, newHeight); err != nil {
+		return
+	}
+	if !ok && !opts.hasEffects() {
+		headers = origHeaders
+		headers.ContentType = "image/gif"
+		body = []byte(origBody)
+		return
+	}
+	if !ok {
+		// Only apply the effects on the frames
+		crop, newWidth, newHeight = bounds, bounds.Dx(), bounds.Dy()
+	}
+
+	logger(ctx).Info("Resize", "uri", uri, "width", opts.Width, "height", opts.Height,
+		"orig_width", bounds.Dx(), "orig_height", bounds.Dy(), "crop", crop.String(),
+		"new_width", newWidth, "new_height", newHeight, "frames", len(g.Image))
+
+	sx := float64(newWidth) / float64(crop.Dx())
+	sy := float64(newHeight) / float64(crop.Dy())
+	for i, frame := range g.Image {
+		// Frames can cover only a part of the canvas: map this part
+		// to the resized canvas
+		src := frame.Bounds().Intersect(crop)
+		if src.Empty() {
+			src = image.Rect(crop.Min.X, crop.Min.Y, crop.Min.X+1, crop.Min.Y+1)
+		}
+		dst := image.Rect(
+			int(math.Floor(float64(src.Min.X-crop.Min.X)*sx)),
+			int(math.Floor(float64(src.Min.Y-crop.Min.Y)*sy)),
+			int(math.Ceil(float64(src.Max.X-crop.Min.X)*sx)),
+			int(math.Ceil(float64(src.Max.Y-crop.Min.Y)*sy)),
+		).Intersect(image.Rect(0, 0, newWidth, newHeight))
+		if dst.Empty() {
+			dst = image.Rect(0, 0, 1, 1)
+		}
+
+		m := resample(frame, src, dst.Dx(), dst.Dy(), opts.Filter)
+		m = applyEffects(m, opts)
+		palette := frame.Palette
+		if opts.Grayscale {
+			palette = grayscalePalette(palette)
+		}
+		p := image.NewPaletted(dst, palette)
+		draw.Draw(p, dst, m, image.Point{}, draw.Src)
+		g.Image[i] = p
+	}
+	g.Config.Width, g.Config.Height = newWidth, newHeight
+
+	writter := getBuffer()
+	defer putBuffer(writter)
+	err = gif.EncodeAll(writter, g)
+	if err != nil {
+		return
+	}
+
+	resizeDuration.Observe(time.Since(start).Seconds())
+
+	body = append([]byte(nil), writter.Bytes()...)
+
+	headers = origHeaders
+	headers.ContentType = "image/gif"
+
+	return
+}
@@ -0,0 +1,104 @@
+package resize
+
+import (
+	"bytes"
+	"context"
+	"image"
+	"image/color"
+	"image/gif"
+	"testing"
+	"time"
+)
+
+// Encode an animated GIF with frames of different colors
+func animatedGIF(t *testing.T, width, height, frames int) []byte {
+	t.Helper()
+	g := &gif.GIF{}
+	palette := color.Palette{color.Black, color.White, color.RGBA{255, 0, 0, 255}}
+	for i := 0; i < frames; i++ {
+		frame := image.NewPaletted(image.Rect(0, 0, width, height), palette)
+		for j := range frame.Pix {
+			frame.Pix[j] = uint8(i % len(palette))
+		}
+		g.Image = append(g.Image, frame)
+		g.Delay = append(g.Delay, 10*(i+1))
+		g.Disposal = append(g.Disposal, gif.DisposalBackground)
+	}
+	var buf bytes.Buffer
+	if err := gif.EncodeAll(&buf, g); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestResizeAnimatedGIF(t *testing.T) {
+	s := newTestServer(Config{MaxPixels: 1 << 20, MaxFrames: 10}, newMemoryCache())
+	headers, body := resizeFrom(t, s, "image/gif", animatedGIF(t, 80, 40, 3), ResizeOptions{Width: 20, Height: 20, Quality: defaultQuality})
+
+	if headers.ContentType != "image/gif" {
+		t.Errorf("Content-Type = %s, want image/gif", headers.ContentType)
+	}
+	g, err := gif.DecodeAll(bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(g.Image) != 3 {
+		t.Fatalf("%d frames, want 3", len(g.Image))
+	}
+	for i, frame := range g.Image {
+		if frame.Bounds() != image.Rect(0, 0, 20, 10) {
+			t.Errorf("frame %d: bounds = %v, want 20x10", i, frame.Bounds())
+		}
+		if g.Delay[i] != 10*(i+1) || g.Disposal[i] != gif.DisposalBackground {
+			t.Errorf("frame %d: delay = %d, disposal = %d", i, g.Delay[i], g.Disposal[i])
+		}
+	}
+}
+
+func TestResizeGIFWithTooManyFrames(t *testing.T) {
+	s := newTestServer(Config{MaxPixels: 1 << 20, MaxFrames: 2}, newMemoryCache())
+	_, body := resizeFrom(t, s, "image/gif", animatedGIF(t, 80, 40, 3), ResizeOptions{Width: 20, Height: 20, Quality: defaultQuality})
+
+	m, _, err := image.Decode(bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Bounds().Dx() != 20 || m.Bounds().Dy() != 10 {
+		t.Errorf("size = %v, want 20x10", m.Bounds())
+	}
+	if g, err := gif.DecodeAll(bytes.NewReader(body)); err == nil && len(g.Image) != 1 {
+		t.Errorf("%d frames, want only the first one", len(g.Image))
+	}
+}
+
+func TestResizeGIFWithTooManyPixels(t *testing.T) {
+	// Each frame is within the limit, but not all of them
+	s := newTestServer(Config{MaxPixels: 1 << 20, MaxFrames: 10, MaxSourcePixels: 80 * 40 * 2}, newMemoryCache())
+	_, body := resizeFrom(t, s, "image/gif", animatedGIF(t, 80, 40, 3), ResizeOptions{Width: 20, Height: 20, Quality: defaultQuality})
+
+	if g, err := gif.DecodeAll(bytes.NewReader(body)); err == nil && len(g.Image) != 1 {
+		t.Errorf("%d frames, want only the first one", len(g.Image))
+	}
+}
+
+func TestAnimatedGIFDecodeTimeout(t *testing.T) {
+	s := newTestServer(Config{MaxPixels: 1 << 20, MaxFrames: 10, DecodeTimeout: time.Nanosecond}, newMemoryCache())
+	ts, _ := newUpstream(t, "image/gif", animatedGIF(t, 400, 400, 5))
+
+	_, _, err := s.FetchResized(context.Background(), ts.URL, ResizeOptions{Width: 20, Height: 20, Quality: defaultQuality})
+	if err != errDecodeTimeout {
+		t.Errorf("err = %v, want %v", err, errDecodeTimeout)
+	}
+}
+
+func TestCountGIFFrames(t *testing.T) {
+	for _, frames := range []int{1, 3} {
+		if n := countGIFFrames(string(animatedGIF(t, 80, 40, frames))); n != frames {
+			t.Errorf("%d frames counted, want %d", n, frames)
+		}
+	}
+	body := animatedGIF(t, 80, 40, 3)
+	if n := countGIFFrames(string(body[:len(body)/2])); n != 0 {
+		t.Errorf("%d frames counted in a truncated image, want 0", n)
+	}
+}
@@ -0,0 +1,829 @@
+package resize
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Check if the client has announced it can display images of a media type
+func accepts(r *http.Request, mediaType string) bool {
+	for _, accept := range strings.Split(r.Header.Get("Accept"), ",") {
+		if strings.TrimSpace(strings.Split(accept, ";")[0]) == mediaType {
+			return true
+		}
+	}
+	return false
+}
+
+// Respond with an error, as JSON for the clients asking for it, or as plain
+// text like http.Error
+func httpError(w http.ResponseWriter, r *http.Request, message string, code int) {
+	if !accepts(r, "application/json") {
+		http.Error(w, message, code)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(map[string]interface{}{"error": message, "code": code})
+}
+
+// Generate a strong ETag from the body of a response
+func generateETag(body []byte) string {
+	return fmt.Sprintf("\"%x\"", sha1.Sum(body))
+}
+
+// Generate the ETag of a cached file, the same as the one of its body, and
+// rewind it to be served
+func generateFileETag(file *os.File) (string, error) {
+	hash := sha1.New()
+	if _, err := io.Copy(hash, file); err != nil {
+		return "", err
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("\"%x\"", hash.Sum(nil)), nil
+}
+
+// Check if the client already has the current version of the response.
+// If-None-Match takes precedence over If-Modified-Since when both are sent.
+func isNotModified(r *http.Request, etag, lastModified string) bool {
+	if inm := r.Header.Get("If-None-Match"); inm != "" {
+		for _, candidate := range strings.Split(inm, ",") {
+			candidate = strings.TrimSpace(candidate)
+			if candidate == "*" || candidate == etag {
+				return true
+			}
+		}
+		return false
+	}
+
+	return lastModified == r.Header.Get("If-Modified-Since")
+}
+
+// Parse a requested width or height, where "auto" (or 0) means that it is
+// derived from the other one and the aspect ratio of the image
+func parseDimension(str string) (int64, error) {
+	if str == "auto" {
+		return 0, nil
+	}
+	return strconv.ParseInt(str, 10, 32)
+}
+
+// The error of the invalid options of a resize
+var errInvalidParameters = errors.New("Invalid parameters")
+
+// Parse the options of a resize from the request, or respond with an error
+// if they are invalid
+func (s *Server) parseOptions(w http.ResponseWriter, r *http.Request) (opts ResizeOptions, ok bool) {
+	acceptable := func(mediaType string) bool { return accepts(r, mediaType) }
+	opts, err := s.optionsFromQuery(r.Context(), r.URL.Query(), acceptable)
+	if err != nil {
+		httpError(w, r, err.Error(), 400)
+		return opts, false
+	}
+	return opts, true
+}
+
+// Parse the options of a resize from a query, with the dimensions as the
+// :width and :height parameters of the path. The format is negotiated with
+// the media types acceptable to the client.
+func (s *Server) optionsFromQuery(ctx context.Context, query url.Values, acceptable func(mediaType string) bool) (opts ResizeOptions, err error) {
+	strWidth, strHeight := query.Get(":width"), query.Get(":height")
+
+	width, err := parseDimension(strWidth)
+	if err != nil {
+		logger(ctx).Warn("Invalid width", "width", strWidth)
+		return opts, errInvalidParameters
+	}
+
+	height, err := parseDimension(strHeight)
+	if err != nil {
+		logger(ctx).Warn("Invalid height", "height", strHeight)
+		return opts, errInvalidParameters
+	}
+
+	quality := int64(defaultQuality)
+	if strQuality := query.Get("quality"); strQuality != "" {
+		quality, err = strconv.ParseInt(strQuality, 10, 32)
+		if err != nil || quality < 1 || quality > 100 {
+			logger(ctx).Warn("Invalid quality", "quality", strQuality)
+			return opts, errInvalidParameters
+		}
+	}
+
+	dpr := int64(1)
+	if strDPR := query.Get("dpr"); strDPR != "" {
+		dpr, err = strconv.ParseInt(strDPR, 10, 32)
+		if err != nil || dpr < 1 || dpr > 3 {
+			logger(ctx).Warn("Invalid dpr", "dpr", strDPR)
+			return opts, errInvalidParameters
+		}
+	}
+
+	scale := 0.0
+	if strScale := query.Get("scale"); strScale != "" {
+		// A ratio like 0.5, or a percent like 50% with its explicit suffix
+		percent, isPercent := strings.CutSuffix(strScale, "%")
+		if isPercent {
+			scale, err = strconv.ParseFloat(percent, 64)
+			scale /= 100
+		} else {
+			scale, err = strconv.ParseFloat(strScale, 64)
+		}
+		if err != nil || scale <= 0 || scale > maxScale {
+			logger(ctx).Warn("Invalid scale", "scale", strScale)
+			return opts, errInvalidParameters
+		}
+	}
+
+	if width < 0 || height < 0 || (width == 0 && height == 0 && scale == 0) {
+		logger(ctx).Warn("Invalid dimensions", "width", width, "height", height)
+		return opts, errInvalidParameters
+	}
+
+	// The limits apply to the dimensions of the resized image in pixels
+	if width*dpr > int64(s.config.MaxWidth) {
+		logger(ctx).Warn("Requested width exceeds max width", "width", width)
+		return opts, fmt.Errorf("Requested width exceeds %d", s.config.MaxWidth)
+	}
+
+	if height*dpr > int64(s.config.MaxHeight) {
+		logger(ctx).Warn("Requested height exceeds max height", "height", height)
+		return opts, fmt.Errorf("Requested height exceeds %d", s.config.MaxHeight)
+	}
+
+	if s.config.MaxPixels > 0 && width*height*dpr*dpr > s.config.MaxPixels {
+		logger(ctx).Warn("Requested resized image exceeds max pixels", "width", width, "height", height)
+		return opts, fmt.Errorf("Requested resized image exceeds %d pixels", s.config.MaxPixels)
+	}
+
+	opts = ResizeOptions{
+		Width:   int(width),
+		Height:  int(height),
+		Quality: int(quality),
+		DPR:     int(dpr),
+		Scale:   scale,
+		Mode:    "fit",
+		Gravity: "center",
+		Filter:  "nearest",
+	}
+
+	if mode := query.Get("mode"); mode != "" {
+		if mode != "fit" && mode != "fill" && mode != "pad" {
+			logger(ctx).Warn("Invalid mode", "mode", mode)
+			return opts, errInvalidParameters
+		}
+		opts.Mode = mode
+	}
+
+	if gravity := query.Get("gravity"); gravity != "" {
+		if !gravities[gravity] {
+			logger(ctx).Warn("Invalid gravity", "gravity", gravity)
+			return opts, errInvalidParameters
+		}
+		opts.Gravity = gravity
+	}
+
+	if filter := query.Get("filter"); filter != "" {
+		if !isValidFilter(filter) {
+			logger(ctx).Warn("Invalid filter", "filter", filter)
+			return opts, errInvalidParameters
+		}
+		opts.Filter = filter
+	}
+
+	if strPalette := query.Get("palette"); strPalette != "" {
+		palette, err := strconv.Atoi(strPalette)
+		if err != nil || palette < 2 || palette > 256 {
+			logger(ctx).Warn("Invalid palette", "palette", strPalette)
+			return opts, errInvalidParameters
+		}
+		opts.Palette = palette
+	}
+
+	if strUpscale := query.Get("upscale"); strUpscale != "" {
+		upscale, err := strconv.ParseBool(strUpscale)
+		if err != nil {
+			logger(ctx).Warn("Invalid upscale", "upscale", strUpscale)
+			return opts, errInvalidParameters
+		}
+		opts.Upscale = upscale
+	}
+
+	if strSharpen := query.Get("sharpen"); strSharpen != "" {
+		sharpen, err := strconv.Atoi(strSharpen)
+		if err != nil || sharpen < 0 || sharpen > maxSharpen {
+			logger(ctx).Warn("Invalid sharpen", "sharpen", strSharpen)
+			return opts, errInvalidParameters
+		}
+		opts.Sharpen = sharpen
+	}
+
+	if strTrim := query.Get("trim"); strTrim != "" {
+		trim, err := strconv.ParseBool(strTrim)
+		if err != nil {
+			logger(ctx).Warn("Invalid trim", "trim", strTrim)
+			return opts, errInvalidParameters
+		}
+		opts.Trim = trim
+	}
+
+	if strProgressive := query.Get("progressive"); strProgressive != "" {
+		progressive, err := strconv.ParseBool(strProgressive)
+		if err != nil {
+			logger(ctx).Warn("Invalid progressive", "progressive", strProgressive)
+			return opts, errInvalidParameters
+		}
+		opts.Progressive = progressive
+	}
+
+	if strKeep := query.Get("keep-metadata"); strKeep != "" {
+		keep, err := strconv.ParseBool(strKeep)
+		if err != nil {
+			logger(ctx).Warn("Invalid keep-metadata", "keep-metadata", strKeep)
+			return opts, errInvalidParameters
+		}
+		opts.KeepMetadata = keep
+	}
+
+	if strBlur := query.Get("blur"); strBlur != "" {
+		blur, err := strconv.Atoi(strBlur)
+		if err != nil || blur < 0 || blur > maxBlur {
+			logger(ctx).Warn("Invalid blur", "blur", strBlur)
+			return opts, errInvalidParameters
+		}
+		opts.Blur = blur
+	}
+
+	if strGrayscale := query.Get("grayscale"); strGrayscale != "" {
+		grayscale, err := strconv.ParseBool(strGrayscale)
+		if err != nil {
+			logger(ctx).Warn("Invalid grayscale", "grayscale", strGrayscale)
+			return opts, errInvalidParameters
+		}
+		opts.Grayscale = grayscale
+	}
+
+	if bg := query.Get("bg"); bg != "" {
+		rgb, err := hex.DecodeString(bg)
+		if err != nil || len(rgb) != 3 {
+			logger(ctx).Warn("Invalid background", "bg", bg)
+			return opts, errInvalidParameters
+		}
+		opts.Background = strings.ToLower(bg)
+	}
+
+	if wm := query.Get("wm"); wm != "" {
+		position, strOpacity, _ := strings.Cut(wm, ",")
+		opacity := 100
+		if strOpacity != "" {
+			opacity, err = strconv.Atoi(strOpacity)
+		}
+		if s.config.Watermark == nil || !watermarkPositions[position] || err != nil || opacity < 1 || opacity > 100 {
+			logger(ctx).Warn("Invalid watermark", "wm", wm)
+			return opts, errInvalidParameters
+		}
+		opts.Watermark = position
+		opts.WatermarkOpacity = opacity
+	}
+
+	// Prefer the formats giving the smallest files
+	opts.Negotiated = s.isAllowedFormat("avif") || s.isAllowedFormat("webp")
+	if acceptable("image/avif") && s.isAllowedFormat("avif") {
+		opts.Format = "avif"
+	} else if acceptable("image/webp") && s.isAllowedFormat("webp") {
+		opts.Format = "webp"
+	}
+
+	return opts, nil
+}
+
+// Receive an HTTP request, fetch the image and respond with it.
+// fn is called to respond when the image can't be fetched.
+func (s *Server) Image(w http.ResponseWriter, r *http.Request, fn func(err error, opts ResizeOptions)) {
+	query := r.URL.Query()
+	encoded_url := query.Get(":encoded_url")
+
+	strWidth, strHeight := query.Get(":width"), query.Get(":height")
+
+	if !s.checkSignature(query.Get("sig"), withQuery(query, encoded_url, strWidth, strHeight)...) {
+		logger(r.Context()).Warn("Invalid signature", "encoded_url", encoded_url)
+		httpError(w, r, "Invalid signature", 403)
+		return
+	}
+
+	opts, ok := s.parseOptions(w, r)
+	if !ok {
+		return
+	}
+
+	s.serveImage(w, r, encoded_url, opts, fn)
+}
+
+// Receive an HTTP request for an image at the default size of the
+// thumbnails, and respond with it
+func (s *Server) Thumb(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	encoded_url := query.Get(":encoded_url")
+
+	if !s.checkSignature(query.Get("sig"), withQuery(query, encoded_url)...) {
+		logger(r.Context()).Warn("Invalid signature", "encoded_url", encoded_url)
+		httpError(w, r, "Invalid signature", 403)
+		return
+	}
+
+	// Parse the options as if the default size was in the path
+	query.Set(":width", strconv.Itoa(s.config.ThumbWidth))
+	query.Set(":height", strconv.Itoa(s.config.ThumbHeight))
+	if query.Get("mode") == "" {
+		query.Set("mode", s.config.ThumbMode)
+	}
+	r.URL.RawQuery = query.Encode()
+
+	opts, ok := s.parseOptions(w, r)
+	if !ok {
+		return
+	}
+
+	s.serveImage(w, r, encoded_url, opts, func(err error, opts ResizeOptions) {
+		status := errorStatus(err)
+		httpError(w, r, http.StatusText(status), status)
+	})
+}
+
+// Receive an HTTP request for an image with the options of a preset, and
+// respond with it
+func (s *Server) Preset(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	name := query.Get(":name")
+	encoded_url := query.Get(":encoded_url")
+
+	if !s.checkSignature(query.Get("sig"), withQuery(query, name, encoded_url)...) {
+		logger(r.Context()).Warn("Invalid signature", "encoded_url", encoded_url)
+		httpError(w, r, "Invalid signature", 403)
+		return
+	}
+
+	preset, ok := s.config.Presets[name]
+	if !ok {
+		logger(r.Context()).Warn("Unknown preset", "preset", name)
+		httpError(w, r, "Unknown preset", 404)
+		return
+	}
+
+	// Parse the options as if the ones of the preset were in the request
+	query.Set(":width", strconv.Itoa(preset.Width))
+	query.Set(":height", strconv.Itoa(preset.Height))
+	for param, value := range map[string]string{"mode": preset.Mode, "gravity": preset.Gravity, "filter": preset.Filter} {
+		if value != "" {
+			query.Set(param, value)
+		}
+	}
+	if preset.Quality > 0 {
+		query.Set("quality", strconv.Itoa(preset.Quality))
+	}
+	r.URL.RawQuery = query.Encode()
+
+	opts, ok := s.parseOptions(w, r)
+	if !ok {
+		return
+	}
+	if preset.Format != "" {
+		opts.Format = preset.Format
+		opts.Negotiated = false
+	}
+
+	s.serveImage(w, r, encoded_url, opts, func(err error, opts ResizeOptions) {
+		status := errorStatus(err)
+		httpError(w, r, http.StatusText(status), status)
+	})
+}
+
+// Fetch the image of an hex-encoded URL, resize it and respond with it.
+// fn is called to respond when the image can't be fetched.
+func (s *Server) serveImage(w http.ResponseWriter, r *http.Request, encoded_url string, opts ResizeOptions, fn func(err error, opts ResizeOptions)) {
+	chars, err := hex.DecodeString(encoded_url)
+	if err != nil {
+		logger(r.Context()).Warn("Invalid URL", "encoded_url", encoded_url)
+		httpError(w, r, "Invalid parameters", 400)
+		return
+	}
+	uri := string(chars)
+
+	err = s.validateURL(r.Context(), uri)
+	if err != nil {
+		fn(err, opts)
+		return
+	}
+
+	headers, body, err := s.FetchResized(r.Context(), uri, opts)
+	if err != nil {
+		fn(err, opts)
+		return
+	}
+
+	s.respondResized(w, r, headers, body, opts)
+}
+
+// Receive an HTTP request for an original image, and respond with it as
+// fetched from the distant server, without resizing nor re-encoding it
+func (s *Server) Proxy(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	encoded_url := query.Get(":encoded_url")
+
+	if !s.checkSignature(query.Get("sig"), withQuery(query, encoded_url)...) {
+		logger(r.Context()).Warn("Invalid signature", "encoded_url", encoded_url)
+		httpError(w, r, "Invalid signature", 403)
+		return
+	}
+
+	chars, err := hex.DecodeString(encoded_url)
+	if err != nil {
+		logger(r.Context()).Warn("Invalid URL", "encoded_url", encoded_url)
+		httpError(w, r, "Invalid parameters", 400)
+		return
+	}
+	uri := string(chars)
+
+	err = s.validateURL(r.Context(), uri)
+	if err != nil {
+		status := errorStatus(err)
+		httpError(w, r, http.StatusText(status), status)
+		return
+	}
+
+	// The original may be an SVG with scripts
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("Content-Security-Policy", "default-src 'none'; style-src 'unsafe-inline'; sandbox")
+
+	if s.config.StreamOriginals && s.streamOriginal(w, r, uri) {
+		return
+	}
+
+	headers, body, err := s.FetchImage(r.Context(), uri)
+	if err != nil {
+		status := errorStatus(err)
+		httpError(w, r, http.StatusText(status), status)
+		return
+	}
+
+	s.respond(w, r, headers, body)
+}
+
+// Respond with a fresh original streamed from its file in cache, with
+// support for the range and conditional requests. It returns false when the
+// cache can't open the files, or when the original must be fetched.
+func (s *Server) streamOriginal(w http.ResponseWriter, r *http.Request, uri string) bool {
+	opener, ok := s.cache.(Opener)
+	if !ok || s.urlStatus(uri) != nil {
+		return false
+	}
+
+	headers, file, ok := opener.Open(cacheKey(uri, "orig"))
+	if !ok {
+		return false
+	}
+	defer file.Close()
+
+	if s.isStale(headers) {
+		return false
+	}
+	etag, err := generateFileETag(file)
+	if err != nil {
+		return false
+	}
+	cacheLookups.WithLabelValues(variationKind("orig"), "hit").Inc()
+
+	// The modification time is the one of the distant server, for the
+	// conditional requests
+	modtime, _ := http.ParseTime(headers.LastModified)
+
+	w.Header().Set("Content-Type", headers.ContentType)
+	w.Header().Set("Cache-Control", s.cacheControl(headers.CacheControl, s.config.MaxAge))
+	w.Header().Set("ETag", etag)
+	w.Header().Set("X-Cache", "HIT")
+	http.ServeContent(w, r, "", modtime, file)
+
+	return true
+}
+
+// Receive an HTTP request with an image as body, and respond with it
+// resized. Neither the image nor the result are cached.
+func (s *Server) Post(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+
+	body, err := readBody(r.Body, maxSize+1)
+	if err != nil {
+		logger(r.Context()).Warn("Error while reading the body", "error", err)
+		httpError(w, r, "Invalid body", 400)
+		return
+	}
+	if len(body) > maxSize {
+		httpError(w, r, http.StatusText(http.StatusRequestEntityTooLarge), http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	// The image is signed too, or the signature would resize any other one
+	if !s.checkSignature(query.Get("sig"), withQuery(query, query.Get(":width"), query.Get(":height"), bodyHash(body))...) {
+		logger(r.Context()).Warn("Invalid signature")
+		httpError(w, r, "Invalid signature", 403)
+		return
+	}
+
+	opts, ok := s.parseOptions(w, r)
+	if !ok {
+		return
+	}
+
+	headers := Headers{
+		ContentType:  detectContentType(body),
+		LastModified: time.Now().Format(time.RFC1123),
+	}
+	headers, body, err = s.resizeImage(r.Context(), "-", string(body), headers, opts)
+	if err == errTooBusy {
+		httpError(w, r, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+		return
+	}
+	if err != nil {
+		logger(r.Context()).Warn("Invalid image", "error", err)
+		httpError(w, r, "Invalid image", 400)
+		return
+	}
+	headers.CacheControl = "no-store"
+
+	s.respondResized(w, r, headers, body, opts)
+}
+
+// Respond with a resized image, telling the caches how it was negotiated
+func (s *Server) respondResized(w http.ResponseWriter, r *http.Request, headers Headers, body []byte, opts ResizeOptions) {
+	if opts.Negotiated {
+		w.Header().Add("Vary", "Accept")
+	}
+	if opts.DPR > 1 {
+		w.Header().Set("Content-DPR", strconv.Itoa(opts.DPR))
+	}
+	s.respond(w, r, headers, body)
+}
+
+// Respond with an image, or with a 304 if the client already has it. The
+// body is served with support for the range requests.
+func (s *Server) respond(w http.ResponseWriter, r *http.Request, headers Headers, body []byte) {
+	etag := generateETag(body)
+	if isNotModified(r, etag, headers.LastModified) {
+		w.Header().Add("ETag", etag)
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	w.Header().Add("Content-Type", headers.ContentType)
+	w.Header().Add("ETag", etag)
+	w.Header().Add("Last-Modified", headers.LastModified)
+	w.Header().Add("Cache-Control", headers.CacheControl)
+	if headers.CacheStatus != "" {
+		w.Header().Set("X-Cache", headers.CacheStatus)
+	}
+
+	// If-Range is checked against the ETag, or this modification time
+	modtime, _ := http.ParseTime(headers.LastModified)
+	http.ServeContent(w, r, "", modtime, bytes.NewReader(body))
+}
+
+// Receive an HTTP request for an image and respond with it
+func (s *Server) Img(w http.ResponseWriter, r *http.Request) {
+	fn := func(err error, opts ResizeOptions) {
+		status := errorStatus(err)
+		httpError(w, r, http.StatusText(status), status)
+	}
+	s.Image(w, r, fn)
+}
+
+// Receive an HTTP request for an avatar and respond with it, or with the
+// default image if the avatar can't be fetched
+func (s *Server) Avatar(w http.ResponseWriter, r *http.Request) {
+	fn := func(err error, opts ResizeOptions) {
+		status := errorStatus(err)
+		if s.config.DefaultImage == "" || status == http.StatusForbidden || status == http.StatusBadRequest {
+			httpError(w, r, http.StatusText(status), status)
+			return
+		}
+
+		headers, body, err := s.FetchResized(r.Context(), s.config.DefaultImage, opts)
+		if err != nil {
+			logger(r.Context()).Error("Error while fetching the default image", "uri", s.config.DefaultImage, "error", err)
+			status = errorStatus(err)
+			httpError(w, r, http.StatusText(status), status)
+			return
+		}
+
+		// The avatar may be available soon
+		headers.CacheControl = "public, max-age=60"
+		s.respondResized(w, r, headers, body, opts)
+	}
+	s.Image(w, r, fn)
+}
+
+// Receive an HTTP request to remove an image and all its variations from
+// cache, and respond with the number of removed variations
+func (s *Server) Purge(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	encoded_url := query.Get(":encoded_url")
+
+	if !s.checkSignature(query.Get("sig"), withQuery(query, encoded_url)...) {
+		logger(r.Context()).Warn("Invalid signature", "encoded_url", encoded_url)
+		httpError(w, r, "Invalid signature", 403)
+		return
+	}
+
+	chars, err := hex.DecodeString(encoded_url)
+	if err != nil {
+		logger(r.Context()).Warn("Invalid URL", "encoded_url", encoded_url)
+		httpError(w, r, "Invalid parameters", 400)
+		return
+	}
+	uri := string(chars)
+
+	purger, ok := s.cache.(Purger)
+	if !ok {
+		httpError(w, r, "Purge not supported by the cache", http.StatusNotImplemented)
+		return
+	}
+
+	count, err := purger.Purge(uri)
+	if err != nil {
+		logger(r.Context()).Error("Error while purging", "uri", uri, "error", err)
+		httpError(w, r, http.StatusText(500), 500)
+		return
+	}
+	logger(r.Context()).Info("Purge", "uri", uri, "removed", count)
+
+	w.Header().Set("Content-Type", "application/json")
+	if count == 0 {
+		w.WriteHeader(http.StatusNotFound)
+	}
+	json.NewEncoder(w).Encode(map[string]int{"removed": count})
+}
+
+// The infos about an original image
+type imageInfo struct {
+	Width  int    `json:"width"`
+	Height int    `json:"height"`
+	Format string `json:"format"`
+	Size   int    `json:"size"`
+}
+
+// Receive an HTTP request for the infos about an image, and respond with
+// them in JSON. The dimensions are the ones of the image once upright.
+func (s *Server) Info(w http.ResponseWriter, r *http.Request) {
+	s.describe(w, r, false)
+}
+
+// Receive an HTTP request to check that an image can be fetched and
+// decoded, and respond with its infos in JSON
+func (s *Server) Validate(w http.ResponseWriter, r *http.Request) {
+	s.describe(w, r, true)
+}
+
+// Respond with the infos about an image in JSON. If full, all its pixels
+// are decoded, and the URL is cached in error if they can't be.
+func (s *Server) describe(w http.ResponseWriter, r *http.Request, full bool) {
+	query := r.URL.Query()
+	encoded_url := query.Get(":encoded_url")
+
+	if !s.checkSignature(query.Get("sig"), withQuery(query, encoded_url)...) {
+		logger(r.Context()).Warn("Invalid signature", "encoded_url", encoded_url)
+		httpError(w, r, "Invalid signature", 403)
+		return
+	}
+
+	chars, err := hex.DecodeString(encoded_url)
+	if err != nil {
+		logger(r.Context()).Warn("Invalid URL", "encoded_url", encoded_url)
+		httpError(w, r, "Invalid parameters", 400)
+		return
+	}
+	uri := string(chars)
+
+	err = s.validateURL(r.Context(), uri)
+	if err != nil {
+		status := errorStatus(err)
+		httpError(w, r, http.StatusText(status), status)
+		return
+	}
+
+	headers, body, err := s.FetchImage(r.Context(), uri)
+	if err != nil {
+		status := errorStatus(err)
+		httpError(w, r, http.StatusText(status), status)
+		return
+	}
+
+	info, err := s.decodeInfo(r.Context(), body, full)
+	switch {
+	case err == errTooBusy || r.Context().Err() != nil:
+	case err == errImageTooLarge:
+		s.saveErrorInCache(uri, err, errorTTL)
+	case err == errDecodeTimeout:
+		s.saveErrorInCache(uri, err, transientErrorTTL)
+	case err != nil:
+		logger(r.Context()).Warn("Invalid image", "uri", uri, "error", err)
+		if full {
+			s.saveErrorInCache(uri, errInvalidImage, errorTTL)
+		}
+		err = errInvalidImage
+	}
+	if err != nil {
+		status := errorStatus(err)
+		httpError(w, r, http.StatusText(status), status)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", headers.CacheControl)
+	json.NewEncoder(w).Encode(info)
+}
+
+// Decode the infos about an image, without decoding its pixels unless full.
+// The full decodes are bounded like the ones of the resizes: by the size of
+// the original, the concurrent resizes and the decode timeout.
+func (s *Server) decodeInfo(ctx context.Context, body []byte, full bool) (info imageInfo, err error) {
+	if isSVG(string(body)) {
+		_, info.Width, info.Height, err = decodeSVG(string(body))
+		info.Format, info.Size = "svg", len(body)
+		return
+	}
+
+	config, format, err := image.DecodeConfig(bytes.NewReader(body))
+	if err != nil {
+		return
+	}
+
+	if full {
+		if err = s.checkSourcePixels(config); err != nil {
+			return
+		}
+		if err = s.acquireResize(ctx); err != nil {
+			return
+		}
+		defer s.releaseResize()
+
+		var m image.Image
+		if m, format, err = s.decode(ctx, string(body)); err != nil {
+			return
+		}
+		config.Width, config.Height = m.Bounds().Dx(), m.Bounds().Dy()
+	}
+
+	info = imageInfo{Width: config.Width, Height: config.Height, Format: format, Size: len(body)}
+
+	// The orientations from 5 to 8 transpose the image
+	if format == "jpeg" && readOrientation(string(body)) >= 5 {
+		info.Width, info.Height = info.Height, info.Width
+	}
+
+	return
+}
+
+// Returns 200 OK if the server is running (for monitoring)
+func (s *Server) Status(w http.ResponseWriter, r *http.Request) {
+	fmt.Fprintf(w, "OK")
+}
+
+// Check the health of the cache components, like redis and the cache directory.
+// Returns 200 when healthy, or 503 naming the failing components.
+func (s *Server) Health(w http.ResponseWriter, r *http.Request) {
+	status := map[string]string{}
+	healthy := true
+
+	if checker, ok := s.cache.(HealthChecker); ok {
+		for component, err := range checker.Check() {
+			status[component] = "ok"
+			if err != nil {
+				logger(r.Context()).Error("Health check failed", "component", component, "error", err)
+				status[component] = err.Error()
+				healthy = false
+			}
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if !healthy {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(status)
+}
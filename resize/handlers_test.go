@@ -0,0 +1,958 @@
+package resize
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestContentLength(t *testing.T) {
+	c := newMemoryCache()
+	s := NewServer(Config{MaxPixels: 1 << 20}, c)
+	uri := testOrigin + "/a.png"
+	cacheOriginal(c, uri, "image/png", pngImage(t, 400, 200))
+	path := "/resize/" + encodeURL(uri) + "/100/50"
+
+	w := serve(s.Handler(), "GET", path)
+	if w.Code != 200 {
+		t.Fatalf("status = %d", w.Code)
+	}
+	if length := w.Header().Get("Content-Length"); length != strconv.Itoa(w.Body.Len()) {
+		t.Errorf("Content-Length = %s, want %d", length, w.Body.Len())
+	}
+
+	w = serve(s.Handler(), "GET", path, "If-None-Match: "+w.Header().Get("ETag"))
+	if w.Code != 304 || w.Body.Len() != 0 || w.Header().Get("Content-Length") != "" {
+		t.Errorf("304: status = %d, body = %d bytes, Content-Length = %q", w.Code, w.Body.Len(), w.Header().Get("Content-Length"))
+	}
+}
+
+func TestETag(t *testing.T) {
+	c := newMemoryCache()
+	s := NewServer(Config{MaxPixels: 1 << 20}, c)
+	uri := testOrigin + "/a.png"
+	cacheOriginal(c, uri, "image/png", pngImage(t, 400, 200))
+	path := "/resize/" + encodeURL(uri) + "/100/50"
+
+	w := serve(s.Handler(), "GET", path)
+	etag := w.Header().Get("ETag")
+	if etag != generateETag(w.Body.Bytes()) {
+		t.Fatalf("ETag = %s, want the one of the body", etag)
+	}
+
+	tests := []struct {
+		name    string
+		headers []string
+		status  int
+	}{
+		{"matching ETag", []string{"If-None-Match: " + etag}, 304},
+		{"matching ETag in a list", []string{`If-None-Match: "other", ` + etag}, 304},
+		{"other ETag", []string{`If-None-Match: "other"`}, 200},
+		{"If-Modified-Since", []string{"If-Modified-Since: " + testLastModified}, 304},
+		{"older If-Modified-Since", []string{"If-Modified-Since: Sun, 31 Dec 2023 00:00:00 GMT"}, 200},
+		{"other ETag over If-Modified-Since", []string{`If-None-Match: "other"`, "If-Modified-Since: " + testLastModified}, 200},
+	}
+	for _, test := range tests {
+		w := serve(s.Handler(), "GET", path, test.headers...)
+		if w.Code != test.status {
+			t.Errorf("%s: status = %d, want %d", test.name, w.Code, test.status)
+		}
+		if w.Header().Get("ETag") != etag {
+			t.Errorf("%s: ETag = %s, want %s", test.name, w.Header().Get("ETag"), etag)
+		}
+	}
+}
+
+func TestDimensionLimits(t *testing.T) {
+	s := NewServer(Config{MaxWidth: 1000, MaxHeight: 800, MaxPixels: 500000}, newMemoryCache())
+	prefix := "/resize/" + encodeURL(testOrigin+"/a.png")
+
+	tests := []struct {
+		size    string
+		message string
+	}{
+		{"/2000/10", "Requested width exceeds 1000"},
+		{"/10/900", "Requested height exceeds 800"},
+		{"/900/700", "Requested resized image exceeds 500000 pixels"},
+		{"/-1/10", "Invalid parameters"},
+		{"/a/10", "Invalid parameters"},
+	}
+	for _, test := range tests {
+		w := serve(s.Handler(), "GET", prefix+test.size)
+		if w.Code != 400 || strings.TrimSpace(w.Body.String()) != test.message {
+			t.Errorf("%s: %d %q, want 400 %q", test.size, w.Code, w.Body.String(), test.message)
+		}
+	}
+}
+
+func TestDimensionClamps(t *testing.T) {
+	c := newMemoryCache()
+	uri := testOrigin + "/a.png"
+	cacheOriginal(c, uri, "image/png", pngImage(t, 40, 20))
+	prefix := "/resize/" + encodeURL(uri)
+
+	// Within the pixel budget, but not within the default clamps
+	s := NewServer(Config{MaxPixels: 1 << 20}, c)
+	for _, size := range []string{"/20000/1", "/1/20000"} {
+		if w := serve(s.Handler(), "GET", prefix+size); w.Code != 400 {
+			t.Errorf("%s: status = %d, want 400", size, w.Code)
+		}
+	}
+
+	s = NewServer(Config{MaxWidth: 100, MaxHeight: 50, MaxPixels: 1 << 20}, c)
+	tests := []struct {
+		size   string
+		status int
+	}{
+		{"/101/10", 400},
+		{"/10/51", 400},
+		{"/100/50", 200},
+	}
+	for _, test := range tests {
+		if w := serve(s.Handler(), "GET", prefix+test.size); w.Code != test.status {
+			t.Errorf("%s: status = %d, want %d", test.size, w.Code, test.status)
+		}
+	}
+
+	// An original larger than the clamps is passed through when it needs no
+	// resize
+	wide := testOrigin + "/wide.png"
+	orig := pngImage(t, 500, 30)
+	cacheOriginal(c, wide, "image/png", orig)
+	w := serve(s.Handler(), "GET", "/resize/"+encodeURL(wide)+"/0/40")
+	if w.Code != 200 || !bytes.Equal(w.Body.Bytes(), orig) {
+		t.Errorf("status = %d without a resize, want the original", w.Code)
+	}
+}
+
+func TestOutputFormats(t *testing.T) {
+	c := newMemoryCache()
+	uri := testOrigin + "/a.png"
+	cacheOriginal(c, uri, "image/png", pngImage(t, 40, 20))
+	s := NewServer(Config{MaxPixels: 1 << 20, OutputFormats: []string{"jpeg", "webp"}}, c)
+	path := "/resize/" + encodeURL(uri) + "/10/10"
+
+	tests := []struct {
+		accept      string
+		contentType string
+	}{
+		// The format of the original is not allowed
+		{"", "image/jpeg"},
+		{"image/avif,image/webp", "image/webp"},
+		{"image/avif", "image/jpeg"},
+	}
+	for _, test := range tests {
+		w := serve(s.Handler(), "GET", path, "Accept: "+test.accept)
+		if w.Code != 200 || w.Header().Get("Content-Type") != test.contentType {
+			t.Errorf("Accept %q: %d %s, want 200 %s", test.accept, w.Code, w.Header().Get("Content-Type"), test.contentType)
+		}
+	}
+}
+
+func TestThumb(t *testing.T) {
+	c := newMemoryCache()
+	uri := testOrigin + "/a.png"
+	cacheOriginal(c, uri, "image/png", pngImage(t, 400, 200))
+
+	tests := []struct {
+		config        Config
+		width, height int
+	}{
+		// Filled by default
+		{Config{}, 150, 150},
+		{Config{ThumbWidth: 60, ThumbHeight: 40}, 60, 40},
+		{Config{ThumbWidth: 60, ThumbHeight: 40, ThumbMode: "fit"}, 60, 30},
+	}
+	for _, test := range tests {
+		test.config.SyncCache = true
+		s := NewServer(test.config, c)
+		w := serve(s.Handler(), "GET", "/thumb/"+encodeURL(uri))
+		if w.Code != 200 {
+			t.Fatalf("status = %d", w.Code)
+		}
+		m := decodeImage(t, w.Body.Bytes(), "png")
+		if m.Bounds().Dx() != test.width || m.Bounds().Dy() != test.height {
+			t.Errorf("%+v: size = %v, want %dx%d", test.config, m.Bounds(), test.width, test.height)
+		}
+	}
+
+	// Cached as the variations of the resolved sizes
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, size := range []string{"/150/150/", "/60/40/"} {
+		found := false
+		for key := range c.images {
+			found = found || strings.Contains(key, "resize"+size)
+		}
+		if !found {
+			t.Errorf("no variation cached for %s", size)
+		}
+	}
+}
+
+func TestCacheStatus(t *testing.T) {
+	client := &http.Client{Transport: respondWithImage(pngImage(t, 40, 20), "")}
+	s := NewServer(Config{MaxPixels: 1 << 20, SyncCache: true, HTTPClient: client}, newMemoryCache())
+
+	// A resized variation, and the original of another image
+	for _, path := range []string{"/resize/" + encodeURL(testOrigin+"/a.png") + "/10/10", "/proxy/" + encodeURL(testOrigin+"/b.png")} {
+		for _, want := range []string{"MISS", "HIT"} {
+			w := serve(s.Handler(), "GET", path)
+			if w.Code != 200 || w.Header().Get("X-Cache") != want {
+				t.Errorf("%s: %d with X-Cache = %q, want 200 with %s", path, w.Code, w.Header().Get("X-Cache"), want)
+			}
+		}
+	}
+}
+
+func TestVary(t *testing.T) {
+	c := newMemoryCache()
+	uri := testOrigin + "/a.png"
+	cacheOriginal(c, uri, "image/png", pngImage(t, 40, 20))
+	resize := "/resize/" + encodeURL(uri) + "/10/10"
+
+	tests := []struct {
+		formats     []string
+		path        string
+		accept      string
+		contentType string
+		vary        bool
+	}{
+		{nil, resize, "image/webp", "image/webp", true},
+		// Cached apart from the negotiated variation
+		{nil, resize, "", "image/png", true},
+		{[]string{"png", "jpeg"}, resize, "image/webp", "image/png", false},
+		{nil, "/proxy/" + encodeURL(uri), "image/webp", "image/png", false},
+	}
+	for _, test := range tests {
+		s := NewServer(Config{MaxPixels: 1 << 20, SyncCache: true, OutputFormats: test.formats}, c)
+		w := serve(s.Handler(), "GET", test.path, "Accept: "+test.accept)
+		vary := false
+		for _, value := range w.Header().Values("Vary") {
+			for _, name := range strings.Split(value, ",") {
+				vary = vary || strings.TrimSpace(name) == "Accept"
+			}
+		}
+		if w.Code != 200 || w.Header().Get("Content-Type") != test.contentType || vary != test.vary {
+			t.Errorf("%s with %v: %d %s with Vary = %q, want 200 %s with Vary: Accept %v",
+				test.accept, test.formats, w.Code, w.Header().Get("Content-Type"), w.Header().Get("Vary"), test.contentType, test.vary)
+		}
+	}
+}
+
+func TestWebPFallback(t *testing.T) {
+	c := newMemoryCache()
+	uri := testOrigin + "/a.png"
+	cacheOriginal(c, uri, "image/png", pngImage(t, 20000, 2))
+	s := NewServer(Config{MaxWidth: 20000, MaxPixels: 1 << 20, SyncCache: true}, c)
+	// Too wide for the WebP encoder
+	path := "/resize/" + encodeURL(uri) + "/17000/2"
+
+	for i := 0; i < 2; i++ {
+		w := serve(s.Handler(), "GET", path, "Accept: image/webp")
+		if w.Code != 200 || w.Header().Get("Content-Type") != "image/png" {
+			t.Fatalf("%d %s, want 200 image/png", w.Code, w.Header().Get("Content-Type"))
+		}
+		if w.Header().Get("X-Cache") != "MISS" {
+			t.Errorf("request %d: X-Cache = %q, want MISS as the fallback is not cached", i, w.Header().Get("X-Cache"))
+		}
+		decodeImage(t, w.Body.Bytes(), "png")
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for key := range c.images {
+		if key != cacheKey(uri, "orig") {
+			t.Errorf("%s is cached", key)
+		}
+	}
+}
+
+func TestCachedNotFound(t *testing.T) {
+	var requests int32
+	upstream := func(r *http.Request) (*http.Response, error) {
+		atomic.AddInt32(&requests, 1)
+		status := 404
+		if strings.HasSuffix(r.URL.Path, "/unavailable.png") {
+			status = 503
+		}
+		return respondWith(status)(r)
+	}
+	c := newMemoryCache()
+	s := NewServer(Config{MaxPixels: 1 << 20, SyncCache: true, HTTPClient: &http.Client{Transport: roundTripFunc(upstream)}}, c)
+
+	path := "/resize/" + encodeURL(testOrigin+"/missing.png") + "/10/10"
+	for i := 0; i < 2; i++ {
+		if w := serve(s.Handler(), "GET", path); w.Code != 404 {
+			t.Errorf("request %d: status = %d, want 404", i+1, w.Code)
+		}
+	}
+	if requests != 1 {
+		t.Errorf("%d fetches, want the 404 to be cached", requests)
+	}
+
+	// Cached for longer than the transient errors
+	if w := serve(s.Handler(), "GET", "/resize/"+encodeURL(testOrigin+"/unavailable.png")+"/10/10"); w.Code != 502 {
+		t.Errorf("unavailable: status = %d, want 502", w.Code)
+	}
+	_, notFoundTTL := c.cachedError(testOrigin + "/missing.png")
+	_, transientTTL := c.cachedError(testOrigin + "/unavailable.png")
+	if notFoundTTL <= transientTTL {
+		t.Errorf("TTL of a 404 = %d, of a 503 = %d", notFoundTTL, transientTTL)
+	}
+}
+
+func TestPresets(t *testing.T) {
+	var presets map[string]Preset
+	err := json.Unmarshal([]byte(`{
+		"small": {"width": 20, "height": 20, "mode": "fill", "format": "jpeg", "quality": 50},
+		"banner": {"width": 60, "height": 10, "mode": "pad", "format": "png"}
+	}`), &presets)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := newMemoryCache()
+	uri := testOrigin + "/a.png"
+	cacheOriginal(c, uri, "image/png", pngImage(t, 80, 40))
+	s := NewServer(Config{MaxPixels: 1 << 20, Presets: presets}, c)
+
+	tests := []struct {
+		name          string
+		format        string
+		width, height int
+	}{
+		{"small", "jpeg", 20, 20},
+		{"banner", "png", 60, 10},
+	}
+	for _, test := range tests {
+		// Whatever the client accepts
+		w := serve(s.Handler(), "GET", "/preset/"+test.name+"/"+encodeURL(uri), "Accept: image/webp")
+		if w.Code != 200 {
+			t.Fatalf("%s: status = %d", test.name, w.Code)
+		}
+		m := decodeImage(t, w.Body.Bytes(), test.format)
+		if m.Bounds().Dx() != test.width || m.Bounds().Dy() != test.height {
+			t.Errorf("%s: size = %v, want %dx%d", test.name, m.Bounds(), test.width, test.height)
+		}
+	}
+
+	if w := serve(s.Handler(), "GET", "/preset/unknown/"+encodeURL(uri)); w.Code != 404 {
+		t.Errorf("unknown preset: status = %d, want 404", w.Code)
+	}
+}
+
+func TestJSONErrors(t *testing.T) {
+	s := NewServer(Config{MaxPixels: 1 << 20}, newMemoryCache())
+	path := "/resize/" + encodeURL(testOrigin+"/a.png") + "/-1/10"
+
+	w := serve(s.Handler(), "GET", path, "Accept: application/json")
+	var body struct {
+		Error string `json:"error"`
+		Code  int    `json:"code"`
+	}
+	decodeJSON(t, w, &body)
+	if w.Code != 400 || w.Header().Get("Content-Type") != "application/json" {
+		t.Errorf("status = %d, Content-Type = %s, want 400 application/json", w.Code, w.Header().Get("Content-Type"))
+	}
+	if body.Error != "Invalid parameters" || body.Code != 400 {
+		t.Errorf("body = %+v", body)
+	}
+
+	// In plain text by default
+	w = serve(s.Handler(), "GET", path)
+	if !strings.HasPrefix(w.Header().Get("Content-Type"), "text/plain") || strings.TrimSpace(w.Body.String()) != "Invalid parameters" {
+		t.Errorf("Content-Type = %s, body = %q, want plain text", w.Header().Get("Content-Type"), w.Body.String())
+	}
+}
+
+// Cache an original fetched long ago, to revalidate
+func cacheStaleOriginal(c Cache, uri string, body []byte) {
+	headers := Headers{ContentType: "image/png", LastModified: testLastModified, CacheControl: "max-age=60", FetchedAt: time.Now().Add(-time.Hour)}
+	c.Set(cacheKey(uri, "orig"), headers, body)
+}
+
+func TestStaleIfError(t *testing.T) {
+	c := newMemoryCache()
+	uri := testOrigin + "/a.png"
+	png := pngImage(t, 40, 20)
+	cacheStaleOriginal(c, uri, png)
+	s := NewServer(Config{MaxPixels: 1 << 20, HTTPClient: &http.Client{Transport: respondWith(503)}}, c)
+
+	w := serve(s.Handler(), "GET", "/proxy/"+encodeURL(uri))
+	if w.Code != 200 || !bytes.Equal(w.Body.Bytes(), png) {
+		t.Fatalf("status = %d, want the stale original", w.Code)
+	}
+	if w.Header().Get("X-Cache") != "STALE" || w.Header().Get("Cache-Control") != fmt.Sprintf("public, max-age=%d", staleIfErrorMaxAge) {
+		t.Errorf("X-Cache = %q, Cache-Control = %q", w.Header().Get("X-Cache"), w.Header().Get("Cache-Control"))
+	}
+}
+
+func TestStaleDespiteCachedError(t *testing.T) {
+	c := newMemoryCache()
+	uri := testOrigin + "/a.png"
+	png := pngImage(t, 40, 20)
+	cacheStaleOriginal(c, uri, png)
+	var requests int32
+	upstream := func(r *http.Request) (*http.Response, error) {
+		atomic.AddInt32(&requests, 1)
+		return respondWith(503)(r)
+	}
+	s := NewServer(Config{MaxPixels: 1 << 20, SyncCache: true, HTTPClient: &http.Client{Transport: roundTripFunc(upstream)}}, c)
+
+	// The error of the first revalidation is cached
+	for i := 0; i < 2; i++ {
+		w := serve(s.Handler(), "GET", "/proxy/"+encodeURL(uri))
+		if w.Code != 200 || w.Header().Get("X-Cache") != "STALE" || !bytes.Equal(w.Body.Bytes(), png) {
+			t.Errorf("request %d: %d with X-Cache = %q, want the STALE original", i+1, w.Code, w.Header().Get("X-Cache"))
+		}
+	}
+	if requests != 1 {
+		t.Errorf("%d fetches, want the error to be cached", requests)
+	}
+	if err := c.GetError(uri); err == nil {
+		t.Error("no error cached")
+	}
+
+	// Not when the URL itself is rejected
+	c.SetError(uri, errForbiddenHost, errorTTL)
+	if w := serve(s.Handler(), "GET", "/proxy/"+encodeURL(uri)); w.Code != 403 {
+		t.Errorf("forbidden host: status = %d, want 403", w.Code)
+	}
+}
+
+func TestProxy(t *testing.T) {
+	// With metadata that a resize would strip
+	jpeg := withOrientation(jpegImage(t, 80, 40), 6)
+	upstream := func(r *http.Request) (*http.Response, error) {
+		return &http.Response{StatusCode: 200, Header: http.Header{"Content-Type": {"image/jpeg"}}, Body: io.NopCloser(bytes.NewReader(jpeg)), Request: r}, nil
+	}
+	s := NewServer(Config{MaxPixels: 1 << 20, Secret: "secret", HTTPClient: &http.Client{Transport: roundTripFunc(upstream)}}, newMemoryCache())
+
+	encoded := encodeURL(testOrigin + "/a.jpg")
+	w := serve(s.Handler(), "GET", "/proxy/"+encoded+"?sig="+Sign("secret", encoded))
+	if w.Code != 200 || w.Header().Get("Content-Type") != "image/jpeg" || !bytes.Equal(w.Body.Bytes(), jpeg) {
+		t.Errorf("status = %d, Content-Type = %s, want the original unchanged", w.Code, w.Header().Get("Content-Type"))
+	}
+
+	// Like the resized images
+	if w := serve(s.Handler(), "GET", "/proxy/"+encoded); w.Code != 403 {
+		t.Errorf("unsigned: status = %d, want 403", w.Code)
+	}
+	private := encodeURL("http://10.0.0.1/a.jpg")
+	if w := serve(s.Handler(), "GET", "/proxy/"+private+"?sig="+Sign("secret", private)); w.Code != errorStatus(errForbiddenHost) {
+		t.Errorf("private address: status = %d, want %d", w.Code, errorStatus(errForbiddenHost))
+	}
+}
+
+func TestStreamedOriginalRange(t *testing.T) {
+	c := newTestDiskCache(t)
+	s := NewServer(Config{StreamOriginals: true}, c)
+	uri := testOrigin + "/a.png"
+	png := pngImage(t, 40, 20)
+	cacheOriginal(c, uri, "image/png", png)
+
+	w := serve(s.Handler(), "GET", "/proxy/"+encodeURL(uri), "Range: bytes=10-19")
+	if w.Code != 206 || !bytes.Equal(w.Body.Bytes(), png[10:20]) {
+		t.Fatalf("status = %d, body = %x, want a 206 with bytes 10 to 19", w.Code, w.Body.Bytes())
+	}
+	if cr := w.Header().Get("Content-Range"); cr != fmt.Sprintf("bytes 10-19/%d", len(png)) {
+		t.Errorf("Content-Range = %q", cr)
+	}
+	if w.Header().Get("X-Cache") != "HIT" || w.Header().Get("Content-Type") != "image/png" {
+		t.Errorf("X-Cache = %q, Content-Type = %q", w.Header().Get("X-Cache"), w.Header().Get("Content-Type"))
+	}
+}
+
+func TestStreamedOriginalETag(t *testing.T) {
+	c := newTestDiskCache(t)
+	uri := testOrigin + "/a.png"
+	png := pngImage(t, 40, 20)
+	cacheOriginal(c, uri, "image/png", png)
+	streamed := NewServer(Config{StreamOriginals: true}, c)
+	buffered := NewServer(Config{}, c)
+
+	w := serve(streamed.Handler(), "GET", "/proxy/"+encodeURL(uri))
+	etag := w.Header().Get("ETag")
+	if w.Code != 200 || etag != generateETag(png) {
+		t.Fatalf("status = %d, ETag = %q, want the one of the body", w.Code, etag)
+	}
+	if other := serve(buffered.Handler(), "GET", "/proxy/"+encodeURL(uri)).Header().Get("ETag"); other != etag {
+		t.Errorf("ETag = %q without streaming, want %q", other, etag)
+	}
+
+	w = serve(streamed.Handler(), "GET", "/proxy/"+encodeURL(uri), "If-None-Match: "+etag)
+	if w.Code != 304 {
+		t.Errorf("status = %d with the ETag, want 304", w.Code)
+	}
+	// A range of another version is not served
+	w = serve(streamed.Handler(), "GET", "/proxy/"+encodeURL(uri), "Range: bytes=10-19", `If-Range: "other"`)
+	if w.Code != 200 || !bytes.Equal(w.Body.Bytes(), png) {
+		t.Errorf("status = %d with another If-Range, want the whole image", w.Code)
+	}
+}
+
+func TestResizedRange(t *testing.T) {
+	c := newMemoryCache()
+	s := NewServer(Config{MaxPixels: 1 << 20}, c)
+	uri := testOrigin + "/a.png"
+	cacheOriginal(c, uri, "image/png", pngImage(t, 400, 200))
+	path := "/resize/" + encodeURL(uri) + "/100/50"
+
+	full := serve(s.Handler(), "GET", path)
+	body := full.Body.Bytes()
+	if full.Code != 200 || full.Header().Get("Accept-Ranges") != "bytes" {
+		t.Fatalf("status = %d, Accept-Ranges = %q", full.Code, full.Header().Get("Accept-Ranges"))
+	}
+	decodeImage(t, body, "png")
+
+	w := serve(s.Handler(), "GET", path, "Range: bytes=0-99")
+	if w.Code != 206 || !bytes.Equal(w.Body.Bytes(), body[:100]) {
+		t.Fatalf("status = %d, want a 206 with the first 100 bytes", w.Code)
+	}
+	if cr := w.Header().Get("Content-Range"); cr != fmt.Sprintf("bytes 0-99/%d", len(body)) {
+		t.Errorf("Content-Range = %q", cr)
+	}
+
+	w = serve(s.Handler(), "GET", path, fmt.Sprintf("Range: bytes=%d-", len(body)))
+	if w.Code != 416 {
+		t.Errorf("status = %d past the end, want 416", w.Code)
+	}
+	if cr := w.Header().Get("Content-Range"); cr != fmt.Sprintf("bytes */%d", len(body)) {
+		t.Errorf("Content-Range = %q past the end", cr)
+	}
+}
+
+// Decode the JSON body of a response
+func decodeJSON(t *testing.T, w *httptest.ResponseRecorder, v interface{}) {
+	t.Helper()
+	if err := json.Unmarshal(w.Body.Bytes(), v); err != nil {
+		t.Fatalf("invalid JSON %q: %s", w.Body.String(), err)
+	}
+}
+
+func TestHealth(t *testing.T) {
+	s := NewServer(Config{}, newTestDiskCache(t))
+	w := serve(s.Handler(), "GET", "/health")
+	var status map[string]string
+	decodeJSON(t, w, &status)
+	if w.Code != 200 || status["redis"] != "ok" || status["cache_dir"] != "ok" {
+		t.Errorf("%d %v", w.Code, status)
+	}
+}
+
+func TestHealthFailures(t *testing.T) {
+	// A connection waiting to reconnect fails the commands
+	unavailable := &RedisConn{retryAt: time.Now().Add(time.Hour)}
+	notDir := filepath.Join(t.TempDir(), "file")
+	os.WriteFile(notDir, nil, 0644)
+
+	tests := []struct {
+		cache  *DiskCache
+		failed string
+	}{
+		{NewDiskCache(t.TempDir(), unavailable, DefaultRedisPrefix), "redis"},
+		{NewDiskCache(notDir, newTestRedis(t), testPrefix(t)), "cache_dir"},
+	}
+	for _, test := range tests {
+		s := NewServer(Config{}, test.cache)
+		w := serve(s.Handler(), "GET", "/health")
+		var status map[string]string
+		decodeJSON(t, w, &status)
+		if w.Code != 503 || status[test.failed] == "ok" || status[test.failed] == "" {
+			t.Errorf("%s: %d %v", test.failed, w.Code, status)
+		}
+		for component, result := range status {
+			if component != test.failed && result != "ok" {
+				t.Errorf("%s: %s failed too: %s", test.failed, component, result)
+			}
+		}
+
+		// The liveness probe doesn't depend on them
+		if w := serve(s.Handler(), "GET", "/status"); w.Code != 200 || w.Body.String() != "OK" {
+			t.Errorf("/status: %d %q", w.Code, w.Body.String())
+		}
+	}
+}
+
+func TestNoPixelLimit(t *testing.T) {
+	c := newMemoryCache()
+	s := NewServer(Config{}, c)
+	uri := testOrigin + "/a.png"
+	cacheOriginal(c, uri, "image/png", pngImage(t, 400, 200))
+
+	if w := serve(s.Handler(), "GET", "/resize/"+encodeURL(uri)+"/100/50"); w.Code != 200 {
+		t.Errorf("status = %d %q, want 200", w.Code, w.Body.String())
+	}
+}
+
+// A transport answering the requests with a function
+type roundTripFunc func(r *http.Request) (*http.Response, error)
+
+func (fn roundTripFunc) RoundTrip(r *http.Request) (*http.Response, error) {
+	return fn(r)
+}
+
+// Answer with a status and an empty body
+func respondWith(status int) roundTripFunc {
+	return func(r *http.Request) (*http.Response, error) {
+		return &http.Response{StatusCode: status, Header: http.Header{}, Body: http.NoBody, Request: r}, nil
+	}
+}
+
+func TestErrorStatus(t *testing.T) {
+	timeout := roundTripFunc(func(r *http.Request) (*http.Response, error) {
+		return nil, &net.DNSError{Err: "timeout", IsTimeout: true}
+	})
+
+	tests := []struct {
+		name      string
+		uri       string
+		transport http.RoundTripper
+		status    int
+	}{
+		{"not found", testOrigin + "/a.png", respondWith(404), 404},
+		{"server error", testOrigin + "/a.png", respondWith(500), 502},
+		{"timeout", testOrigin + "/a.png", timeout, 502},
+		{"forbidden host", "http://10.0.0.1/a.png", respondWith(200), 403},
+	}
+	for _, test := range tests {
+		s := NewServer(Config{MaxPixels: 1 << 20, HTTPClient: &http.Client{Transport: test.transport}}, newMemoryCache())
+		if w := serve(s.Handler(), "GET", "/resize/"+encodeURL(test.uri)+"/10/10"); w.Code != test.status {
+			t.Errorf("%s: status = %d, want %d", test.name, w.Code, test.status)
+		}
+	}
+}
+
+func TestDefaultAvatar(t *testing.T) {
+	c := newMemoryCache()
+	defaultImage := testOrigin + "/default.png"
+	cacheOriginal(c, defaultImage, "image/png", pngImage(t, 40, 40))
+	s := NewServer(Config{MaxPixels: 1 << 20, DefaultImage: defaultImage, HTTPClient: &http.Client{Transport: respondWith(404)}}, c)
+	path := "/" + encodeURL(testOrigin+"/missing.png") + "/10/10"
+
+	w := serve(s.Handler(), "GET", "/avatar"+path)
+	if w.Code != 200 {
+		t.Fatalf("status = %d, want 200", w.Code)
+	}
+	if cacheControl := w.Header().Get("Cache-Control"); cacheControl != "public, max-age=60" {
+		t.Errorf("Cache-Control = %s", cacheControl)
+	}
+	expected := serve(s.Handler(), "GET", "/resize/"+encodeURL(defaultImage)+"/10/10")
+	if !bytes.Equal(w.Body.Bytes(), expected.Body.Bytes()) {
+		t.Error("the default image was not served")
+	}
+
+	// Only for the avatars
+	if w := serve(s.Handler(), "GET", "/resize"+path); w.Code != 404 {
+		t.Errorf("/resize: status = %d, want 404", w.Code)
+	}
+}
+
+func TestAutoDimension(t *testing.T) {
+	c := newMemoryCache()
+	s := NewServer(Config{MaxWidth: 1000, MaxHeight: 1000, MaxPixels: 1 << 20}, c)
+	uri := testOrigin + "/a.png"
+	cacheOriginal(c, uri, "image/png", pngImage(t, 400, 200))
+
+	tests := []struct {
+		size          string
+		width, height int
+	}{
+		{"/100/auto", 100, 50},
+		{"/100/0", 100, 50},
+		{"/auto/50", 100, 50},
+		{"/0/20", 40, 20},
+		{"/100/100", 100, 50},
+	}
+	for _, test := range tests {
+		w := serve(s.Handler(), "GET", "/resize/"+encodeURL(uri)+test.size)
+		if w.Code != 200 {
+			t.Errorf("%s: status = %d", test.size, w.Code)
+			continue
+		}
+		if m := decodeImage(t, w.Body.Bytes(), "png"); m.Bounds().Dx() != test.width || m.Bounds().Dy() != test.height {
+			t.Errorf("%s: size = %v, want %dx%d", test.size, m.Bounds(), test.width, test.height)
+		}
+	}
+}
+
+// Answer with an image and a Cache-Control header
+func respondWithImage(body []byte, cacheControl string) roundTripFunc {
+	return func(r *http.Request) (*http.Response, error) {
+		header := http.Header{"Content-Type": {"image/png"}}
+		if cacheControl != "" {
+			header.Set("Cache-Control", cacheControl)
+		}
+		return &http.Response{StatusCode: 200, Header: header, Body: io.NopCloser(bytes.NewReader(body)), Request: r}, nil
+	}
+}
+
+func TestCacheControl(t *testing.T) {
+	png := pngImage(t, 40, 20)
+	tests := []struct {
+		name     string
+		config   Config
+		upstream string
+		want     string
+	}{
+		{"default", Config{}, "", "public, max-age=600"},
+		{"overridden", Config{MaxAge: 3600}, "", "public, max-age=3600"},
+		{"resized overridden", Config{MaxAge: 3600, ResizeMaxAge: 120}, "", "public, max-age=120"},
+		{"upstream shorter", Config{}, "public, max-age=30", "public, max-age=30"},
+		{"upstream longer", Config{}, "max-age=86400", "public, max-age=600"},
+	}
+	for _, test := range tests {
+		test.config.HTTPClient = &http.Client{Transport: respondWithImage(png, test.upstream)}
+		s := NewServer(test.config, newMemoryCache())
+		w := serve(s.Handler(), "GET", "/resize/"+encodeURL(testOrigin+"/a.png")+"/10/10")
+		if cacheControl := w.Header().Get("Cache-Control"); w.Code != 200 || cacheControl != test.want {
+			t.Errorf("%s: status = %d, Cache-Control = %q, want %q", test.name, w.Code, cacheControl, test.want)
+		}
+	}
+}
+
+func TestDPR(t *testing.T) {
+	c := newMemoryCache()
+	s := NewServer(Config{MaxWidth: 1000, MaxHeight: 1000, MaxPixels: 1 << 20}, c)
+	uri := testOrigin + "/a.png"
+	cacheOriginal(c, uri, "image/png", pngImage(t, 800, 400))
+	path := "/resize/" + encodeURL(uri) + "/100/50"
+
+	one := serve(s.Handler(), "GET", path)
+	two := serve(s.Handler(), "GET", path+"?dpr=2")
+	if one.Code != 200 || two.Code != 200 {
+		t.Fatalf("status = %d and %d", one.Code, two.Code)
+	}
+	if m := decodeImage(t, one.Body.Bytes(), "png"); m.Bounds().Dx() != 100 || m.Bounds().Dy() != 50 {
+		t.Errorf("dpr=1: size = %v, want 100x50", m.Bounds())
+	}
+	if m := decodeImage(t, two.Body.Bytes(), "png"); m.Bounds().Dx() != 200 || m.Bounds().Dy() != 100 {
+		t.Errorf("dpr=2: size = %v, want 200x100", m.Bounds())
+	}
+
+	// The limits apply to the resized image
+	if w := serve(s.Handler(), "GET", "/resize/"+encodeURL(uri)+"/400/200?dpr=3"); w.Code != 400 {
+		t.Errorf("dpr=3 over the max width: status = %d, want 400", w.Code)
+	}
+}
+
+func TestPost(t *testing.T) {
+	c := newMemoryCache()
+	s := NewServer(Config{MaxPixels: 1 << 20}, c)
+
+	r := httptest.NewRequest("POST", "/resize/40/40", bytes.NewReader(pngImage(t, 80, 40)))
+	w := httptest.NewRecorder()
+	s.Handler().ServeHTTP(w, r)
+	if w.Code != 200 || w.Header().Get("Content-Type") != "image/png" {
+		t.Fatalf("status = %d, Content-Type = %s", w.Code, w.Header().Get("Content-Type"))
+	}
+	if m := decodeImage(t, w.Body.Bytes(), "png"); m.Bounds().Dx() != 40 || m.Bounds().Dy() != 20 {
+		t.Errorf("size = %v, want 40x20", m.Bounds())
+	}
+	if len(c.images) != 0 {
+		t.Errorf("%d images cached", len(c.images))
+	}
+
+	r = httptest.NewRequest("POST", "/resize/40/40", strings.NewReader("not an image"))
+	w = httptest.NewRecorder()
+	s.Handler().ServeHTTP(w, r)
+	if w.Code != 400 {
+		t.Errorf("invalid image: status = %d, want 400", w.Code)
+	}
+}
+
+func TestAVIF(t *testing.T) {
+	c := newMemoryCache()
+	s := NewServer(Config{MaxPixels: 1 << 20}, c)
+	uri := testOrigin + "/a.jpg"
+	cacheOriginal(c, uri, "image/jpeg", jpegImage(t, 80, 40))
+
+	w := serve(s.Handler(), "GET", "/resize/"+encodeURL(uri)+"/40/40", "Accept: image/avif,image/webp,*/*")
+	if w.Code != 200 {
+		t.Fatalf("status = %d", w.Code)
+	}
+	if contentType := w.Header().Get("Content-Type"); contentType != "image/avif" {
+		t.Skipf("AVIF encoder unavailable, fell back to %s", contentType)
+	}
+	if body := w.Body.Bytes(); len(body) < 12 || string(body[4:12]) != "ftypavif" {
+		t.Errorf("invalid AVIF signature: %q", body[:12])
+	}
+	if vary := w.Header().Get("Vary"); !strings.Contains(vary, "Accept") {
+		t.Errorf("Vary = %q", vary)
+	}
+}
+
+func TestInfo(t *testing.T) {
+	c := newMemoryCache()
+	s := NewServer(Config{}, c)
+	png := pngImage(t, 80, 40)
+	cacheOriginal(c, testOrigin+"/a.png", "image/png", png)
+	sideways := withOrientation(jpegImage(t, 80, 40), 6)
+	cacheOriginal(c, testOrigin+"/sideways.jpg", "image/jpeg", sideways)
+
+	tests := []struct {
+		uri  string
+		want imageInfo
+	}{
+		{testOrigin + "/a.png", imageInfo{80, 40, "png", len(png)}},
+		// Once upright
+		{testOrigin + "/sideways.jpg", imageInfo{40, 80, "jpeg", len(sideways)}},
+	}
+	for _, test := range tests {
+		w := serve(s.Handler(), "GET", "/info/"+encodeURL(test.uri))
+		var info imageInfo
+		decodeJSON(t, w, &info)
+		if w.Code != 200 || info != test.want {
+			t.Errorf("%s: status = %d, info = %+v, want %+v", test.uri, w.Code, info, test.want)
+		}
+	}
+}
+
+func TestValidate(t *testing.T) {
+	png := pngImage(t, 80, 40)
+	var requests int32
+	upstream := roundTripFunc(func(r *http.Request) (*http.Response, error) {
+		atomic.AddInt32(&requests, 1)
+		contentType, body := "image/png", png
+		switch r.URL.Path {
+		case "/unreachable.png":
+			return nil, &net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")}
+		case "/page.html":
+			contentType, body = "text/html", []byte("<html></html>")
+		case "/truncated.png":
+			body = png[:len(png)/2]
+		}
+		return &http.Response{StatusCode: 200, Header: http.Header{"Content-Type": {contentType}}, Body: io.NopCloser(bytes.NewReader(body)), Request: r}, nil
+	})
+	s := NewServer(Config{HTTPClient: &http.Client{Transport: upstream}}, newMemoryCache())
+
+	w := serve(s.Handler(), "GET", "/validate/"+encodeURL(testOrigin+"/a.png"))
+	var info imageInfo
+	decodeJSON(t, w, &info)
+	if w.Code != 200 || info.Width != 80 || info.Height != 40 || info.Format != "png" {
+		t.Errorf("valid image: status = %d, info = %+v", w.Code, info)
+	}
+
+	for _, path := range []string{"/page.html", "/unreachable.png", "/truncated.png"} {
+		if w := serve(s.Handler(), "GET", "/validate/"+encodeURL(testOrigin+path)); w.Code != 502 {
+			t.Errorf("%s: status = %d, want 502", path, w.Code)
+		}
+	}
+
+	// The errors are cached
+	s.WaitForSaves(context.Background())
+	before := atomic.LoadInt32(&requests)
+	for _, path := range []string{"/page.html", "/truncated.png"} {
+		if w := serve(s.Handler(), "GET", "/validate/"+encodeURL(testOrigin+path)); w.Code != 502 {
+			t.Errorf("%s again: status = %d, want 502", path, w.Code)
+		}
+	}
+	if n := atomic.LoadInt32(&requests) - before; n != 0 {
+		t.Errorf("%d fetches of the URLs in error", n)
+	}
+}
+
+func TestValidateIsLimited(t *testing.T) {
+	c := newMemoryCache()
+	s := NewServer(Config{MaxSourcePixels: 1 << 20, MaxConcurrentResizes: 1, ResizeQueueTimeout: 10 * time.Millisecond}, c)
+	uri := testOrigin + "/a.png"
+	cacheOriginal(c, uri, "image/png", pngImage(t, 80, 40))
+	bomb := testOrigin + "/bomb.png"
+	cacheOriginal(c, bomb, "image/png", declaredPNG(t, 50000, 50000))
+
+	// Without a slot for the decode
+	if err := s.acquireResize(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if w := serve(s.Handler(), "GET", "/validate/"+encodeURL(uri)); w.Code != 503 {
+		t.Errorf("while resizing: status = %d, want 503", w.Code)
+	}
+	if w := serve(s.Handler(), "GET", "/info/"+encodeURL(uri)); w.Code != 200 {
+		t.Errorf("infos from the header while resizing: status = %d, want 200", w.Code)
+	}
+	s.releaseResize()
+	if w := serve(s.Handler(), "GET", "/validate/"+encodeURL(uri)); w.Code != 200 {
+		t.Errorf("status = %d once the slot is free, want 200", w.Code)
+	}
+
+	// Nor decoding the images too large
+	if w := serve(s.Handler(), "GET", "/validate/"+encodeURL(bomb)); w.Code != errorStatus(errImageTooLarge) {
+		t.Errorf("image too large: status = %d, want %d", w.Code, errorStatus(errImageTooLarge))
+	}
+	s.WaitForSaves(context.Background())
+	if err, _ := c.cachedError(bomb); err != errImageTooLarge {
+		t.Errorf("cached error = %v, want %v", err, errImageTooLarge)
+	}
+}
+
+func TestScale(t *testing.T) {
+	c := newMemoryCache()
+	s := NewServer(Config{MaxPixels: 100000}, c)
+	uri := testOrigin + "/a.png"
+	cacheOriginal(c, uri, "image/png", pngImage(t, 400, 200))
+	path := "/resize/" + encodeURL(uri) + "/0/0?scale="
+
+	// The percents are escaped in the query
+	for _, scale := range []string{"0.5", "50%25"} {
+		w := serve(s.Handler(), "GET", path+scale)
+		if w.Code != 200 {
+			t.Errorf("scale=%s: status = %d", scale, w.Code)
+			continue
+		}
+		if m := decodeImage(t, w.Body.Bytes(), "png"); m.Bounds().Dx() != 200 || m.Bounds().Dy() != 100 {
+			t.Errorf("scale=%s: size = %v, want 200x100", scale, m.Bounds())
+		}
+	}
+
+	// 800x400 exceeds the max pixels
+	for _, scale := range []string{"2", "200%25"} {
+		if w := serve(s.Handler(), "GET", path+scale); w.Code != 400 {
+			t.Errorf("scale=%s: status = %d, want 400", scale, w.Code)
+		}
+	}
+
+	// A number without a suffix is always a ratio
+	s = NewServer(Config{MaxPixels: 1 << 22}, c)
+	tests := []struct {
+		scale  string
+		status int
+		width  int
+	}{
+		{"1", 200, 400},
+		{"1.5", 200, 600},
+		{"4", 200, 1600},
+		{"4.01", 400, 0},
+		{"50", 400, 0},
+		{"100", 400, 0},
+		{"100%25", 200, 400},
+		{"400%25", 200, 1600},
+		{"401%25", 400, 0},
+		{"0", 400, 0},
+		{"0%25", 400, 0},
+		{"%25", 400, 0},
+	}
+	for _, test := range tests {
+		w := serve(s.Handler(), "GET", path+test.scale)
+		if w.Code != test.status {
+			t.Errorf("scale=%s: status = %d, want %d", test.scale, w.Code, test.status)
+			continue
+		}
+		if test.status == 200 {
+			if m := decodeImage(t, w.Body.Bytes(), "png"); m.Bounds().Dx() != test.width {
+				t.Errorf("scale=%s: width = %d, want %d", test.scale, m.Bounds().Dx(), test.width)
+			}
+		}
+	}
+}
@@ -0,0 +1,226 @@
+package resize
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"github.com/fzzy/radix/redis"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// The logs of the tests are discarded
+func TestMain(m *testing.M) {
+	slog.SetDefault(slog.New(slog.NewTextHandler(io.Discard, nil)))
+	os.Exit(m.Run())
+}
+
+// A cache keeping everything in memory, for the tests not about the cache
+type memoryCache struct {
+	mu     sync.Mutex
+	images map[string]memoryEntry
+	errors map[string]error
+	ttls   map[string]int // the TTLs of the errors
+}
+
+type memoryEntry struct {
+	headers Headers
+	body    []byte
+}
+
+func newMemoryCache() *memoryCache {
+	return &memoryCache{images: map[string]memoryEntry{}, errors: map[string]error{}, ttls: map[string]int{}}
+}
+
+func (c *memoryCache) Get(key string) (Headers, []byte, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry, ok := c.images[key]
+	return entry.headers, entry.body, ok
+}
+
+func (c *memoryCache) Set(key string, headers Headers, body []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	headers.CacheStatus = ""
+	c.images[key] = memoryEntry{headers, body}
+}
+
+func (c *memoryCache) GetError(uri string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.errors[uri]
+}
+
+func (c *memoryCache) SetError(uri string, err error, ttl int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.errors[uri] = err
+	c.ttls[uri] = ttl
+}
+
+// Return the error cached for an URL and its TTL
+func (c *memoryCache) cachedError(uri string) (error, int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.errors[uri], c.ttls[uri]
+}
+
+// Connect to the redis of the tests, at $REDIS_ADDR or on localhost, or
+// skip the test if there is none
+func newTestRedis(t *testing.T) *RedisConn {
+	t.Helper()
+	address := os.Getenv("REDIS_ADDR")
+	if address == "" {
+		address = "127.0.0.1:6379"
+	}
+	connection := NewRedisConn(redis.Config{Network: "tcp", Address: address, Timeout: time.Second})
+	if err := connection.Call("PING").Err; err != nil {
+		t.Skipf("redis unavailable at %s: %s", address, err)
+	}
+	t.Cleanup(connection.Close)
+	return connection
+}
+
+// Return a prefix of the keys in redis of its own for a test
+func testPrefix(t *testing.T) string {
+	return fmt.Sprintf("goresize-test/%s/%d/", t.Name(), time.Now().UnixNano())
+}
+
+// Create a disk cache in a temporary directory, with its keys in redis
+// under a prefix of its own
+func newTestDiskCache(t *testing.T) *DiskCache {
+	t.Helper()
+	return NewDiskCache(t.TempDir(), newTestRedis(t), testPrefix(t))
+}
+
+// Create a server able to fetch the images of the test servers, which
+// listen on a loopback address
+func newTestServer(config Config, cache Cache) *Server {
+	s := NewServer(config, cache)
+	if config.HTTPClient == nil {
+		s.httpClient.Transport.(*http.Transport).DialContext = (&net.Dialer{}).DialContext
+	}
+	return s
+}
+
+// Start a distant server answering every request with body, without
+// Content-Type if it is empty, and count the requests it received
+func newUpstream(t *testing.T, contentType string, body []byte) (*httptest.Server, *int32) {
+	t.Helper()
+	var mu sync.Mutex
+	count := new(int32)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		*count++
+		mu.Unlock()
+		if contentType == "" {
+			// Not even sniffed by the test server
+			w.Header()["Content-Type"] = nil
+		} else {
+			w.Header().Set("Content-Type", contentType)
+		}
+		w.Write(body)
+	}))
+	t.Cleanup(ts.Close)
+	return ts, count
+}
+
+// Create an image with a gradient, so that it doesn't compress to nothing
+func gradient(width, height int) *image.NRGBA {
+	m := image.NewNRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			m.SetNRGBA(x, y, color.NRGBA{uint8(x * 255 / width), uint8(y * 255 / height), 128, 255})
+		}
+	}
+	return m
+}
+
+// Encode a gradient in PNG
+func pngImage(t *testing.T, width, height int) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, gradient(width, height)); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// Encode a gradient in JPEG
+func jpegImage(t *testing.T, width, height int) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, gradient(width, height), nil); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// Decode an image, failing the test if it isn't in the expected format
+func decodeImage(t *testing.T, body []byte, format string) image.Image {
+	t.Helper()
+	m, actual, err := image.Decode(bytes.NewReader(body))
+	if err != nil {
+		t.Fatalf("invalid image: %s", err)
+	}
+	if actual != format {
+		t.Fatalf("format = %s, want %s", actual, format)
+	}
+	return m
+}
+
+// Hex-encode an URL for the paths of the requests
+func encodeURL(uri string) string {
+	return hex.EncodeToString([]byte(uri))
+}
+
+// Send a request to a handler, with headers as "Name: value" strings
+func serve(h http.Handler, method, path string, headers ...string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, path, nil)
+	for _, header := range headers {
+		name, value, _ := strings.Cut(header, ": ")
+		r.Header.Set(name, value)
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	return w
+}
+
+// The handler tests serve the images of a public address, cached as if they
+// had just been fetched from it
+const testOrigin = "http://93.184.216.34"
+
+// The Last-Modified of the originals cached by the tests
+const testLastModified = "Mon, 01 Jan 2024 00:00:00 GMT"
+
+// Cache an original as if it had just been fetched
+func cacheOriginal(c Cache, uri, contentType string, body []byte) {
+	c.Set(cacheKey(uri, "orig"), Headers{ContentType: contentType, LastModified: testLastModified, FetchedAt: time.Now()}, body)
+}
+
+// Insert an EXIF segment with an orientation after the start of a JPEG
+func withOrientation(body []byte, orientation int) []byte {
+	tiff := []byte{
+		'I', 'I', 0x2a, 0, 8, 0, 0, 0, // little endian, first IFD at 8
+		1, 0, // one entry
+		0x12, 0x01, 3, 0, 1, 0, 0, 0, byte(orientation), 0, 0, 0, // orientation, 1 short
+		0, 0, 0, 0, // no next IFD
+	}
+	payload := append([]byte("Exif\x00\x00"), tiff...)
+	segment := []byte{0xff, 0xe1, byte((len(payload) + 2) >> 8), byte(len(payload) + 2)}
+	segment = append(segment, payload...)
+	return append(append(append([]byte{}, body[:2]...), segment...), body[2:]...)
+}
@@ -0,0 +1,227 @@
+package resize
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"image"
+	"image/color"
+	"image/png"
+	"io"
+	"strings"
+)
+
+// The error returned for the ICO files we can't decode
+var errInvalidICO = errors.New("Invalid ICO")
+
+// An image of an ICO file
+type icoEntry struct {
+	width, height int
+	data          []byte // a PNG file, or a bitmap without its file header
+}
+
+func init() {
+	image.RegisterFormat("ico", "\x00\x00\x01\x00", decodeICO, decodeICOConfig)
+}
+
+// Decode the largest image of an ICO file
+func decodeICO(r io.Reader) (image.Image, error) {
+	entries, err := readICO(r)
+	if err != nil {
+		return nil, err
+	}
+	return decodeICOEntry(entries[len(entries)-1])
+}
+
+// Decode the size of the largest image of an ICO file
+func decodeICOConfig(r io.Reader) (image.Config, error) {
+	entries, err := readICO(r)
+	if err != nil {
+		return image.Config{}, err
+	}
+	largest := entries[len(entries)-1]
+	// The size in the directory of the file may not be the one of a PNG file
+	if isPNG(largest.data) {
+		return png.DecodeConfig(bytes.NewReader(largest.data))
+	}
+	return image.Config{ColorModel: color.NRGBAModel, Width: largest.width, Height: largest.height}, nil
+}
+
+// Decode the image of an ICO file best suited to be resized to width x
+// height: the smallest one at least as large, or the largest one. A PNG file
+// is checked and decoded like the other originals.
+func (s *Server) decodeICOForSize(ctx context.Context, body string, width, height int) (image.Image, error) {
+	entries, err := readICO(strings.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	entry := entries[len(entries)-1]
+	for _, e := range entries {
+		if e.width >= width && e.height >= height {
+			entry = e
+			break
+		}
+	}
+	if !isPNG(entry.data) {
+		return decodeICOBitmap(entry.data)
+	}
+
+	config, err := png.DecodeConfig(bytes.NewReader(entry.data))
+	if err != nil {
+		return nil, err
+	}
+	if err = s.checkSourcePixels(config); err != nil {
+		logger(ctx).Warn("Icon too large", "width", config.Width, "height", config.Height)
+		return nil, err
+	}
+	m, _, err := s.decode(ctx, string(entry.data))
+	return m, err
+}
+
+// Read the images of an ICO file, from the smallest to the largest
+func readICO(r io.Reader) ([]icoEntry, error) {
+	data, err := readBody(r, maxSize+1)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < 6 || binary.LittleEndian.Uint16(data[2:]) != 1 {
+		return nil, errInvalidICO
+	}
+
+	count := int(binary.LittleEndian.Uint16(data[4:]))
+	if count == 0 || len(data) < 6+16*count {
+		return nil, errInvalidICO
+	}
+
+	var entries []icoEntry
+	for i := 0; i < count; i++ {
+		dir := data[6+16*i:]
+		// The sizes of 256 pixels are stored as 0
+		width, height := int(dir[0]), int(dir[1])
+		if width == 0 {
+			width = 256
+		}
+		if height == 0 {
+			height = 256
+		}
+		size := int(binary.LittleEndian.Uint32(dir[8:]))
+		offset := int(binary.LittleEndian.Uint32(dir[12:]))
+		if offset < 0 || size < 0 || offset+size > len(data) || offset+size < offset {
+			return nil, errInvalidICO
+		}
+		entry := icoEntry{width: width, height: height, data: data[offset : offset+size]}
+
+		// Sorted by area, as most files list the largest images first
+		j := len(entries)
+		for j > 0 && entries[j-1].width*entries[j-1].height > width*height {
+			j--
+		}
+		entries = append(entries[:j], append([]icoEntry{entry}, entries[j:]...)...)
+	}
+	return entries, nil
+}
+
+// Decode an image of an ICO file, either a PNG file or a bitmap
+func decodeICOEntry(entry icoEntry) (image.Image, error) {
+	if isPNG(entry.data) {
+		return png.Decode(bytes.NewReader(entry.data))
+	}
+	return decodeICOBitmap(entry.data)
+}
+
+// Check if an image of an ICO file is a PNG file
+func isPNG(data []byte) bool {
+	return bytes.HasPrefix(data, []byte("\x89PNG\r\n\x1a\n"))
+}
+
+// Decode an uncompressed bitmap of an ICO file: its rows are stored bottom
+// up, followed by a 1 bit mask of the transparent pixels
+func decodeICOBitmap(data []byte) (image.Image, error) {
+	if len(data) < 40 || binary.LittleEndian.Uint32(data) < 40 {
+		return nil, errInvalidICO
+	}
+	width := int(int32(binary.LittleEndian.Uint32(data[4:])))
+	// The height covers both the pixels and the mask
+	height := int(int32(binary.LittleEndian.Uint32(data[8:]))) / 2
+	bpp := int(binary.LittleEndian.Uint16(data[14:]))
+	compression := binary.LittleEndian.Uint32(data[16:])
+	colors := int(binary.LittleEndian.Uint32(data[32:]))
+	if width <= 0 || height <= 0 || width > 256 || height > 256 || compression != 0 {
+		return nil, errInvalidICO
+	}
+
+	pos := int(binary.LittleEndian.Uint32(data))
+	var palette []color.NRGBA
+	switch bpp {
+	case 1, 4, 8:
+		if colors == 0 || colors > 1<<uint(bpp) {
+			colors = 1 << uint(bpp)
+		}
+		if pos+4*colors > len(data) {
+			return nil, errInvalidICO
+		}
+		for i := 0; i < colors; i++ {
+			c := data[pos+4*i:]
+			palette = append(palette, color.NRGBA{c[2], c[1], c[0], 255})
+		}
+		pos += 4 * colors
+	case 24, 32:
+	default:
+		return nil, errInvalidICO
+	}
+
+	// The rows are padded to 4 bytes
+	stride := (width*bpp + 31) / 32 * 4
+	maskStride := (width + 31) / 32 * 4
+	if pos+stride*height > len(data) {
+		return nil, errInvalidICO
+	}
+	pixels := data[pos : pos+stride*height]
+	var mask []byte
+	if end := pos + stride*height + maskStride*height; end <= len(data) {
+		mask = data[pos+stride*height : end]
+	}
+
+	m := image.NewNRGBA(image.Rect(0, 0, width, height))
+	hasAlpha := false
+	for y := 0; y < height; y++ {
+		row := pixels[(height-1-y)*stride:]
+		for x := 0; x < width; x++ {
+			var c color.NRGBA
+			switch bpp {
+			case 32:
+				c = color.NRGBA{row[4*x+2], row[4*x+1], row[4*x], row[4*x+3]}
+				hasAlpha = hasAlpha || c.A != 0
+			case 24:
+				c = color.NRGBA{row[3*x+2], row[3*x+1], row[3*x], 255}
+			default:
+				bit := x * bpp
+				index := int(row[bit/8]>>uint(8-bpp-bit%8)) & (1<<uint(bpp) - 1)
+				if index < len(palette) {
+					c = palette[index]
+				}
+			}
+			m.SetNRGBA(x, y, c)
+		}
+	}
+
+	// The mask is only used for the bitmaps without alpha
+	if bpp == 32 && !hasAlpha {
+		for i := 3; i < len(m.Pix); i += 4 {
+			m.Pix[i] = 255
+		}
+	}
+	if mask != nil && (bpp != 32 || !hasAlpha) {
+		for y := 0; y < height; y++ {
+			row := mask[(height-1-y)*maskStride:]
+			for x := 0; x < width; x++ {
+				if row[x/8]&(0x80>>uint(x%8)) != 0 {
+					m.SetNRGBA(x, y, color.NRGBA{})
+				}
+			}
+		}
+	}
+
+	return m, nil
+}
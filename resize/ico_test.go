@@ -0,0 +1,99 @@
+package resize
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"testing"
+	"time"
+)
+
+// Encode an ICO file of images
+func icoFile(entries ...icoEntry) []byte {
+	var header, data bytes.Buffer
+	binary.Write(&header, binary.LittleEndian, []uint16{0, 1, uint16(len(entries))})
+	offset := 6 + 16*len(entries)
+	for _, entry := range entries {
+		// The sizes of 256 pixels are stored as 0
+		header.Write([]byte{byte(entry.width), byte(entry.height), 0, 0})
+		binary.Write(&header, binary.LittleEndian, []uint16{1, 32})
+		binary.Write(&header, binary.LittleEndian, []uint32{uint32(len(entry.data)), uint32(offset + data.Len())})
+		data.Write(entry.data)
+	}
+	return append(header.Bytes(), data.Bytes()...)
+}
+
+// Encode an image of an ICO file in PNG
+func pngEntry(t *testing.T, m image.Image) icoEntry {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, m); err != nil {
+		t.Fatal(err)
+	}
+	return icoEntry{m.Bounds().Dx(), m.Bounds().Dy(), buf.Bytes()}
+}
+
+// A square of a single color
+func square(size int, c color.Color) image.Image {
+	m := image.NewNRGBA(image.Rect(0, 0, size, size))
+	draw.Draw(m, m.Bounds(), image.NewUniform(c), image.Point{}, draw.Src)
+	return m
+}
+
+func TestResizeICO(t *testing.T) {
+	red, green, blue := color.NRGBA{255, 0, 0, 255}, color.NRGBA{0, 255, 0, 255}, color.NRGBA{0, 0, 255, 255}
+	// Listed from the largest, like most files
+	ico := icoFile(pngEntry(t, square(64, blue)), pngEntry(t, square(16, red)), pngEntry(t, square(32, green)))
+	s := newTestServer(Config{MaxPixels: 1 << 20}, newMemoryCache())
+
+	tests := []struct {
+		size  int
+		color color.NRGBA
+	}{
+		{12, red},
+		{24, green},
+		{48, blue},
+	}
+	for _, test := range tests {
+		_, body := resizeFrom(t, s, "image/x-icon", ico, ResizeOptions{Width: test.size, Height: test.size, Quality: defaultQuality})
+		m := decodeImage(t, body, "png")
+		if m.Bounds().Dx() != test.size || m.Bounds().Dy() != test.size {
+			t.Errorf("%d: size = %v", test.size, m.Bounds())
+		}
+		if c := color.NRGBAModel.Convert(m.At(test.size/2, test.size/2)); c != test.color {
+			t.Errorf("%d: color = %v, want the one of the icon %v", test.size, c, test.color)
+		}
+	}
+}
+
+func TestICOWithLargePNG(t *testing.T) {
+	// The directory of the file lies about the size of the PNG file of the
+	// smallest image, the one resized
+	ico := icoFile(icoEntry{16, 16, declaredPNG(t, 30000, 30000)}, pngEntry(t, gradient(64, 64)))
+	c := newMemoryCache()
+	s := newTestServer(Config{MaxPixels: 1 << 20, MaxSourcePixels: 1000000, SyncCache: true}, c)
+	ts, _ := newUpstream(t, "image/x-icon", ico)
+
+	_, _, err := s.FetchResized(context.Background(), ts.URL, ResizeOptions{Width: 10, Height: 10, Quality: defaultQuality})
+	if err != errImageTooLarge {
+		t.Fatalf("err = %v, want %v", err, errImageTooLarge)
+	}
+	if err := c.GetError(ts.URL); errorStatus(err) != errorStatus(errImageTooLarge) {
+		t.Errorf("cached error = %v, want %v", err, errImageTooLarge)
+	}
+}
+
+func TestICODecodeTimeout(t *testing.T) {
+	ico := icoFile(pngEntry(t, gradient(1000, 1000)))
+	s := newTestServer(Config{MaxPixels: 1 << 20, DecodeTimeout: time.Nanosecond}, newMemoryCache())
+	ts, _ := newUpstream(t, "image/x-icon", ico)
+
+	_, _, err := s.FetchResized(context.Background(), ts.URL, ResizeOptions{Width: 10, Height: 10, Quality: defaultQuality})
+	if err != errDecodeTimeout {
+		t.Errorf("err = %v, want %v", err, errDecodeTimeout)
+	}
+}
@@ -0,0 +1,683 @@
+package resize
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	// Also register the decoders of WebP and AVIF images
+	"github.com/chai2010/webp"
+	"github.com/gen2brain/avif"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"math"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// The options of a resize
+type ResizeOptions struct {
+	Width   int // 0 to derive it from the height and the aspect ratio
+	Height  int // 0 to derive it from the width and the aspect ratio
+	Quality int
+	DPR     int     // the ratio of the pixels to the width and height, 1 to 3
+	Format  string  // the output format, or empty to keep the original one
+	Mode    string  // "fit" within the box, "fill" it and crop, or "pad" it around the fitted image
+	Gravity string  // the anchor of the crop in fill mode
+	Filter  string  // the resampling filter: nearest, bilinear or lanczos
+	Palette int     // the maximal number of colors of PNG output, or 0
+	Upscale bool    // enlarge the images smaller than the box in fit mode
+	Scale   float64 // the ratio of the size of the image to keep, instead of the box, or 0
+	Sharpen int     // the amount of sharpening after a resize, in percents, or 0
+	Trim    bool    // remove the uniform border of the image before resizing
+
+	// Encode the JPEG images as progressive ones
+	Progressive bool
+
+	// Keep the metadata of the images served without re-encoding
+	KeepMetadata bool
+
+	// The output format depends on the Accept header of the request
+	Negotiated bool
+
+	// The effects applied after resizing
+	Blur       int // the radius of the gaussian blur in pixels, or 0
+	Grayscale  bool
+	Background string // the hex color transparent images are flattened on
+
+	// The position of the watermark, or empty for none, and its opacity
+	// in percents
+	Watermark        string
+	WatermarkOpacity int
+}
+
+// The speed of the AVIF encoder, from 0 (slowest, smallest files) to 10
+const avifSpeed = 8
+
+// The gravities accepted for the crop in fill mode
+var gravities = map[string]bool{
+	"center": true,
+	"north":  true,
+	"south":  true,
+	"east":   true,
+	"west":   true,
+	"smart":  true, // the area with the most details
+}
+
+// Generate the cache variation for these options
+func (opts ResizeOptions) variation() string {
+	variation := fmt.Sprintf("resize/%d/%d/q%d", opts.Width, opts.Height, opts.Quality)
+	if opts.Mode == "fill" {
+		variation += "/fill/" + opts.Gravity
+	} else if opts.Mode == "pad" {
+		variation += "/pad"
+	}
+	if opts.Filter != "" && opts.Filter != "nearest" {
+		variation += "/" + opts.Filter
+	}
+	if opts.Palette > 0 {
+		variation += fmt.Sprintf("/p%d", opts.Palette)
+	}
+	if opts.DPR > 1 {
+		variation += fmt.Sprintf("/dpr%d", opts.DPR)
+	}
+	if opts.Upscale {
+		variation += "/up"
+	}
+	if opts.Scale > 0 {
+		variation += fmt.Sprintf("/scale%g", opts.Scale)
+	}
+	if opts.Sharpen > 0 {
+		variation += fmt.Sprintf("/sharpen%d", opts.Sharpen)
+	}
+	if opts.Trim {
+		variation += "/trim"
+	}
+	if opts.Progressive {
+		variation += "/progressive"
+	}
+	if opts.KeepMetadata {
+		variation += "/meta"
+	}
+	if opts.Blur > 0 {
+		variation += fmt.Sprintf("/blur%d", opts.Blur)
+	}
+	if opts.Grayscale {
+		variation += "/gray"
+	}
+	if opts.Background != "" {
+		variation += "/bg" + opts.Background
+	}
+	if opts.Watermark != "" {
+		variation += fmt.Sprintf("/wm-%s-%d", opts.Watermark, opts.WatermarkOpacity)
+	}
+	if opts.Format != "" {
+		variation += "/" + opts.Format
+	}
+	return variation
+}
+
+// Fetch a resized variation of an image, from cache if available
+func (s *Server) FetchResized(ctx context.Context, uri string, opts ResizeOptions) (headers Headers, body []byte, err error) {
+
+	variation := opts.variation()
+
+	type result struct {
+		headers Headers
+		body    []byte
+	}
+
+	// Only one of the concurrent requests for a variation fetches and
+	// resizes it, the others wait for its result
+	for {
+		ch := s.resizeGroup.DoChan(cacheKey(uri, variation), func() (interface{}, error) {
+			headers, body, err := s.fetchAndResizeImage(ctx, uri, variation, opts)
+			return result{headers, body}, err
+		})
+
+		select {
+		case <-ctx.Done():
+			return headers, nil, ctx.Err()
+		case r := <-ch:
+			// The request doing the work may have been cancelled, but not this one
+			if r.Err != nil && errors.Is(r.Err, context.Canceled) && ctx.Err() == nil {
+				continue
+			}
+
+			res := r.Val.(result)
+			headers = res.headers
+			headers.CacheControl = s.cacheControl(headers.CacheControl, s.config.ResizeMaxAge)
+
+			return headers, res.body, r.Err
+		}
+	}
+}
+
+// Fetch a variation from cache if available, or resize the original image
+func (s *Server) fetchAndResizeImage(ctx context.Context, uri, variation string, opts ResizeOptions) (headers Headers, body []byte, err error) {
+	headers, body, ok := s.fetchImageFromCache(uri, variation)
+
+	if ok {
+		s.revalidateVariations(ctx, uri)
+		return
+	}
+
+	headers, body, err = s.fetchImage(ctx, uri)
+	if err != nil {
+		return
+	}
+
+	headers, body, err = s.resizeImage(ctx, uri, string(body), headers, opts)
+	if err == errImageTooLarge {
+		s.saveErrorInCache(uri, err, errorTTL)
+	} else if err == errDecodeTimeout {
+		s.saveErrorInCache(uri, err, transientErrorTTL)
+	}
+	if err != nil {
+		return
+	}
+
+	// Resized again once the original is revalidated, rather than cached with
+	// the short max-age of the stale one. Nor is the fallback cached in place
+	// of the requested format.
+	if headers.CacheStatus != "STALE" && !headers.Fallback {
+		s.saveImageInCache(uri, variation, headers, body)
+	}
+
+	// The resized image is new, even if the original was cached
+	if headers.CacheStatus == "HIT" {
+		headers.CacheStatus = "MISS"
+	}
+
+	return
+}
+
+// Compute the area of the source image to keep and the size to resample it
+// to. ok is false when the image already fits and needs no resize.
+func (opts ResizeOptions) geometry(bounds image.Rectangle) (crop image.Rectangle, width, height int, ok bool) {
+	width, height = opts.Width, opts.Height
+	if opts.DPR > 1 {
+		width, height = width*opts.DPR, height*opts.DPR
+	}
+	origWidth, origHeight := bounds.Dx(), bounds.Dy()
+
+	if opts.Scale > 0 {
+		scale := opts.Scale * math.Max(1, float64(opts.DPR))
+		width = int(math.Max(1, math.Round(float64(origWidth)*scale)))
+		height = int(math.Max(1, math.Round(float64(origHeight)*scale)))
+		return bounds, width, height, width != origWidth || height != origHeight
+	}
+
+	// Derive the missing dimension from the aspect ratio of the image.
+	// There is nothing to crop in fill mode in this case.
+	if width == 0 || height == 0 {
+		if origWidth == 0 || origHeight == 0 || (!opts.Upscale && (width >= origWidth || height >= origHeight)) {
+			return bounds, origWidth, origHeight, false
+		}
+		if width == 0 {
+			width = int(math.Max(1, math.Round(float64(origWidth*height)/float64(origHeight))))
+		} else {
+			height = int(math.Max(1, math.Round(float64(origHeight*width)/float64(origWidth))))
+		}
+		return bounds, width, height, true
+	}
+
+	if opts.Mode == "fill" {
+		// Crop the largest area with the requested aspect ratio, then scale
+		// it to exactly cover the box
+		return cropRect(bounds, width, height, opts.Gravity), width, height, true
+	}
+
+	if !opts.Upscale && width >= origWidth && height >= origHeight {
+		return bounds, origWidth, origHeight, false
+	}
+
+	// Scale by the ratio of the most constrained side to fit within the box
+	ratio := math.Min(float64(width)/float64(origWidth), float64(height)/float64(origHeight))
+
+	newWidth := int(math.Max(1, math.Round(float64(origWidth)*ratio)))
+	newHeight := int(math.Max(1, math.Round(float64(origHeight)*ratio)))
+
+	return bounds, newWidth, newHeight, true
+}
+
+func (s *Server) resizeImage(ctx context.Context, uri, origBody string, origHeaders Headers, opts ResizeOptions) (headers Headers, body []byte, err error) {
+
+	if isSVG(origBody) {
+		return s.resizeSVG(ctx, uri, origBody, origHeaders, opts)
+	}
+
+	// Only decode the header to check if the image needs to be resized
+	config, format, err := image.DecodeConfig(strings.NewReader(origBody))
+	if err != nil {
+		return
+	}
+
+	if err = s.checkSourcePixels(config); err != nil {
+		logger(ctx).Warn("Image too large", "uri", uri, "width", config.Width, "height", config.Height)
+		return
+	}
+
+	orientation := 1
+	if format == "jpeg" {
+		orientation = readOrientation(origBody)
+	}
+	origBounds := image.Rect(0, 0, config.Width, config.Height)
+	if orientation >= 5 {
+		origBounds = image.Rect(0, 0, config.Height, config.Width)
+	}
+
+	// Without a resize, the size is the one of the original, already checked
+	_, newWidth, newHeight, ok := opts.geometry(origBounds)
+	padWidth, padHeight, pad := opts.padding()
+	if ok || pad {
+		if err = s.checkPixels(newWidth, newHeight); err != nil {
+			return
+		}
+	}
+	if pad {
+		if err = s.checkPixels(padWidth, padHeight); err != nil {
+			return
+		}
+	}
+	// Without its EXIF tags, a rotated image must be re-encoded upright. The
+	// negotiated formats are only worth it when the image is re-encoded anyway.
+	keepFormat := opts.Format == "" || opts.Format == format || opts.Negotiated
+	if !ok && !pad && !opts.Trim && !opts.hasEffects() && (opts.KeepMetadata || orientation == 1) && s.isAllowedFormat(format) && keepFormat {
+		// The content-type sent by the distant server may be inaccurate,
+		// so trust the decoder for the one cached with the variation
+		headers = origHeaders
+		headers.ContentType = formatContentType(format, origHeaders.ContentType)
+		body = []byte(origBody)
+		if !opts.KeepMetadata {
+			body = stripMetadata(body, format)
+		}
+		if opts.Progressive && format == "jpeg" {
+			if progressive, err := progressiveJPEG(body); err == nil {
+				body = progressive
+			}
+		}
+		return
+	}
+
+	err = s.acquireResize(ctx)
+	if err != nil {
+		return
+	}
+	defer s.releaseResize()
+
+	// Only the first frame is kept in the other formats, and when padding
+	if s.isAllowedFormat("gif") && !pad {
+		var g *gif.GIF
+		if g, err = s.decodeAnimatedGIF(ctx, uri, origBody, config); err != nil {
+			return
+		} else if g != nil {
+			return s.resizeAnimatedGIF(ctx, uri, origBody, origHeaders, g, opts)
+		}
+	}
+
+	var m image.Image
+	if format == "ico" {
+		// Start from the image of the icon closest to the requested size
+		m, err = s.decodeICOForSize(ctx, origBody, newWidth, newHeight)
+	} else {
+		m, format, err = s.decode(ctx, origBody)
+	}
+
+	if err != nil {
+		return
+	}
+
+	start := time.Now()
+
+	// Make the image upright, as the EXIF tags are dropped when re-encoding
+	m = applyOrientation(m, orientation)
+
+	if opts.Trim {
+		m = trimBorder(m)
+	}
+
+	bounds := m.Bounds()
+	crop, newWidth, newHeight, ok := opts.geometry(bounds)
+
+	// Resampling is expensive: skip it if the client is gone
+	if err = ctx.Err(); err != nil {
+		return
+	}
+
+	if ok && opts.Mode == "fill" && opts.Gravity == "smart" {
+		crop = smartCrop(m, crop)
+	}
+
+	if ok {
+		logger(ctx).Info("Resize", "uri", uri, "width", opts.Width, "height", opts.Height,
+			"orig_width", bounds.Dx(), "orig_height", bounds.Dy(), "crop", crop.String(),
+			"new_width", newWidth, "new_height", newHeight)
+
+		m = resample(m, crop, newWidth, newHeight, opts.Filter)
+		if opts.Sharpen > 0 {
+			m = sharpen(m, opts.Sharpen)
+		}
+	}
+
+	if pad {
+		m = padImage(m, padWidth, padHeight, opts.background())
+	}
+
+	m = applyEffects(m, opts)
+	if opts.Watermark != "" && s.config.Watermark != nil {
+		m = overlay(m, s.config.Watermark, opts.Watermark, opts.WatermarkOpacity)
+	}
+
+	writter := getBuffer()
+	defer putBuffer(writter)
+
+	contentType, fallback, err := s.encodeOutput(ctx, uri, writter, m, format, opts)
+	if err != nil {
+		return
+	}
+
+	resizeDuration.Observe(time.Since(start).Seconds())
+
+	body = append([]byte(nil), writter.Bytes()...)
+
+	headers = origHeaders
+	headers.ContentType = contentType
+	headers.Fallback = fallback
+
+	return
+}
+
+// Check that an original image can be decoded, as it allocates memory for
+// all the pixels the image claims to have, whatever the size of its file
+func (s *Server) checkSourcePixels(config image.Config) error {
+	if s.config.MaxSourcePixels > 0 && int64(config.Width)*int64(config.Height) > s.config.MaxSourcePixels {
+		return errImageTooLarge
+	}
+	return nil
+}
+
+// Decode an image, giving up after the decode timeout
+func (s *Server) decode(ctx context.Context, body string) (m image.Image, format string, err error) {
+	type decoded struct {
+		m      image.Image
+		format string
+	}
+	d, err := withDecodeTimeout(ctx, s.config.DecodeTimeout, func() (decoded, error) {
+		m, format, err := image.Decode(strings.NewReader(body))
+		return decoded{m, format}, err
+	})
+	return d.m, d.format, err
+}
+
+// Run a decoding, giving up after a timeout if it is positive. The decoding
+// can't be interrupted, so it goes on in the background.
+func withDecodeTimeout[T any](ctx context.Context, timeout time.Duration, decode func() (T, error)) (v T, err error) {
+	if timeout <= 0 {
+		return decode()
+	}
+
+	type result struct {
+		v   T
+		err error
+	}
+	done := make(chan result, 1)
+	go func() {
+		v, err := decode()
+		done <- result{v, err}
+	}()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case r := <-done:
+		return r.v, r.err
+	case <-timer.C:
+		logger(ctx).Warn("Decode timeout", "timeout", timeout)
+		return v, errDecodeTimeout
+	case <-ctx.Done():
+		return v, ctx.Err()
+	}
+}
+
+// Check that a resized image doesn't exceed the maximal dimensions and number
+// of pixels, for the sizes that depend on the size of the original
+func (s *Server) checkPixels(width, height int) error {
+	if width > s.config.MaxWidth || height > s.config.MaxHeight {
+		return errMaxPixels
+	}
+	if s.config.MaxPixels > 0 && int64(width)*int64(height) > s.config.MaxPixels {
+		return errMaxPixels
+	}
+	return nil
+}
+
+// Wait for a slot to resize an image, failing after the queue timeout
+func (s *Server) acquireResize(ctx context.Context) error {
+	if s.resizeSlots != nil {
+		timer := time.NewTimer(s.config.ResizeQueueTimeout)
+		defer timer.Stop()
+
+		select {
+		case s.resizeSlots <- struct{}{}:
+		case <-timer.C:
+			logger(ctx).Warn("Too many concurrent resizes")
+			return errTooBusy
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+
+	resizesInFlight.Inc()
+	return nil
+}
+
+// Free the slot of a resize
+func (s *Server) releaseResize() {
+	resizesInFlight.Dec()
+	if s.resizeSlots != nil {
+		<-s.resizeSlots
+	}
+}
+
+// Compute the largest rectangle of bounds with the aspect ratio of
+// width x height, positioned according to the gravity
+func cropRect(bounds image.Rectangle, width, height int, gravity string) image.Rectangle {
+	dx, dy := bounds.Dx(), bounds.Dy()
+	if width <= 0 || height <= 0 || dx <= 0 || dy <= 0 {
+		return bounds
+	}
+
+	cropWidth, cropHeight := dx, dy
+	if dx*height > dy*width {
+		cropWidth = dy * width / height
+	} else {
+		cropHeight = dx * height / width
+	}
+
+	// Centered by default
+	x := bounds.Min.X + (dx-cropWidth)/2
+	y := bounds.Min.Y + (dy-cropHeight)/2
+	switch gravity {
+	case "north":
+		y = bounds.Min.Y
+	case "south":
+		y = bounds.Max.Y - cropHeight
+	case "west":
+		x = bounds.Min.X
+	case "east":
+		x = bounds.Max.X - cropWidth
+	}
+
+	return image.Rect(x, y, x+cropWidth, y+cropHeight)
+}
+
+// Encode an image in JPEG, progressive if asked and possible, or else
+// baseline
+func encodeJPEG(w io.Writer, m image.Image, opts ResizeOptions) error {
+	if !opts.Progressive {
+		return jpeg.Encode(w, m, &jpeg.Options{Quality: opts.Quality})
+	}
+
+	baseline := getBuffer()
+	defer putBuffer(baseline)
+	if err := jpeg.Encode(baseline, m, &jpeg.Options{Quality: opts.Quality}); err != nil {
+		return err
+	}
+	body, err := progressiveJPEG(baseline.Bytes())
+	if err != nil {
+		body = baseline.Bytes()
+	}
+	_, err = w.Write(body)
+	return err
+}
+
+// Return the size of the box to pad the image to in pad mode, with ok false
+// in the other modes or if a dimension is derived from the image
+func (opts ResizeOptions) padding() (width, height int, ok bool) {
+	if opts.Mode != "pad" || opts.Width == 0 || opts.Height == 0 || opts.Scale > 0 {
+		return 0, 0, false
+	}
+	width, height = opts.Width, opts.Height
+	if opts.DPR > 1 {
+		width, height = width*opts.DPR, height*opts.DPR
+	}
+	return width, height, true
+}
+
+// Center an image in a box of width x height filled with a color
+func padImage(m image.Image, width, height int, bg color.Color) image.Image {
+	bounds := m.Bounds()
+	if bounds.Dx() == width && bounds.Dy() == height {
+		return m
+	}
+
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+	draw.Draw(dst, dst.Bounds(), image.NewUniform(bg), image.Point{}, draw.Src)
+	x, y := (width-bounds.Dx())/2, (height-bounds.Dy())/2
+	r := image.Rect(x, y, x+bounds.Dx(), y+bounds.Dy())
+	draw.Draw(dst, r, m, bounds.Min, draw.Over)
+	return dst
+}
+
+// Return the content-type of an image format as reported by image.Decode,
+// or def for the formats we don't know
+func formatContentType(format, def string) string {
+	switch format {
+	case "jpeg", "png", "gif", "webp", "avif":
+		return "image/" + format
+	}
+	return def
+}
+
+// The formats the images can be encoded in, by order of preference when the
+// one of the original is not allowed
+var encodableFormats = []string{"png", "jpeg", "webp", "avif"}
+
+// Check if the images can be served in a format
+func (s *Server) isAllowedFormat(format string) bool {
+	if len(s.config.OutputFormats) == 0 {
+		return true
+	}
+	for _, allowed := range s.config.OutputFormats {
+		if format == allowed {
+			return true
+		}
+	}
+	return false
+}
+
+// Return the format to encode an image in: the requested one if any, or the
+// one of the original, or the first allowed one if they are not allowed
+func (s *Server) outputFormat(requested, original string) string {
+	if requested != "" && s.isAllowedFormat(requested) {
+		return requested
+	}
+
+	// The other formats are encoded in PNG
+	switch original {
+	case "jpeg", "webp", "avif":
+	default:
+		original = "png"
+	}
+	if s.isAllowedFormat(original) {
+		return original
+	}
+
+	for _, format := range encodableFormats {
+		if s.isAllowedFormat(format) {
+			return format
+		}
+	}
+	return original
+}
+
+// Detect the content-type of an image, asking the registered decoders for
+// the formats http.DetectContentType doesn't know, such as AVIF and SVG
+func detectContentType(body []byte) string {
+	if isSVG(string(body)) {
+		return "image/svg+xml"
+	}
+	contentType := http.DetectContentType(body)
+	if strings.HasPrefix(contentType, "image/") {
+		return contentType
+	}
+	if _, format, err := image.DecodeConfig(bytes.NewReader(body)); err == nil {
+		return formatContentType(format, contentType)
+	}
+	return contentType
+}
+
+// Encode a resized image in the requested format, or the one of the
+// original, and return the content-type of the result, and whether it is in
+// the fallback format
+func (s *Server) encodeOutput(ctx context.Context, uri string, w *bytes.Buffer, m image.Image, format string, opts ResizeOptions) (contentType string, fallback bool, err error) {
+	outputFormat := s.outputFormat(opts.Format, format)
+
+	contentType, err = s.encodeImage(w, m, outputFormat, opts)
+
+	// Fall back to the original format if the WebP or AVIF encoder fails
+	if err != nil && (outputFormat == "webp" || outputFormat == "avif") {
+		logger(ctx).Warn("Error while encoding", "uri", uri, "format", outputFormat, "error", err)
+		w.Reset()
+		fallback = true
+		contentType, err = s.encodeImage(w, m, s.outputFormat("", format), opts)
+	}
+	return
+}
+
+// Encode the image in the given format, falling back to PNG for the formats
+// we can't encode, and return the content-type of the result
+func (s *Server) encodeImage(w io.Writer, m image.Image, format string, opts ResizeOptions) (contentType string, err error) {
+	// Transparent areas would be black in the formats without alpha
+	if format == "jpeg" {
+		m = flatten(m, opts.background())
+	}
+
+	switch format {
+	case "jpeg":
+		err = encodeJPEG(w, m, opts)
+		contentType = "image/jpeg"
+	case "webp":
+		err = webp.Encode(w, m, &webp.Options{Quality: float32(opts.Quality)})
+		contentType = "image/webp"
+	case "avif":
+		err = avif.Encode(w, m, avif.Options{Quality: opts.Quality, QualityAlpha: opts.Quality, Speed: avifSpeed})
+		contentType = "image/avif"
+	default:
+		if opts.Palette > 0 {
+			m = quantize(m, opts.Palette)
+		}
+		encoder := png.Encoder{CompressionLevel: s.config.PNGCompression}
+		err = encoder.Encode(w, m)
+		contentType = "image/png"
+	}
+	return
+}
@@ -0,0 +1,475 @@
+package resize
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"image"
+	"image/color"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/chai2010/webp"
+)
+
+// Resize an image served by a distant server with the options
+func resizeFrom(t *testing.T, s *Server, contentType string, body []byte, opts ResizeOptions) (Headers, []byte) {
+	t.Helper()
+	ts, _ := newUpstream(t, contentType, body)
+	headers, resized, err := s.FetchResized(context.Background(), ts.URL, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return headers, resized
+}
+
+func TestResizeKeepsJPEG(t *testing.T) {
+	s := newTestServer(Config{MaxPixels: 1 << 20}, newMemoryCache())
+	headers, body := resizeFrom(t, s, "image/jpeg", jpegImage(t, 400, 200), ResizeOptions{Width: 100, Height: 100, Quality: defaultQuality})
+
+	if headers.ContentType != "image/jpeg" {
+		t.Errorf("Content-Type = %s, want image/jpeg", headers.ContentType)
+	}
+	m := decodeImage(t, body, "jpeg")
+	if m.Bounds().Dx() != 100 || m.Bounds().Dy() != 50 {
+		t.Errorf("size = %v, want 100x50", m.Bounds())
+	}
+}
+
+func TestResizeKeepsPNG(t *testing.T) {
+	s := newTestServer(Config{MaxPixels: 1 << 20}, newMemoryCache())
+	headers, body := resizeFrom(t, s, "image/png", pngImage(t, 400, 200), ResizeOptions{Width: 100, Height: 100, Quality: defaultQuality})
+
+	if headers.ContentType != "image/png" {
+		t.Errorf("Content-Type = %s, want image/png", headers.ContentType)
+	}
+	decodeImage(t, body, "png")
+}
+
+// Start a distant server answering slowly with status and body, so that the
+// concurrent requests overlap, and count its requests
+func newSlowUpstream(t *testing.T, status int, body []byte) (*httptest.Server, *int32) {
+	t.Helper()
+	requests := new(int32)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(requests, 1)
+		time.Sleep(100 * time.Millisecond)
+		w.Header().Set("Content-Type", "image/png")
+		w.WriteHeader(status)
+		w.Write(body)
+	}))
+	t.Cleanup(ts.Close)
+	return ts, requests
+}
+
+// Fetch a resized image from n goroutines at once, and return their errors
+func fetchConcurrently(s *Server, uri string, opts ResizeOptions, n int) []error {
+	errs := make([]error, n)
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			_, _, errs[i] = s.FetchResized(context.Background(), uri, opts)
+		}(i)
+	}
+	wg.Wait()
+	return errs
+}
+
+func TestConcurrentRequestsShareTheWork(t *testing.T) {
+	ts, requests := newSlowUpstream(t, 200, pngImage(t, 100, 100))
+	s := newTestServer(Config{MaxPixels: 1 << 20}, newMemoryCache())
+
+	for i, err := range fetchConcurrently(s, ts.URL, ResizeOptions{Width: 10, Height: 10, Quality: defaultQuality}, 50) {
+		if err != nil {
+			t.Fatalf("request %d: %s", i, err)
+		}
+	}
+	if n := atomic.LoadInt32(requests); n != 1 {
+		t.Errorf("%d fetches, want 1", n)
+	}
+}
+
+func TestConcurrentRequestsShareTheErrors(t *testing.T) {
+	ts, requests := newSlowUpstream(t, 404, nil)
+	s := newTestServer(Config{MaxPixels: 1 << 20}, newMemoryCache())
+
+	for i, err := range fetchConcurrently(s, ts.URL, ResizeOptions{Width: 10, Height: 10, Quality: defaultQuality}, 50) {
+		if err != errNotFound {
+			t.Fatalf("request %d: err = %v, want %v", i, err, errNotFound)
+		}
+	}
+	if n := atomic.LoadInt32(requests); n != 1 {
+		t.Errorf("%d fetches, want 1", n)
+	}
+}
+
+func TestFillMode(t *testing.T) {
+	s := newTestServer(Config{MaxPixels: 1 << 20}, newMemoryCache())
+	_, body := resizeFrom(t, s, "image/png", pngImage(t, 400, 200), ResizeOptions{Width: 100, Height: 100, Quality: defaultQuality, Mode: "fill", Gravity: "center"})
+	if m := decodeImage(t, body, "png"); m.Bounds().Dx() != 100 || m.Bounds().Dy() != 100 {
+		t.Errorf("size = %v, want 100x100", m.Bounds())
+	}
+}
+
+func TestCropGravity(t *testing.T) {
+	bounds := image.Rect(0, 0, 400, 200)
+	tests := map[string]image.Rectangle{
+		"center": image.Rect(100, 0, 300, 200),
+		"west":   image.Rect(0, 0, 200, 200),
+		"east":   image.Rect(200, 0, 400, 200),
+		"north":  image.Rect(100, 0, 300, 200),
+	}
+	for gravity, want := range tests {
+		if crop := cropRect(bounds, 100, 100, gravity); crop != want {
+			t.Errorf("%s: crop = %v, want %v", gravity, crop, want)
+		}
+	}
+
+	bounds = image.Rect(0, 0, 200, 400)
+	if crop := cropRect(bounds, 100, 100, "north"); crop != image.Rect(0, 0, 200, 200) {
+		t.Errorf("north: crop = %v", crop)
+	}
+	if crop := cropRect(bounds, 100, 100, "south"); crop != image.Rect(0, 200, 200, 400) {
+		t.Errorf("south: crop = %v", crop)
+	}
+}
+
+func TestFillVariation(t *testing.T) {
+	fit := ResizeOptions{Width: 100, Height: 100, Quality: defaultQuality, Mode: "fit", Gravity: "center"}
+	fill := fit
+	fill.Mode = "fill"
+	north := fill
+	north.Gravity = "north"
+	if fit.variation() == fill.variation() || fill.variation() == north.variation() {
+		t.Errorf("variations not distinct: %s, %s, %s", fit.variation(), fill.variation(), north.variation())
+	}
+}
+
+func TestPNGCompression(t *testing.T) {
+	opts := ResizeOptions{Width: 200, Height: 200, Quality: defaultQuality}
+	original := pngImage(t, 400, 200)
+	_, defaultBody := resizeFrom(t, newTestServer(Config{MaxPixels: 1 << 20}, newMemoryCache()), "image/png", original, opts)
+	_, bestBody := resizeFrom(t, newTestServer(Config{MaxPixels: 1 << 20, PNGCompression: png.BestCompression}, newMemoryCache()), "image/png", original, opts)
+
+	if len(bestBody) > len(defaultBody) {
+		t.Errorf("%d bytes with the best compression, %d bytes by default", len(bestBody), len(defaultBody))
+	}
+}
+
+func TestPalette(t *testing.T) {
+	s := newTestServer(Config{MaxPixels: 1 << 20}, newMemoryCache())
+	_, body := resizeFrom(t, s, "image/png", pngImage(t, 400, 200), ResizeOptions{Width: 100, Height: 100, Quality: defaultQuality, Palette: 16})
+
+	m, ok := decodeImage(t, body, "png").(*image.Paletted)
+	if !ok {
+		t.Fatal("not a paletted image")
+	}
+	if len(m.Palette) > 16 {
+		t.Errorf("%d colors, want at most 16", len(m.Palette))
+	}
+}
+
+func TestFitWithinBox(t *testing.T) {
+	tests := []struct {
+		name          string
+		source        image.Rectangle
+		width, height int
+		newW, newH    int
+	}{
+		{"portrait into landscape", image.Rect(0, 0, 300, 600), 400, 100, 50, 100},
+		{"landscape into portrait", image.Rect(0, 0, 600, 300), 100, 400, 100, 50},
+		{"landscape into landscape", image.Rect(0, 0, 800, 200), 400, 200, 400, 100},
+		{"square into square", image.Rect(0, 0, 500, 500), 100, 100, 100, 100},
+		{"square into landscape", image.Rect(0, 0, 500, 500), 400, 100, 100, 100},
+	}
+	for _, test := range tests {
+		opts := ResizeOptions{Width: test.width, Height: test.height, Mode: "fit"}
+		_, w, h, ok := opts.geometry(test.source)
+		if !ok || w != test.newW || h != test.newH {
+			t.Errorf("%s: %dx%d (resized: %v), want %dx%d", test.name, w, h, ok, test.newW, test.newH)
+		}
+	}
+}
+
+func TestUpscale(t *testing.T) {
+	s := newTestServer(Config{MaxPixels: 1 << 20}, newMemoryCache())
+	small := pngImage(t, 40, 20)
+
+	_, body := resizeFrom(t, s, "image/png", small, ResizeOptions{Width: 200, Height: 200, Quality: defaultQuality})
+	if m := decodeImage(t, body, "png"); m.Bounds().Dx() != 40 || m.Bounds().Dy() != 20 {
+		t.Errorf("without upscale: size = %v, want the original 40x20", m.Bounds())
+	}
+
+	_, body = resizeFrom(t, s, "image/png", small, ResizeOptions{Width: 200, Height: 200, Quality: defaultQuality, Upscale: true})
+	if m := decodeImage(t, body, "png"); m.Bounds().Dx() != 200 || m.Bounds().Dy() != 100 {
+		t.Errorf("with upscale: size = %v, want 200x100", m.Bounds())
+	}
+
+	// Still bounded by the max pixels
+	s = newTestServer(Config{MaxPixels: 10000}, newMemoryCache())
+	ts, _ := newUpstream(t, "image/png", small)
+	if _, _, err := s.FetchResized(context.Background(), ts.URL, ResizeOptions{Width: 400, Height: 400, Quality: defaultQuality, Upscale: true}); err != errMaxPixels {
+		t.Errorf("err = %v, want %v", err, errMaxPixels)
+	}
+
+	// And by the max width and height, whether one or both sides are given
+	s = newTestServer(Config{MaxPixels: 1 << 20, MaxWidth: 1000, MaxHeight: 1000}, newMemoryCache())
+	ts, _ = newUpstream(t, "image/png", pngImage(t, 100, 10))
+	for _, opts := range []ResizeOptions{
+		{Height: 200, Quality: defaultQuality, Upscale: true},
+		{Width: 2000, Height: 2000, Quality: defaultQuality, Upscale: true},
+		{Width: 2000, Height: 2000, Quality: defaultQuality, Mode: "fill", Upscale: true},
+	} {
+		if _, _, err := s.FetchResized(context.Background(), ts.URL, opts); err != errMaxPixels {
+			t.Errorf("%dx%d in %s mode: err = %v, want %v", opts.Width, opts.Height, opts.Mode, err, errMaxPixels)
+		}
+	}
+	s = newTestServer(Config{MaxPixels: 1 << 20}, newMemoryCache())
+	ts, _ = newUpstream(t, "image/png", pngImage(t, 100, 1))
+	if _, _, err := s.FetchResized(context.Background(), ts.URL, ResizeOptions{Height: 200, Quality: defaultQuality, Upscale: true}); err != errMaxPixels {
+		t.Errorf("20000x200 with the default limits: err = %v, want %v", err, errMaxPixels)
+	}
+}
+
+func TestConcurrentResizesLimit(t *testing.T) {
+	c := newMemoryCache()
+	s := NewServer(Config{MaxPixels: 1 << 20, MaxConcurrentResizes: 1, ResizeQueueTimeout: 5 * time.Second}, c)
+	uri := testOrigin + "/a.png"
+	cacheOriginal(c, uri, "image/png", pngImage(t, 40, 20))
+
+	// Another resize is running
+	if err := s.acquireResize(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error, 1)
+	go func() {
+		_, _, err := s.FetchResized(context.Background(), uri, ResizeOptions{Width: 10, Height: 10, Quality: defaultQuality})
+		done <- err
+	}()
+
+	select {
+	case err := <-done:
+		t.Fatalf("resized in parallel: err = %v", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	s.releaseResize()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("err = %v once its turn came", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("still waiting for its turn")
+	}
+}
+
+func TestConcurrentResizesTimeout(t *testing.T) {
+	c := newMemoryCache()
+	s := NewServer(Config{MaxPixels: 1 << 20, MaxConcurrentResizes: 1, ResizeQueueTimeout: 50 * time.Millisecond}, c)
+	uri := testOrigin + "/a.png"
+	cacheOriginal(c, uri, "image/png", pngImage(t, 40, 20))
+
+	if err := s.acquireResize(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	defer s.releaseResize()
+	if w := serve(s.Handler(), "GET", "/resize/"+encodeURL(uri)+"/10/10"); w.Code != 503 {
+		t.Errorf("status = %d, want 503", w.Code)
+	}
+}
+
+func TestDefaultResizeQueueTimeout(t *testing.T) {
+	c := newMemoryCache()
+	s := NewServer(Config{MaxPixels: 1 << 20, MaxConcurrentResizes: 1}, c)
+	uri := testOrigin + "/a.png"
+	cacheOriginal(c, uri, "image/png", pngImage(t, 40, 20))
+
+	// Without a timeout, the resizes would fail even with a free slot
+	for i := 0; i < 20; i++ {
+		if w := serve(s.Handler(), "GET", fmt.Sprintf("/resize/%s/%d/10", encodeURL(uri), 10+i)); w.Code != 200 {
+			t.Fatalf("status = %d, want 200", w.Code)
+		}
+	}
+}
+
+func TestResizeWebP(t *testing.T) {
+	var source bytes.Buffer
+	if err := webp.Encode(&source, gradient(400, 200), &webp.Options{Lossless: true}); err != nil {
+		t.Fatal(err)
+	}
+	s := newTestServer(Config{MaxPixels: 1 << 20}, newMemoryCache())
+
+	for _, format := range []string{"png", "jpeg"} {
+		headers, body := resizeFrom(t, s, "image/webp", source.Bytes(), ResizeOptions{Width: 100, Height: 100, Quality: defaultQuality, Format: format})
+		if headers.ContentType != "image/"+format {
+			t.Errorf("Content-Type = %s, want image/%s", headers.ContentType, format)
+		}
+		m := decodeImage(t, body, format)
+		if m.Bounds().Dx() != 100 || m.Bounds().Dy() != 50 {
+			t.Errorf("%s: size = %v, want 100x50", format, m.Bounds())
+		}
+	}
+}
+
+func TestNoResizeKeepsTheBytes(t *testing.T) {
+	s := newTestServer(Config{MaxPixels: 1 << 20}, newMemoryCache())
+	for _, orig := range [][]byte{pngImage(t, 40, 20), jpegImage(t, 40, 20)} {
+		_, body, err := s.resizeImage(context.Background(), "", string(orig), Headers{}, ResizeOptions{Width: 100, Height: 100, Quality: defaultQuality})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(body, orig) {
+			t.Error("the image was re-encoded while it fits in the box")
+		}
+	}
+}
+
+// Without a resize, the image should not even be decoded: the allocations
+// don't grow with its size
+func BenchmarkNoResize(b *testing.B) {
+	var buf bytes.Buffer
+	png.Encode(&buf, gradient(2000, 2000))
+	orig := buf.String()
+	s := newTestServer(Config{}, newMemoryCache())
+	opts := ResizeOptions{Width: 4000, Height: 4000, Quality: defaultQuality}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, _, err := s.resizeImage(context.Background(), "", orig, Headers{}, opts); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// Encode a small PNG declaring larger dimensions in its header, as a
+// decompression bomb would
+func declaredPNG(t *testing.T, width, height uint32) []byte {
+	t.Helper()
+	body := pngImage(t, 10, 10)
+	// The IHDR chunk follows the 8 bytes of the signature, with its length
+	// and type before its data, and its CRC after
+	binary.BigEndian.PutUint32(body[16:], width)
+	binary.BigEndian.PutUint32(body[20:], height)
+	binary.BigEndian.PutUint32(body[29:], crc32.ChecksumIEEE(body[12:29]))
+	return body
+}
+
+func TestMaxSourcePixels(t *testing.T) {
+	c := newMemoryCache()
+	s := newTestServer(Config{MaxPixels: 1 << 20, MaxSourcePixels: 1000000}, c)
+	ts, _ := newUpstream(t, "image/png", declaredPNG(t, 100000, 100000))
+
+	// Rejected from its header, before allocating its pixels
+	_, _, err := s.FetchResized(context.Background(), ts.URL, ResizeOptions{Width: 10, Height: 10, Quality: defaultQuality})
+	if err != errImageTooLarge {
+		t.Fatalf("err = %v, want %v", err, errImageTooLarge)
+	}
+	if err := c.GetError(ts.URL); errorStatus(err) != errorStatus(errImageTooLarge) {
+		t.Errorf("cached error = %v, want %v", err, errImageTooLarge)
+	}
+}
+
+func TestDecodeTimeout(t *testing.T) {
+	c := newMemoryCache()
+	s := newTestServer(Config{MaxPixels: 1 << 20, DecodeTimeout: time.Nanosecond}, c)
+	ts, _ := newUpstream(t, "image/png", pngImage(t, 1000, 1000))
+
+	_, _, err := s.FetchResized(context.Background(), ts.URL, ResizeOptions{Width: 10, Height: 10, Quality: defaultQuality})
+	if err != errDecodeTimeout {
+		t.Fatalf("err = %v, want %v", err, errDecodeTimeout)
+	}
+	if err := c.GetError(ts.URL); errorStatus(err) != errorStatus(errDecodeTimeout) {
+		t.Errorf("cached error = %v, want %v", err, errDecodeTimeout)
+	}
+}
+
+func TestMaxSourcePixelsOnFetch(t *testing.T) {
+	c := newMemoryCache()
+	s := newTestServer(Config{MaxSourcePixels: 1000000, SyncCache: true}, c)
+	ts, requests := newUpstream(t, "image/png", declaredPNG(t, 30000, 30000))
+
+	// Even when it is not resized, and only once
+	for i := 0; i < 2; i++ {
+		if _, _, err := s.FetchImage(context.Background(), ts.URL); errorStatus(err) != errorStatus(errImageTooLarge) {
+			t.Fatalf("fetch %d: err = %v, want %v", i+1, err, errImageTooLarge)
+		}
+	}
+	if *requests != 1 {
+		t.Errorf("%d requests, want the error to be cached", *requests)
+	}
+	if _, _, ok := c.Get(cacheKey(ts.URL, "orig")); ok {
+		t.Error("the original was cached")
+	}
+}
+
+func TestPadMode(t *testing.T) {
+	s := newTestServer(Config{MaxPixels: 1 << 20}, newMemoryCache())
+	opts := ResizeOptions{Width: 40, Height: 40, Quality: defaultQuality, Mode: "pad", Gravity: "center", Background: "00ff00"}
+	_, body := resizeFrom(t, s, "image/png", pngImage(t, 80, 40), opts)
+
+	m := decodeImage(t, body, "png")
+	if m.Bounds().Dx() != 40 || m.Bounds().Dy() != 40 {
+		t.Fatalf("size = %v, want 40x40", m.Bounds())
+	}
+	green := color.NRGBA{0, 255, 0, 255}
+	for _, y := range []int{0, 9, 30, 39} {
+		if c := color.NRGBAModel.Convert(m.At(20, y)); c != green {
+			t.Errorf("padding at y = %d: %v, want the background", y, c)
+		}
+	}
+	if c := color.NRGBAModel.Convert(m.At(20, 20)); c == green {
+		t.Error("the image is not in the middle")
+	}
+
+	// Cached apart from the fitted image and the other backgrounds
+	fit := opts
+	fit.Mode, fit.Background = "fit", ""
+	red := opts
+	red.Background = "ff0000"
+	if opts.variation() == fit.variation() || opts.variation() == red.variation() {
+		t.Errorf("variation = %s, the same as the fitted image or another background", opts.variation())
+	}
+}
+
+// Return the marker of the start of frame of a JPEG image: 0xc0 for the
+// baseline ones, 0xc2 for the progressive ones
+func jpegFrameMarker(body []byte) byte {
+	for pos := 2; pos+4 <= len(body) && body[pos] == 0xff; {
+		marker := body[pos+1]
+		if marker >= 0xc0 && marker <= 0xcf && marker != 0xc4 && marker != 0xc8 && marker != 0xcc {
+			return marker
+		}
+		pos += 2 + int(binary.BigEndian.Uint16(body[pos+2:]))
+	}
+	return 0
+}
+
+func TestProgressiveJPEG(t *testing.T) {
+	s := newTestServer(Config{MaxPixels: 1 << 20}, newMemoryCache())
+	opts := ResizeOptions{Width: 100, Height: 100, Quality: defaultQuality}
+
+	_, baseline := resizeFrom(t, s, "image/jpeg", jpegImage(t, 400, 200), opts)
+	opts.Progressive = true
+	_, progressive := resizeFrom(t, s, "image/jpeg", jpegImage(t, 400, 200), opts)
+
+	if marker := jpegFrameMarker(baseline); marker != 0xc0 {
+		t.Errorf("start of frame = %#x without the option, want 0xc0", marker)
+	}
+	if marker := jpegFrameMarker(progressive); marker != 0xc2 {
+		t.Errorf("start of frame = %#x, want 0xc2", marker)
+	}
+	if m := decodeImage(t, progressive, "jpeg"); m.Bounds().Dx() != 100 || m.Bounds().Dy() != 50 {
+		t.Errorf("size = %v, want 100x50", m.Bounds())
+	}
+}
@@ -0,0 +1,109 @@
+package resize
+
+import (
+	"context"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// A file of the disk cache, as seen by the janitor
+type cacheFile struct {
+	path  string
+	size  int64
+	atime time.Time
+}
+
+// Evict the cached files in the background, every interval, so that the
+// cache directory doesn't exceed maxBytes, until ctx is done. It must be
+// started before the cache is used: the keys of the files are only
+// remembered in redis from then on, to forget their infos when they are
+// evicted. The returned channel is closed once the janitor stopped, after
+// the eviction in progress.
+func (c *DiskCache) StartJanitor(ctx context.Context, maxBytes int64, interval time.Duration) <-chan struct{} {
+	c.evicting = true
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			if err := c.Evict(maxBytes); err != nil {
+				slog.Error("Error while evicting", "directory", c.directory, "error", err)
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+	return stopped
+}
+
+// Remove the least recently used files, with their infos in redis, until
+// the cache directory doesn't exceed maxBytes
+func (c *DiskCache) Evict(maxBytes int64) error {
+	var files []cacheFile
+	var total int64
+
+	err := filepath.WalkDir(c.directory, func(path string, d fs.DirEntry, err error) error {
+		// The files may be removed while walking the directory
+		if err != nil || d.IsDir() || strings.HasPrefix(d.Name(), ".") {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return nil
+		}
+		files = append(files, cacheFile{path, info.Size(), accessTime(info)})
+		total += info.Size()
+		return nil
+	})
+	if err != nil || total <= maxBytes {
+		return err
+	}
+
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].atime.Before(files[j].atime)
+	})
+
+	evicted := 0
+	for _, f := range files {
+		if total <= maxBytes {
+			break
+		}
+		err = os.Remove(f.path)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		c.forgetFile(f.path)
+		total -= f.size
+		evicted++
+	}
+
+	slog.Info("Evict", "directory", c.directory, "files", evicted, "bytes", total)
+	cacheEvictions.Add(float64(evicted))
+
+	return nil
+}
+
+// Remove the infos in redis of an evicted file
+func (c *DiskCache) forgetFile(path string) {
+	rel, err := filepath.Rel(c.directory, path)
+	if err != nil {
+		return
+	}
+	name := filepath.ToSlash(rel)
+
+	key, err := c.connection.Call("HGET", c.redisKey("files"), name).Str()
+	if err != nil {
+		return
+	}
+	c.connection.Call("DEL", c.redisKey(key))
+	c.connection.Call("HDEL", c.redisKey("files"), name)
+}
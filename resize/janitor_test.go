@@ -0,0 +1,77 @@
+package resize
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestEvict(t *testing.T) {
+	c := newTestDiskCache(t)
+	// As when the janitor is started, without evicting in the background
+	c.evicting = true
+	var keys []string
+	for i := 0; i < 5; i++ {
+		key := cacheKey(fmt.Sprintf("http://example.com/%d.png", i), "orig")
+		c.Set(key, Headers{ContentType: "image/png"}, make([]byte, 1000))
+		// From the least to the most recently used
+		used := time.Now().Add(time.Duration(i-10) * time.Minute)
+		os.Chtimes(c.generateKeyForCache(key), used, used)
+		keys = append(keys, key)
+	}
+
+	if err := c.Evict(3000); err != nil {
+		t.Fatal(err)
+	}
+
+	for i, key := range keys {
+		_, err := os.Stat(c.generateKeyForCache(key))
+		infos, _ := c.connection.Call("HGETALL", c.redisKey(key)).Hash()
+		if i < 2 && (!os.IsNotExist(err) || len(infos) != 0) {
+			t.Errorf("%s not evicted, with its infos %v", key, infos)
+		}
+		if i >= 2 && (err != nil || infos["type"] != "image/png") {
+			t.Errorf("%s evicted", key)
+		}
+	}
+}
+
+func TestFilesOnlyRememberedForEviction(t *testing.T) {
+	c := newTestDiskCache(t)
+	key := cacheKey("http://example.com/a.png", "orig")
+	c.Set(key, Headers{ContentType: "image/png"}, []byte("png"))
+	if files, _ := c.connection.Call("HGETALL", c.redisKey("files")).Hash(); len(files) != 0 {
+		t.Errorf("files remembered without eviction: %v", files)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	c.StartJanitor(ctx, 1<<30, time.Hour)
+	c.Set(key, Headers{ContentType: "image/png"}, []byte("png"))
+	if files, _ := c.connection.Call("HGETALL", c.redisKey("files")).Hash(); files[hashKey(key, c.depth)] != key {
+		t.Errorf("files remembered with eviction: %v", files)
+	}
+}
+
+func TestJanitorStops(t *testing.T) {
+	c := newTestDiskCache(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := c.StartJanitor(ctx, 1000, 10*time.Millisecond)
+
+	cancel()
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the janitor didn't stop")
+	}
+
+	// Nothing is evicted anymore
+	key := cacheKey("http://example.com/a.png", "orig")
+	c.Set(key, Headers{ContentType: "image/png"}, make([]byte, 2000))
+	time.Sleep(50 * time.Millisecond)
+	if _, err := os.Stat(c.generateKeyForCache(key)); err != nil {
+		t.Errorf("evicted after the janitor stopped: %v", err)
+	}
+}
@@ -0,0 +1,126 @@
+package resize
+
+import (
+	"bytes"
+	"encoding/binary"
+)
+
+// Remove the metadata (EXIF, XMP, IPTC, comments) of an image served without
+// re-encoding, as the encoders already drop them. The body is returned
+// unchanged if its format is not supported or if it can't be parsed.
+func stripMetadata(body []byte, format string) []byte {
+	var stripped []byte
+	var ok bool
+	switch format {
+	case "jpeg":
+		stripped, ok = stripJPEGMetadata(body)
+	case "png":
+		stripped, ok = stripPNGMetadata(body)
+	case "webp":
+		stripped, ok = stripWebPMetadata(body)
+	}
+	if !ok {
+		return body
+	}
+	return stripped
+}
+
+// Drop the APP1 (EXIF and XMP), APP13 (IPTC) and comment segments of a JPEG
+// image, keeping the others such as the color profile
+func stripJPEGMetadata(body []byte) ([]byte, bool) {
+	if len(body) < 2 || body[0] != 0xff || body[1] != 0xd8 {
+		return nil, false
+	}
+
+	out := bytes.NewBuffer(make([]byte, 0, len(body)))
+	out.Write(body[:2])
+	for i := 2; ; {
+		if i+4 > len(body) || body[i] != 0xff {
+			return nil, false
+		}
+		marker := body[i+1]
+
+		// The entropy-coded data follows the start of scan: keep the rest as is
+		if marker == 0xda {
+			out.Write(body[i:])
+			return out.Bytes(), true
+		}
+
+		length := int(binary.BigEndian.Uint16(body[i+2:]))
+		end := i + 2 + length
+		if length < 2 || end > len(body) {
+			return nil, false
+		}
+		if marker != 0xe1 && marker != 0xed && marker != 0xfe {
+			out.Write(body[i:end])
+		}
+		i = end
+	}
+}
+
+// The chunks of a PNG image holding metadata
+var pngMetadataChunks = map[string]bool{"eXIf": true, "tEXt": true, "zTXt": true, "iTXt": true, "tIME": true}
+
+// Drop the EXIF, text and time chunks of a PNG image
+func stripPNGMetadata(body []byte) ([]byte, bool) {
+	const signature = "\x89PNG\r\n\x1a\n"
+	if !bytes.HasPrefix(body, []byte(signature)) {
+		return nil, false
+	}
+
+	out := bytes.NewBuffer(make([]byte, 0, len(body)))
+	out.WriteString(signature)
+	for i := len(signature); i < len(body); {
+		if i+8 > len(body) {
+			return nil, false
+		}
+		// Length, type, data and CRC
+		end := i + 12 + int(binary.BigEndian.Uint32(body[i:]))
+		if end > len(body) || end < i {
+			return nil, false
+		}
+		if !pngMetadataChunks[string(body[i+4:i+8])] {
+			out.Write(body[i:end])
+		}
+		i = end
+	}
+	return out.Bytes(), true
+}
+
+// Drop the EXIF and XMP chunks of a WebP image, and their flags in the
+// extended header
+func stripWebPMetadata(body []byte) ([]byte, bool) {
+	if len(body) < 12 || string(body[:4]) != "RIFF" || string(body[8:12]) != "WEBP" {
+		return nil, false
+	}
+
+	out := bytes.NewBuffer(make([]byte, 0, len(body)))
+	out.Write(body[:12])
+	for i := 12; i < len(body); {
+		if i+8 > len(body) {
+			return nil, false
+		}
+		// Chunks are padded to an even size
+		size := int(binary.LittleEndian.Uint32(body[i+4:]))
+		end := i + 8 + size + size%2
+		if end > len(body) || end < i {
+			return nil, false
+		}
+		switch string(body[i : i+4]) {
+		case "EXIF", "XMP ":
+		case "VP8X":
+			start := out.Len()
+			out.Write(body[i:end])
+			if size > 0 {
+				out.Bytes()[start+8] &^= 0x08 | 0x04
+			}
+		default:
+			out.Write(body[i:end])
+		}
+		i = end
+	}
+
+	stripped := out.Bytes()
+	binary.LittleEndian.PutUint32(stripped[4:], uint32(len(stripped)-8))
+	return stripped, true
+}
@@ -0,0 +1,51 @@
+package resize
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"testing"
+)
+
+// Insert a text chunk after the header of a PNG
+func withTextChunk(body []byte, text string) []byte {
+	data := append([]byte("tEXt"), text...)
+	chunk := binary.BigEndian.AppendUint32(nil, uint32(len(data)-4))
+	chunk = append(chunk, data...)
+	chunk = binary.BigEndian.AppendUint32(chunk, crc32.ChecksumIEEE(data))
+	// After the signature and the IHDR chunk
+	return append(append(append([]byte{}, body[:33]...), chunk...), body[33:]...)
+}
+
+func TestStripMetadata(t *testing.T) {
+	c := newMemoryCache()
+	s := NewServer(Config{MaxPixels: 1 << 20}, c)
+	jpeg := withOrientation(jpegImage(t, 40, 20), 1)
+	png := withTextChunk(pngImage(t, 40, 20), "Comment\x00secret")
+	cacheOriginal(c, testOrigin+"/a.jpg", "image/jpeg", jpeg)
+	cacheOriginal(c, testOrigin+"/a.png", "image/png", png)
+
+	tests := []struct {
+		uri, format string
+		metadata    []byte
+	}{
+		{testOrigin + "/a.jpg", "jpeg", []byte("Exif")},
+		{testOrigin + "/a.png", "png", []byte("secret")},
+	}
+	for _, test := range tests {
+		// Served without being resized, or resized
+		for _, size := range []string{"/100/100", "/20/20"} {
+			w := serve(s.Handler(), "GET", "/resize/"+encodeURL(test.uri)+size)
+			if w.Code != 200 || bytes.Contains(w.Body.Bytes(), test.metadata) {
+				t.Errorf("%s%s: status = %d, metadata kept", test.format, size, w.Code)
+			}
+			decodeImage(t, w.Body.Bytes(), test.format)
+		}
+
+		// Unless asked to keep them
+		w := serve(s.Handler(), "GET", "/resize/"+encodeURL(test.uri)+"/100/100?keep-metadata=true")
+		if !bytes.Contains(w.Body.Bytes(), test.metadata) {
+			t.Errorf("%s: metadata stripped with keep-metadata", test.format)
+		}
+	}
+}
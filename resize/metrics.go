@@ -0,0 +1,85 @@
+package resize
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"strings"
+)
+
+// Cache lookups, by kind of variation (orig or resize) and result (hit or miss)
+var cacheLookups = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "goresize_cache_lookups_total",
+	Help: "Number of cache lookups by kind of variation and result.",
+}, []string{"kind", "result"})
+
+// Fetches on distant servers, by result (success or error)
+var upstreamFetches = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "goresize_upstream_fetches_total",
+	Help: "Number of fetches on distant servers by result.",
+}, []string{"result"})
+
+// Duration of the resampling and encoding of images
+var resizeDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+	Name:    "goresize_resize_duration_seconds",
+	Help:    "Duration of the resampling and encoding of images.",
+	Buckets: prometheus.DefBuckets,
+})
+
+// Saves in cache waiting for a worker
+var cacheQueueDepth = prometheus.NewGauge(prometheus.GaugeOpts{
+	Name: "goresize_cache_queue_depth",
+	Help: "Number of saves in cache waiting for a worker.",
+})
+
+// Saves in cache dropped because the queue was full
+var cacheSavesDropped = prometheus.NewCounter(prometheus.CounterOpts{
+	Name: "goresize_cache_saves_dropped_total",
+	Help: "Number of saves in cache dropped because the queue was full.",
+})
+
+// Attempts to reconnect to redis after losing the connection
+var redisReconnects = prometheus.NewCounter(prometheus.CounterOpts{
+	Name: "goresize_redis_reconnects_total",
+	Help: "Number of attempts to reconnect to redis.",
+})
+
+// Files evicted from the disk cache to stay under its maximal size
+var cacheEvictions = prometheus.NewCounter(prometheus.CounterOpts{
+	Name: "goresize_cache_evictions_total",
+	Help: "Number of files evicted from the disk cache.",
+})
+
+// Images being resized
+var resizesInFlight = prometheus.NewGauge(prometheus.GaugeOpts{
+	Name: "goresize_resizes_in_flight",
+	Help: "Number of images being resized.",
+})
+
+// Number of circuit breakers of the failing hosts, by state: open or
+// half_open. The hosts are not labels, as any host can be fetched.
+var circuitBreakers = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "goresize_circuit_breakers",
+	Help: "Number of circuit breakers of the failing hosts, by state: open or half_open.",
+}, []string{"state"})
+
+// Capacity of the pool of connections to redis
+var redisPoolCapacity = prometheus.NewGauge(prometheus.GaugeOpts{
+	Name: "goresize_redis_pool_capacity",
+	Help: "Maximal number of connections to redis.",
+})
+
+// Commands running on redis, or waiting for a connection above the capacity:
+// the connections in use are the lowest of it and the capacity
+var redisCommandsInFlight = prometheus.NewGauge(prometheus.GaugeOpts{
+	Name: "goresize_redis_commands_in_flight",
+	Help: "Number of commands running on redis or waiting for a connection.",
+})
+
+func init() {
+	prometheus.MustRegister(cacheLookups, upstreamFetches, resizeDuration, cacheQueueDepth, cacheSavesDropped,
+		redisReconnects, cacheEvictions, resizesInFlight, circuitBreakers, redisPoolCapacity, redisCommandsInFlight)
+}
+
+// Return the kind of a variation: orig or resize
+func variationKind(variation string) string {
+	return strings.SplitN(variation, "/", 2)[0]
+}
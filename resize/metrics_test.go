@@ -0,0 +1,33 @@
+package resize
+
+import (
+	"context"
+	"strings"
+	"testing"
+)
+
+func TestMetrics(t *testing.T) {
+	ts, _ := newUpstream(t, "image/png", pngImage(t, 40, 20))
+	s := newTestServer(Config{MaxPixels: 1 << 20}, newMemoryCache())
+	opts := ResizeOptions{Width: 10, Height: 10, Quality: defaultQuality}
+	if _, _, err := s.FetchResized(context.Background(), ts.URL, opts); err != nil {
+		t.Fatal(err)
+	}
+
+	w := serve(s.Handler(), "GET", "/metrics")
+	if w.Code != 200 {
+		t.Fatalf("status = %d", w.Code)
+	}
+	for _, metric := range []string{
+		`goresize_cache_lookups_total{kind="orig",result="miss"}`,
+		`goresize_cache_lookups_total{kind="resize",result="miss"}`,
+		`goresize_upstream_fetches_total{result="success"}`,
+		`goresize_resize_duration_seconds_count`,
+		`goresize_redis_pool_capacity`,
+		`goresize_redis_commands_in_flight`,
+	} {
+		if !strings.Contains(w.Body.String(), metric) {
+			t.Errorf("%s is missing", metric)
+		}
+	}
+}
@@ -0,0 +1,71 @@
+package resize
+
+import (
+	"github.com/rwcarlsen/goexif/exif"
+	"image"
+	"strings"
+)
+
+// Read the EXIF orientation of a JPEG image, 1 (upright) if it has none
+func readOrientation(body string) int {
+	x, err := exif.Decode(strings.NewReader(body))
+	if err != nil {
+		return 1
+	}
+
+	tag, err := x.Get(exif.Orientation)
+	if err != nil {
+		return 1
+	}
+
+	orientation, err := tag.Int(0)
+	if err != nil || orientation < 1 || orientation > 8 {
+		return 1
+	}
+
+	return orientation
+}
+
+// Rotate and flip the image so that it is upright for the given EXIF
+// orientation. The result no longer needs an orientation tag.
+func applyOrientation(m image.Image, orientation int) image.Image {
+	if orientation <= 1 || orientation > 8 {
+		return m
+	}
+
+	bounds := m.Bounds()
+	w, h := bounds.Dx(), bounds.Dy()
+
+	// Orientations 5 to 8 swap the width and the height
+	dw, dh := w, h
+	if orientation >= 5 {
+		dw, dh = h, w
+	}
+
+	img := image.NewRGBA(image.Rect(0, 0, dw, dh))
+	for y := 0; y < dh; y++ {
+		for x := 0; x < dw; x++ {
+			// Get the source pixel for this destination pixel.
+			var sx, sy int
+			switch orientation {
+			case 2: // flip horizontal
+				sx, sy = w-1-x, y
+			case 3: // rotate 180
+				sx, sy = w-1-x, h-1-y
+			case 4: // flip vertical
+				sx, sy = x, h-1-y
+			case 5: // transpose
+				sx, sy = y, x
+			case 6: // rotate 90 clockwise
+				sx, sy = y, h-1-x
+			case 7: // transverse
+				sx, sy = w-1-y, h-1-x
+			case 8: // rotate 90 counter-clockwise
+				sx, sy = w-1-y, x
+			}
+			img.Set(x, y, m.At(bounds.Min.X+sx, bounds.Min.Y+sy))
+		}
+	}
+
+	return img
+}
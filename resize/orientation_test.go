@@ -0,0 +1,66 @@
+package resize
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/jpeg"
+	"testing"
+)
+
+// Check that a color is close to another one, despite the JPEG compression
+func isClose(c color.Color, want color.NRGBA) bool {
+	r, g, b, _ := c.RGBA()
+	return abs(int(r>>8)-int(want.R)) < 40 && abs(int(g>>8)-int(want.G)) < 40 && abs(int(b>>8)-int(want.B)) < 40
+}
+
+func TestResizeSidewaysJPEG(t *testing.T) {
+	// Stored sideways: the left half is the top of the photo
+	red, blue := color.NRGBA{255, 0, 0, 255}, color.NRGBA{0, 0, 255, 255}
+	m := image.NewNRGBA(image.Rect(0, 0, 80, 40))
+	draw.Draw(m, image.Rect(0, 0, 40, 40), image.NewUniform(red), image.Point{}, draw.Src)
+	draw.Draw(m, image.Rect(40, 0, 80, 40), image.NewUniform(blue), image.Point{}, draw.Src)
+	var buf bytes.Buffer
+	jpeg.Encode(&buf, m, &jpeg.Options{Quality: 95})
+
+	if orientation := readOrientation(string(withOrientation(buf.Bytes(), 6))); orientation != 6 {
+		t.Fatalf("orientation = %d, want 6", orientation)
+	}
+
+	s := newTestServer(Config{MaxPixels: 1 << 20}, newMemoryCache())
+	_, body := resizeFrom(t, s, "image/jpeg", withOrientation(buf.Bytes(), 6), ResizeOptions{Width: 20, Height: 40, Quality: 95})
+	resized := decodeImage(t, body, "jpeg")
+	if resized.Bounds().Dx() != 20 || resized.Bounds().Dy() != 40 {
+		t.Fatalf("size = %v, want 20x40", resized.Bounds())
+	}
+	if c := resized.At(10, 5); !isClose(c, red) {
+		t.Errorf("top = %v, want red", c)
+	}
+	if c := resized.At(10, 35); !isClose(c, blue) {
+		t.Errorf("bottom = %v, want blue", c)
+	}
+	if readOrientation(string(body)) != 1 {
+		t.Error("the orientation tag was kept")
+	}
+}
+
+func TestApplyOrientation(t *testing.T) {
+	m := image.NewNRGBA(image.Rect(0, 0, 3, 2))
+	m.Set(0, 0, color.White)
+
+	// Where the top left pixel goes, for each orientation
+	corners := map[int]image.Point{
+		1: {0, 0}, 2: {2, 0}, 3: {2, 1}, 4: {0, 1},
+		5: {0, 0}, 6: {1, 0}, 7: {1, 2}, 8: {0, 2},
+	}
+	for orientation, corner := range corners {
+		upright := applyOrientation(m, orientation)
+		if orientation >= 5 && (upright.Bounds().Dx() != 2 || upright.Bounds().Dy() != 3) {
+			t.Errorf("%d: size = %v, want 2x3", orientation, upright.Bounds())
+		}
+		if r, _, _, _ := upright.At(corner.X, corner.Y).RGBA(); r != 0xffff {
+			t.Errorf("%d: the top left pixel is not at %v", orientation, corner)
+		}
+	}
+}
@@ -0,0 +1,453 @@
+package resize
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+)
+
+// The error returned for the JPEG images that can't be made progressive,
+// such as the ones already progressive or with restart intervals
+var errUnsupportedJPEG = errors.New("Unsupported JPEG")
+
+// A Huffman table of a JPEG image, as defined by a DHT segment
+type huffmanTable struct {
+	// The first and last codes of each length, and the index of the symbol
+	// of the first one
+	minCode, maxCode, index [17]int
+	symbols                 []byte
+
+	// The code and its length for each symbol, for encoding
+	codes   [256]uint16
+	lengths [256]uint8
+}
+
+// A component of a JPEG image, and its quantized coefficients in zigzag
+// order, block by block
+type jpegComponent struct {
+	id          byte
+	h, v        int
+	dcTable     int
+	acTable     int
+	blocksWide  int // the blocks covering the component, without the padding of the MCUs
+	blocksHigh  int
+	stride      int // the blocks of a row, including the padding of the MCUs
+	coefficient [][64]int32
+}
+
+// Convert a baseline JPEG image into a progressive one, without loss as the
+// coefficients are kept: the DC coefficients of all the components are sent
+// first, then the AC ones of each component
+func progressiveJPEG(body []byte) ([]byte, error) {
+	if len(body) < 4 || body[0] != 0xff || body[1] != 0xd8 {
+		return nil, errUnsupportedJPEG
+	}
+
+	out := bytes.NewBuffer(make([]byte, 0, len(body)+512))
+	out.Write(body[:2])
+
+	var tables [2][4]*huffmanTable
+	var components []*jpegComponent
+	var width, height, hmax, vmax int
+	for i := 2; ; {
+		if i+4 > len(body) || body[i] != 0xff {
+			return nil, errUnsupportedJPEG
+		}
+		marker := body[i+1]
+		if marker == 0xff {
+			// A fill byte before a marker
+			i++
+			continue
+		}
+		if marker == 0x01 || (marker >= 0xd0 && marker <= 0xd9) {
+			// Only expected in or after a scan
+			return nil, errUnsupportedJPEG
+		}
+		length := int(binary.BigEndian.Uint16(body[i+2:]))
+		end := i + 2 + length
+		if length < 2 || end > len(body) {
+			return nil, errUnsupportedJPEG
+		}
+		segment := body[i+4 : end]
+
+		switch marker {
+		case 0xc0, 0xc1:
+			// Baseline or extended sequential, with Huffman coding
+			if components != nil || len(segment) < 6 || segment[0] != 8 {
+				return nil, errUnsupportedJPEG
+			}
+			height = int(binary.BigEndian.Uint16(segment[1:]))
+			width = int(binary.BigEndian.Uint16(segment[3:]))
+			n := int(segment[5])
+			if width == 0 || height == 0 || n == 0 || len(segment) < 6+3*n {
+				return nil, errUnsupportedJPEG
+			}
+			for c := 0; c < n; c++ {
+				s := segment[6+3*c:]
+				comp := &jpegComponent{id: s[0], h: int(s[1] >> 4), v: int(s[1] & 15)}
+				if comp.h < 1 || comp.h > 4 || comp.v < 1 || comp.v > 4 {
+					return nil, errUnsupportedJPEG
+				}
+				hmax, vmax = maxInt(hmax, comp.h), maxInt(vmax, comp.v)
+				components = append(components, comp)
+			}
+			out.Write(body[i:end])
+			out.Bytes()[out.Len()-length-1] = 0xc2
+		case 0xc4:
+			for s := segment; len(s) > 0; {
+				class, id := int(s[0]>>4), int(s[0]&15)
+				if class > 1 || id > 3 || len(s) < 17 {
+					return nil, errUnsupportedJPEG
+				}
+				table, n, err := newHuffmanTable(s[1:17], s[17:])
+				if err != nil {
+					return nil, err
+				}
+				tables[class][id] = table
+				s = s[17+n:]
+			}
+			out.Write(body[i:end])
+		case 0xda:
+			if components == nil {
+				return nil, errUnsupportedJPEG
+			}
+			// Each block takes at least 2 bits: don't trust the size of a
+			// truncated or corrupted image
+			mcusWide := (width + 8*hmax - 1) / (8 * hmax)
+			mcusHigh := (height + 8*vmax - 1) / (8 * vmax)
+			blocks := 0
+			for _, comp := range components {
+				blocks += mcusWide * comp.h * mcusHigh * comp.v
+			}
+			if blocks > 4*(len(body)-end) {
+				return nil, errUnsupportedJPEG
+			}
+			for _, comp := range components {
+				comp.stride = mcusWide * comp.h
+				comp.coefficient = make([][64]int32, comp.stride*mcusHigh*comp.v)
+				comp.blocksWide = ((width*comp.h+hmax-1)/hmax + 7) / 8
+				comp.blocksHigh = ((height*comp.v+vmax-1)/vmax + 7) / 8
+			}
+			if err := decodeBaselineScan(body[i+2:end], body[end:], components, tables); err != nil {
+				return nil, err
+			}
+			if err := encodeProgressiveScans(out, components, tables); err != nil {
+				return nil, err
+			}
+			out.Write([]byte{0xff, 0xd9})
+			return out.Bytes(), nil
+		case 0xc2, 0xc3, 0xc5, 0xc6, 0xc7, 0xc9, 0xca, 0xcb, 0xcd, 0xce, 0xcf, 0xdd:
+			// Already progressive, lossless, arithmetic coding or restarts
+			return nil, errUnsupportedJPEG
+		default:
+			out.Write(body[i:end])
+		}
+		i = end
+	}
+}
+
+// Build a Huffman table from the number of codes of each length and their
+// symbols, and return the number of symbols read
+func newHuffmanTable(counts, symbols []byte) (*huffmanTable, int, error) {
+	t := &huffmanTable{}
+	n := 0
+	for _, count := range counts {
+		n += int(count)
+	}
+	if n > len(symbols) || n > 256 {
+		return nil, 0, errUnsupportedJPEG
+	}
+	t.symbols = symbols[:n]
+
+	code, k := 0, 0
+	for length := 1; length <= 16; length++ {
+		count := int(counts[length-1])
+		t.index[length] = k
+		t.minCode[length] = code
+		t.maxCode[length] = code + count - 1
+		for j := 0; j < count; j++ {
+			t.codes[t.symbols[k]] = uint16(code)
+			t.lengths[t.symbols[k]] = uint8(length)
+			code++
+			k++
+		}
+		code <<= 1
+	}
+	return t, n, nil
+}
+
+// Read the entropy-coded data of a JPEG scan, skipping the stuffed bytes
+type jpegBitReader struct {
+	data  []byte
+	pos   int
+	bits  uint32
+	nbits int
+}
+
+// Read a bit, or fail at the end of the scan
+func (r *jpegBitReader) bit() (int, error) {
+	if r.nbits == 0 {
+		if r.pos >= len(r.data) {
+			return 0, errUnsupportedJPEG
+		}
+		b := r.data[r.pos]
+		if b == 0xff {
+			if r.pos+1 >= len(r.data) || r.data[r.pos+1] != 0 {
+				return 0, errUnsupportedJPEG
+			}
+			r.pos++
+		}
+		r.pos++
+		r.bits, r.nbits = uint32(b), 8
+	}
+	r.nbits--
+	return int(r.bits>>uint(r.nbits)) & 1, nil
+}
+
+// Read a value of n bits, and extend its sign as the coefficients are coded
+func (r *jpegBitReader) receive(n int) (int32, error) {
+	v := 0
+	for j := 0; j < n; j++ {
+		b, err := r.bit()
+		if err != nil {
+			return 0, err
+		}
+		v = v<<1 | b
+	}
+	if n > 0 && v < 1<<uint(n-1) {
+		v += -1<<uint(n) + 1
+	}
+	return int32(v), nil
+}
+
+// Decode a symbol with a Huffman table
+func (r *jpegBitReader) decode(t *huffmanTable) (byte, error) {
+	code := 0
+	for length := 1; length <= 16; length++ {
+		b, err := r.bit()
+		if err != nil {
+			return 0, err
+		}
+		code = code<<1 | b
+		if code <= t.maxCode[length] && code >= t.minCode[length] {
+			return t.symbols[t.index[length]+code-t.minCode[length]], nil
+		}
+	}
+	return 0, errUnsupportedJPEG
+}
+
+// Decode the coefficients of the scan of a baseline JPEG image, from its
+// header and the data following it
+func decodeBaselineScan(header, data []byte, components []*jpegComponent, tables [2][4]*huffmanTable) error {
+	if len(header) < 3 {
+		return errUnsupportedJPEG
+	}
+	n := int(header[2])
+	if n != len(components) || len(header) < 3+2*n+3 {
+		return errUnsupportedJPEG
+	}
+	for c := 0; c < n; c++ {
+		// In the order of the frame
+		s, comp := header[3+2*c:], components[c]
+		if comp.id != s[0] {
+			return errUnsupportedJPEG
+		}
+		comp.dcTable, comp.acTable = int(s[1]>>4), int(s[1]&15)
+		if comp.dcTable > 3 || comp.acTable > 3 || tables[0][comp.dcTable] == nil || tables[1][comp.acTable] == nil {
+			return errUnsupportedJPEG
+		}
+	}
+
+	r := &jpegBitReader{data: data}
+	return forEachBlock(components, true, func(comp *jpegComponent, block *[64]int32, pred *int32) error {
+		size, err := r.decode(tables[0][comp.dcTable])
+		if err != nil {
+			return err
+		}
+		diff, err := r.receive(int(size))
+		if err != nil {
+			return err
+		}
+		*pred += diff
+		block[0] = *pred
+
+		for k := 1; k < 64; k++ {
+			rs, err := r.decode(tables[1][comp.acTable])
+			if err != nil {
+				return err
+			}
+			run, size := int(rs>>4), int(rs&15)
+			if size == 0 {
+				// The other runs without a coefficient are only valid in
+				// progressive scans, and the decoders don't agree on them
+				if run == 0 {
+					break
+				} else if run != 15 {
+					return errUnsupportedJPEG
+				}
+				k += 15
+				continue
+			}
+			k += run
+			if k > 63 {
+				return errUnsupportedJPEG
+			}
+			if block[k], err = r.receive(size); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Write the scans of a progressive JPEG image: one with the DC coefficients
+// of all the components, then one with the AC coefficients of each
+func encodeProgressiveScans(out *bytes.Buffer, components []*jpegComponent, tables [2][4]*huffmanTable) error {
+	header := []byte{0xff, 0xda, 0, byte(6 + 2*len(components)), byte(len(components))}
+	for _, comp := range components {
+		header = append(header, comp.id, byte(comp.dcTable<<4))
+	}
+	out.Write(append(header, 0, 0, 0))
+
+	w := &jpegBitWriter{out: out}
+	forEachBlock(components, true, func(comp *jpegComponent, block *[64]int32, pred *int32) error {
+		diff := block[0] - *pred
+		*pred = block[0]
+		size := bitSize(diff)
+		w.encode(tables[0][comp.dcTable], byte(size))
+		w.emit(diff, size)
+		return nil
+	})
+	w.flush()
+
+	for _, comp := range components {
+		out.Write([]byte{0xff, 0xda, 0, 8, 1, comp.id, byte(comp.acTable), 1, 63, 0})
+		table := tables[1][comp.acTable]
+		forEachBlock([]*jpegComponent{comp}, false, func(comp *jpegComponent, block *[64]int32, pred *int32) error {
+			run := 0
+			for k := 1; k < 64; k++ {
+				if block[k] == 0 {
+					run++
+					continue
+				}
+				for ; run > 15; run -= 16 {
+					w.encode(table, 0xf0)
+				}
+				size := bitSize(block[k])
+				w.encode(table, byte(run<<4|size))
+				w.emit(block[k], size)
+				run = 0
+			}
+			if run > 0 {
+				w.encode(table, 0x00)
+			}
+			return nil
+		})
+		w.flush()
+	}
+	return w.err
+}
+
+// Call f on the blocks of the components in the order of a scan: MCU by MCU
+// if interleaved, or else the blocks covering the component row by row. pred
+// is the DC predictor of the component of the block.
+func forEachBlock(components []*jpegComponent, interleaved bool, f func(comp *jpegComponent, block *[64]int32, pred *int32) error) error {
+	preds := make([]int32, len(components))
+
+	if len(components) == 1 || !interleaved {
+		for c, comp := range components {
+			for y := 0; y < comp.blocksHigh; y++ {
+				for x := 0; x < comp.blocksWide; x++ {
+					if err := f(comp, &comp.coefficient[y*comp.stride+x], &preds[c]); err != nil {
+						return err
+					}
+				}
+			}
+		}
+		return nil
+	}
+
+	first := components[0]
+	mcusWide, mcusHigh := first.stride/first.h, len(first.coefficient)/first.stride/first.v
+	for my := 0; my < mcusHigh; my++ {
+		for mx := 0; mx < mcusWide; mx++ {
+			for c, comp := range components {
+				for v := 0; v < comp.v; v++ {
+					for h := 0; h < comp.h; h++ {
+						i := (my*comp.v+v)*comp.stride + mx*comp.h + h
+						if err := f(comp, &comp.coefficient[i], &preds[c]); err != nil {
+							return err
+						}
+					}
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// Write the entropy-coded data of a JPEG scan, stuffing the 0xff bytes
+type jpegBitWriter struct {
+	out   *bytes.Buffer
+	bits  uint32
+	nbits int
+	err   error // set if a symbol has no code
+}
+
+// Write the n low bits of v
+func (w *jpegBitWriter) write(v uint32, n int) {
+	for j := n - 1; j >= 0; j-- {
+		w.bits = w.bits<<1 | (v>>uint(j))&1
+		w.nbits++
+		if w.nbits == 8 {
+			w.out.WriteByte(byte(w.bits))
+			if byte(w.bits) == 0xff {
+				w.out.WriteByte(0)
+			}
+			w.bits, w.nbits = 0, 0
+		}
+	}
+}
+
+// Write the code of a symbol
+func (w *jpegBitWriter) encode(t *huffmanTable, symbol byte) {
+	if t.lengths[symbol] == 0 {
+		w.err = errUnsupportedJPEG
+	}
+	w.write(uint32(t.codes[symbol]), int(t.lengths[symbol]))
+}
+
+// Write a coefficient in size bits, the negative ones minus one
+func (w *jpegBitWriter) emit(v int32, size int) {
+	if v < 0 {
+		v--
+	}
+	w.write(uint32(v), size)
+}
+
+// Pad the last byte with ones
+func (w *jpegBitWriter) flush() {
+	if w.nbits > 0 {
+		w.write(0xff, 8-w.nbits)
+	}
+}
+
+// Return the number of bits of the magnitude of a coefficient
+func bitSize(v int32) int {
+	if v < 0 {
+		v = -v
+	}
+	size := 0
+	for ; v > 0; v >>= 1 {
+		size++
+	}
+	return size
+}
+
+// Return the largest of two integers
+func maxInt(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
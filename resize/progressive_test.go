@@ -0,0 +1,179 @@
+package resize
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"image"
+	"image/jpeg"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// The JPEG images of the Go distribution (src/image/testdata), baseline
+// unless stated otherwise, with whether they can be made progressive
+var jpegCorpus = []struct {
+	name        string
+	fill        bool // with fill bytes before a marker
+	progressive bool
+}{
+	{"video-001.jpeg", false, true},
+	{"video-001.q50.420.jpeg", false, true},
+	{"video-001.q50.422.jpeg", false, true},
+	{"video-001.q50.440.jpeg", false, true},
+	{"video-001.q50.444.jpeg", false, true},
+	{"video-001.q50.411.jpeg", false, true},
+	{"video-001.q50.410.jpeg", false, true},
+	{"video-001.q50.121121.jpeg", false, true},
+	{"video-001.q50.211211.jpeg", false, true},
+	{"video-001.q50.221122.jpeg", false, true},
+	{"video-001.q50.222112.jpeg", false, true},
+	{"video-001.221212.jpeg", false, true},
+	{"video-001.cmyk.jpeg", false, true},
+	{"video-001.rgb.jpeg", false, true},
+	{"video-005.gray.jpeg", false, true},
+	{"video-005.gray.q50.jpeg", false, true},
+	{"video-005.gray.q50.2x2.jpeg", false, true},
+	{"video-001.q50.420.jpeg", true, true},
+
+	// With restart markers, or already progressive
+	{"video-001.restart2.jpeg", false, false},
+	{"video-001.progressive.jpeg", false, false},
+	{"video-001.separate.dc.progression.jpeg", false, false},
+}
+
+func TestProgressiveJPEGCorpus(t *testing.T) {
+	for _, test := range jpegCorpus {
+		t.Run(test.name, func(t *testing.T) {
+			body, err := os.ReadFile(filepath.Join("testdata", test.name))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if test.fill {
+				// Fill bytes before the segment following the first one
+				i := 4 + int(binary.BigEndian.Uint16(body[4:]))
+				body = append(body[:i:i], append([]byte{0xff, 0xff}, body[i:]...)...)
+			}
+
+			progressive, err := progressiveJPEG(body)
+			if !test.progressive {
+				if err != errUnsupportedJPEG {
+					t.Errorf("err = %v, want %v", err, errUnsupportedJPEG)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if marker := jpegFrameMarker(progressive); marker != 0xc2 {
+				t.Errorf("start of frame = %#x, want 0xc2", marker)
+			}
+			if err := sameJPEGPixels(body, progressive); err != "" {
+				t.Error(err)
+			}
+		})
+	}
+}
+
+// The runs of zeros without a coefficient, other than the ones of 16 zeros
+// or up to the end of the block, are decoded differently by the decoders
+func TestProgressiveJPEGInvalidRuns(t *testing.T) {
+	body, err := os.ReadFile(filepath.Join("testdata", "video-005.gray.q50.jpeg"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Code a coefficient after 6 zeros as a run of 9 zeros in the AC table
+	for i := 2; body[i+1] != 0xda; i += 2 + int(binary.BigEndian.Uint16(body[i+2:])) {
+		if body[i+1] == 0xc4 && body[i+4]>>4 == 1 {
+			symbols := body[i+21 : i+2+int(binary.BigEndian.Uint16(body[i+2:]))]
+			symbols[bytes.IndexByte(symbols, 0x61)] = 0x90
+		}
+	}
+	if _, err := jpeg.Decode(bytes.NewReader(body)); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := progressiveJPEG(body); err != errUnsupportedJPEG {
+		t.Errorf("err = %v, want %v", err, errUnsupportedJPEG)
+	}
+}
+
+// The originals that can't be made progressive are passed through as they
+// are
+func TestProgressiveJPEGFallback(t *testing.T) {
+	body, err := os.ReadFile(filepath.Join("testdata", "video-001.restart2.jpeg"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := newTestServer(Config{MaxPixels: 1 << 20}, newMemoryCache())
+	opts := ResizeOptions{Width: 200, Height: 200, Quality: defaultQuality, Progressive: true, KeepMetadata: true}
+	_, resized, err := s.resizeImage(context.Background(), "", string(body), Headers{}, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(resized, body) {
+		t.Error("the original is not passed through")
+	}
+}
+
+func FuzzProgressiveJPEG(f *testing.F) {
+	for _, test := range jpegCorpus {
+		body, err := os.ReadFile(filepath.Join("testdata", test.name))
+		if err != nil {
+			f.Fatal(err)
+		}
+		f.Add(body)
+	}
+	var buf bytes.Buffer
+	jpeg.Encode(&buf, gradient(33, 17), nil)
+	f.Add(buf.Bytes())
+
+	f.Fuzz(func(t *testing.T, body []byte) {
+		progressive, err := progressiveJPEG(body)
+		if err != nil {
+			return
+		}
+		// The images that can't be decoded may stay so, and the large ones
+		// take too long to decode
+		config, err := jpeg.DecodeConfig(bytes.NewReader(body))
+		if err != nil || config.Width*config.Height > 1<<20 {
+			return
+		}
+		if _, err := jpeg.Decode(bytes.NewReader(body)); err != nil {
+			return
+		}
+		if err := sameJPEGPixels(body, progressive); err != "" {
+			t.Error(err)
+		}
+	})
+}
+
+// Decode a baseline JPEG image and its progressive version, and describe
+// how they differ, if they do
+func sameJPEGPixels(baseline, progressive []byte) string {
+	want, err := jpeg.Decode(bytes.NewReader(baseline))
+	if err != nil {
+		return "invalid baseline image: " + err.Error()
+	}
+	got, err := jpeg.Decode(bytes.NewReader(progressive))
+	if err != nil {
+		return "invalid progressive image: " + err.Error()
+	}
+	if got.Bounds() != want.Bounds() {
+		return "size = " + got.Bounds().String() + ", want " + want.Bounds().String()
+	}
+	if got.ColorModel() != want.ColorModel() {
+		return "the color model has changed"
+	}
+	bounds := want.Bounds()
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			if got.At(x, y) != want.At(x, y) {
+				return "the pixels have changed at " + image.Pt(x, y).String()
+			}
+		}
+	}
+	return ""
+}
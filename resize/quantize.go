@@ -0,0 +1,154 @@
+package resize
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+	"sort"
+)
+
+// A box of colors of the median cut, with the number of pixels of each color
+type colorBox struct {
+	colors []color.RGBA
+	counts []int
+}
+
+// Return the channel with the widest range of values in the box, and this range
+func (b *colorBox) widestChannel() (channel int, width int) {
+	for c := 0; c < 4; c++ {
+		min, max := 255, 0
+		for _, col := range b.colors {
+			v := int(channelOf(col, c))
+			if v < min {
+				min = v
+			}
+			if v > max {
+				max = v
+			}
+		}
+		if max-min > width {
+			channel, width = c, max-min
+		}
+	}
+	return
+}
+
+// Return the weighted average color of the box
+func (b *colorBox) average() color.Color {
+	var sum [4]int
+	total := 0
+	for i, col := range b.colors {
+		n := b.counts[i]
+		sum[0] += int(col.R) * n
+		sum[1] += int(col.G) * n
+		sum[2] += int(col.B) * n
+		sum[3] += int(col.A) * n
+		total += n
+	}
+	return color.RGBA{uint8(sum[0] / total), uint8(sum[1] / total), uint8(sum[2] / total), uint8(sum[3] / total)}
+}
+
+// Split the box at the weighted median of its widest channel
+func (b *colorBox) split() (*colorBox, *colorBox) {
+	channel, _ := b.widestChannel()
+
+	indexes := make([]int, len(b.colors))
+	for i := range indexes {
+		indexes[i] = i
+	}
+	sort.Slice(indexes, func(i, j int) bool {
+		return channelOf(b.colors[indexes[i]], channel) < channelOf(b.colors[indexes[j]], channel)
+	})
+
+	total := 0
+	for _, n := range b.counts {
+		total += n
+	}
+
+	lo, hi := &colorBox{}, &colorBox{}
+	seen := 0
+	for k, i := range indexes {
+		// Keep at least one color on each side
+		if (seen < total/2 && k < len(indexes)-1) || k == 0 {
+			lo.colors = append(lo.colors, b.colors[i])
+			lo.counts = append(lo.counts, b.counts[i])
+		} else {
+			hi.colors = append(hi.colors, b.colors[i])
+			hi.counts = append(hi.counts, b.counts[i])
+		}
+		seen += b.counts[i]
+	}
+	return lo, hi
+}
+
+func channelOf(c color.RGBA, channel int) uint8 {
+	switch channel {
+	case 0:
+		return c.R
+	case 1:
+		return c.G
+	case 2:
+		return c.B
+	}
+	return c.A
+}
+
+// Compute a palette of at most n colors for the image with a median cut
+func medianCut(m image.Image, n int) color.Palette {
+	histogram := map[color.RGBA]int{}
+	bounds := m.Bounds()
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			histogram[color.RGBAModel.Convert(m.At(x, y)).(color.RGBA)]++
+		}
+	}
+
+	box := &colorBox{}
+	for c, count := range histogram {
+		box.colors = append(box.colors, c)
+		box.counts = append(box.counts, count)
+	}
+
+	// Few enough colors to keep them all
+	if len(box.colors) <= n {
+		p := make(color.Palette, len(box.colors))
+		for i, c := range box.colors {
+			p[i] = c
+		}
+		return p
+	}
+
+	boxes := []*colorBox{box}
+	for len(boxes) < n {
+		// Split the box with the widest range
+		best, bestWidth := -1, 0
+		for i, b := range boxes {
+			if len(b.colors) < 2 {
+				continue
+			}
+			if _, width := b.widestChannel(); width > bestWidth {
+				best, bestWidth = i, width
+			}
+		}
+		if best < 0 {
+			break
+		}
+		lo, hi := boxes[best].split()
+		boxes[best] = lo
+		boxes = append(boxes, hi)
+	}
+
+	p := make(color.Palette, len(boxes))
+	for i, b := range boxes {
+		p[i] = b.average()
+	}
+	return p
+}
+
+// Quantize the image to a paletted image of at most n colors
+func quantize(m image.Image, n int) *image.Paletted {
+	bounds := m.Bounds()
+	p := image.NewPaletted(bounds, medianCut(m, n))
+	draw.FloydSteinberg.Draw(p, bounds, m, bounds.Min)
+	return p
+}
@@ -0,0 +1,71 @@
+package resize
+
+import (
+	"context"
+	"golang.org/x/time/rate"
+	"net/url"
+	"time"
+)
+
+// How long a fetch waits for its turn when its host is over the rate limit
+const fetchRateWait = time.Second
+
+// The number of hosts beyond which the idle limiters are forgotten
+const maxFetchLimiters = 10000
+
+// Return the limiter of the fetches on the host of an URL, or nil if they
+// are not limited
+func (s *Server) fetchLimiter(uri string) *rate.Limiter {
+	if s.config.FetchRate <= 0 {
+		return nil
+	}
+
+	u, err := url.Parse(uri)
+	if err != nil {
+		return nil
+	}
+	host := u.Hostname()
+
+	s.fetchLimitersMu.Lock()
+	defer s.fetchLimitersMu.Unlock()
+
+	limiter, ok := s.fetchLimiters[host]
+	if ok {
+		return limiter
+	}
+
+	if len(s.fetchLimiters) >= maxFetchLimiters {
+		for h, l := range s.fetchLimiters {
+			if l.Tokens() >= float64(l.Burst()) {
+				delete(s.fetchLimiters, h)
+			}
+		}
+	}
+
+	burst := s.config.FetchBurst
+	if burst <= 0 {
+		burst = 1
+	}
+	limiter = rate.NewLimiter(rate.Limit(s.config.FetchRate), burst)
+	s.fetchLimiters[host] = limiter
+	return limiter
+}
+
+// Wait for the turn of a fetch on the host of an URL, failing if it doesn't
+// come quickly
+func (s *Server) waitFetchTurn(ctx context.Context, uri string) error {
+	limiter := s.fetchLimiter(uri)
+	if limiter == nil {
+		return nil
+	}
+
+	waitCtx, cancel := context.WithTimeout(ctx, fetchRateWait)
+	defer cancel()
+	if err := limiter.Wait(waitCtx); err != nil {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		return errRateLimited
+	}
+	return nil
+}
@@ -0,0 +1,191 @@
+package resize
+
+import (
+	"errors"
+	"github.com/fzzy/radix/redis"
+	"io"
+	"log/slog"
+	"net"
+	"net/url"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The delays between the attempts to reconnect to redis double up to a minute
+const minRedisBackoff = 100 * time.Millisecond
+const maxRedisBackoff = time.Minute
+
+// The number of connections to redis by default, per processor: the commands
+// are short, but the goroutines serving the requests wait on them
+const redisConnsPerProc = 2
+
+// The error returned while waiting to reconnect to redis
+var errRedisUnavailable = errors.New("Redis unavailable")
+
+// A connection to redis, reconnecting with an exponential backoff when it
+// is lost. The commands fail fast while waiting to reconnect, so that the
+// caches treat them as misses.
+type RedisConn struct {
+	config redis.Config
+
+	mu       sync.Mutex
+	client   *redis.Client
+	failures int
+	retryAt  time.Time
+}
+
+// Return the size of the pool of connections to redis by default, sized
+// for the number of goroutines running at once
+func DefaultRedisPoolCapacity() int {
+	capacity := redisConnsPerProc * runtime.GOMAXPROCS(0)
+	if capacity < 4 {
+		capacity = 4
+	}
+	return capacity
+}
+
+// Parse the redis database to use, either as host:port/db or as an URL like
+// redis://:password@host:port/db. The redis client can neither connect with
+// TLS nor authenticate with a username, so rediss:// URLs and usernames are
+// rejected rather than ignored.
+func ParseRedisURL(conn string) (cfg redis.Config, err error) {
+	if !strings.Contains(conn, "://") {
+		parts := strings.Split(conn, "/")
+		cfg.Address = parts[0]
+		if len(parts) >= 2 {
+			cfg.Database, _ = strconv.Atoi(parts[1])
+		}
+		return
+	}
+
+	u, err := url.Parse(conn)
+	if err != nil {
+		return
+	}
+	switch u.Scheme {
+	case "redis":
+	case "rediss":
+		err = errors.New("TLS is not supported by the redis client")
+		return
+	default:
+		err = errors.New("Unknown scheme " + u.Scheme)
+		return
+	}
+
+	if u.User.Username() != "" {
+		err = errors.New("Usernames are not supported by the redis client")
+		return
+	}
+
+	cfg.Address = u.Host
+	if u.Port() == "" {
+		cfg.Address = net.JoinHostPort(u.Hostname(), "6379")
+	}
+	if password, ok := u.User.Password(); ok {
+		cfg.Password = password
+	}
+	if db := strings.TrimPrefix(u.Path, "/"); db != "" {
+		cfg.Database, err = strconv.Atoi(db)
+	}
+	return
+}
+
+// Create a connection to redis
+func NewRedisConn(config redis.Config) *RedisConn {
+	if config.PoolCapacity <= 0 {
+		config.PoolCapacity = DefaultRedisPoolCapacity()
+	}
+	redisPoolCapacity.Set(float64(config.PoolCapacity))
+	return &RedisConn{config: config, client: redis.NewClient(config)}
+}
+
+// Run a command on redis
+func (c *RedisConn) Call(cmd string, args ...interface{}) *redis.Reply {
+	client, err := c.get()
+	if err != nil {
+		return &redis.Reply{Type: redis.ErrorReply, Err: err}
+	}
+
+	redisCommandsInFlight.Inc()
+	reply := client.Call(cmd, args...)
+	redisCommandsInFlight.Dec()
+	if isConnectionError(reply.Err) {
+		c.fail(client, reply.Err)
+	} else {
+		c.succeed()
+	}
+	return reply
+}
+
+// Close the connection
+func (c *RedisConn) Close() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.client != nil {
+		c.client.Close()
+		c.client = nil
+	}
+}
+
+// Return the client, reconnecting if the delay since the last failure is over
+func (c *RedisConn) get() (*redis.Client, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.client == nil {
+		if time.Now().Before(c.retryAt) {
+			return nil, errRedisUnavailable
+		}
+		slog.Info("Reconnecting to redis", "address", c.config.Address, "attempt", c.failures)
+		redisReconnects.Inc()
+		c.client = redis.NewClient(c.config)
+	}
+	return c.client, nil
+}
+
+// Drop a client that lost its connection, and wait before reconnecting
+func (c *RedisConn) fail(client *redis.Client, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	// Another command may have already dropped it
+	if c.client != client {
+		return
+	}
+	client.Close()
+	c.client = nil
+
+	backoff := maxRedisBackoff
+	if c.failures < 10 {
+		backoff = minRedisBackoff << uint(c.failures)
+		if backoff > maxRedisBackoff {
+			backoff = maxRedisBackoff
+		}
+	}
+	c.failures++
+	c.retryAt = time.Now().Add(backoff)
+	slog.Warn("Lost connection to redis", "error", err, "retry_in", backoff)
+}
+
+// Reset the backoff once a command succeeds
+func (c *RedisConn) succeed() {
+	c.mu.Lock()
+	c.failures = 0
+	c.mu.Unlock()
+}
+
+// Check if an error means that the connection to redis is lost, rather
+// than being returned by redis for the command
+func isConnectionError(err error) bool {
+	if err == nil {
+		return false
+	}
+	if _, ok := err.(net.Error); ok {
+		return true
+	}
+	return errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF)
+}
@@ -2,7 +2,7 @@
 // Use of this source code is governed by a BSD-style
 // license that can be found in the LICENSE file.
 
-package main
+package resize
 
 import (
 	"image"
@@ -235,7 +235,7 @@ func Resample(m image.Image, r image.Rectangle, w, h int) image.Image {
                         // Get a source pixel.
                         subx := x * curw / w
                         suby := y * curh / h
-                        r32, g32, b32, a32 := m.At(subx, suby).RGBA()
+                        r32, g32, b32, a32 := m.At(r.Min.X+subx, r.Min.Y+suby).RGBA()
                         r := uint8(r32 >> 8)
                         g := uint8(g32 >> 8)
                         b := uint8(b32 >> 8)
@@ -0,0 +1,144 @@
+package resize
+
+import (
+	"bytes"
+	"context"
+	"github.com/minio/minio-go/v7"
+	"io/ioutil"
+	"log/slog"
+	"time"
+)
+
+// The cache storing the images in an S3-compatible bucket, with the
+// headers as object metadata, and the errors in redis
+type S3Cache struct {
+	redisErrors
+
+	// The client of the object storage
+	client *minio.Client
+
+	// The bucket for caching objects
+	bucket string
+}
+
+// Create a cache storing its objects in bucket, and the errors in redis
+// under keys starting with prefix
+func NewS3Cache(client *minio.Client, bucket string, connection *RedisConn, prefix string) *S3Cache {
+	return &S3Cache{redisErrors: redisErrors{connection, prefix, DefaultMaxErrors}, client: client, bucket: bucket}
+}
+
+// Fetch image from the bucket
+func (c *S3Cache) Get(key string) (headers Headers, body []byte, ok bool) {
+	obj, err := c.client.GetObject(context.Background(), c.bucket, hashKey(key, defaultShardingDepth), minio.GetObjectOptions{})
+	if err != nil {
+		return
+	}
+	defer obj.Close()
+
+	// A missing object is only reported when reading it
+	info, err := obj.Stat()
+	if err != nil {
+		return
+	}
+
+	body, err = ioutil.ReadAll(obj)
+	if err != nil {
+		return
+	}
+
+	headers.ContentType = info.ContentType
+	headers.CacheControl = info.Metadata.Get("Cache-Control")
+	headers.ETag = info.Metadata.Get("X-Amz-Meta-Etag")
+	headers.FetchedAt = info.LastModified
+	headers.LastModified = info.Metadata.Get("X-Amz-Meta-Last-Modified")
+	if headers.LastModified == "" {
+		headers.LastModified = info.LastModified.Format(time.RFC1123)
+	}
+	ok = true
+
+	return
+}
+
+// Save the body in the bucket, with the headers as metadata
+func (c *S3Cache) Set(key string, headers Headers, body []byte) {
+	name := hashKey(key, defaultShardingDepth)
+	opts := minio.PutObjectOptions{
+		ContentType:  headers.ContentType,
+		CacheControl: headers.CacheControl,
+		UserMetadata: map[string]string{
+			"Last-Modified": headers.LastModified,
+			"Etag":          headers.ETag,
+		},
+	}
+	_, err := c.client.PutObject(context.Background(), c.bucket, name, bytes.NewReader(body), int64(len(body)), opts)
+	if err != nil {
+		slog.Error("Error while writing", "object", name, "error", err)
+	}
+}
+
+// Remember a resized variation of an image in a set of its variations in
+// redis
+func (c *S3Cache) AddVariation(uri, variation string) {
+	c.connection.Call("SADD", c.redisKey("variations/"+uri), variation)
+}
+
+// Remove the objects of the resized variations of an image remembered in
+// redis
+func (c *S3Cache) RemoveVariations(uri string) (int, error) {
+	variations, err := c.connection.Call("SMEMBERS", c.redisKey("variations/"+uri)).List()
+	if err != nil {
+		return 0, err
+	}
+
+	count := 0
+	for _, variation := range variations {
+		name := hashKey(cacheKey(uri, variation), defaultShardingDepth)
+		if err = c.client.RemoveObject(context.Background(), c.bucket, name, minio.RemoveObjectOptions{}); err != nil {
+			return count, err
+		}
+		count++
+	}
+	c.connection.Call("DEL", c.redisKey("variations/"+uri))
+
+	return count, nil
+}
+
+// Remove the objects of the variations of an image and of its original,
+// and its error in redis
+func (c *S3Cache) Purge(uri string) (int, error) {
+	count, err := c.RemoveVariations(uri)
+	if err != nil {
+		return count, err
+	}
+
+	// The original is only counted if it was cached
+	name := hashKey(cacheKey(uri, "orig"), defaultShardingDepth)
+	if _, err = c.client.StatObject(context.Background(), c.bucket, name, minio.StatObjectOptions{}); err == nil {
+		count++
+	} else if minio.ToErrorResponse(err).Code != "NoSuchKey" {
+		return count, err
+	}
+	if err = c.client.RemoveObject(context.Background(), c.bucket, name, minio.RemoveObjectOptions{}); err != nil {
+		return count, err
+	}
+	c.connection.Call("DEL", c.redisKey("err/"+uri))
+
+	return count, nil
+}
+
+// Check that redis answers and that the bucket exists
+func (c *S3Cache) Check() map[string]error {
+	return map[string]error{
+		"redis":  c.pingRedis(time.Second),
+		"bucket": c.checkBucket(),
+	}
+}
+
+// Check that the bucket exists and is reachable
+func (c *S3Cache) checkBucket() error {
+	exists, err := c.client.BucketExists(context.Background(), c.bucket)
+	if err == nil && !exists {
+		err = errBucketNotFound
+	}
+	return err
+}
@@ -0,0 +1,129 @@
+package resize
+
+import (
+	"bytes"
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// An S3 endpoint keeping the objects of every bucket in memory, with their
+// headers
+type mockS3 struct {
+	mu      sync.Mutex
+	objects map[string]mockObject
+}
+
+type mockObject struct {
+	header  http.Header
+	body    []byte
+	modTime time.Time
+}
+
+func (m *mockS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	switch r.Method {
+	case "PUT":
+		body, _ := ioutil.ReadAll(r.Body)
+		if strings.HasPrefix(r.Header.Get("X-Amz-Content-Sha256"), "STREAMING-") {
+			body = decodeAWSChunks(body)
+		}
+		header := http.Header{}
+		for name, values := range r.Header {
+			if name == "Content-Type" || name == "Cache-Control" || strings.HasPrefix(name, "X-Amz-Meta-") {
+				header[name] = values
+			}
+		}
+		m.objects[r.URL.Path] = mockObject{header, body, time.Now()}
+		w.Header().Set("ETag", `"etag"`)
+	case "GET", "HEAD":
+		object, ok := m.objects[r.URL.Path]
+		if !ok {
+			w.Header().Set("Content-Type", "application/xml")
+			w.WriteHeader(http.StatusNotFound)
+			if r.Method == "GET" {
+				w.Write([]byte(`<Error><Code>NoSuchKey</Code><Message>The specified key does not exist.</Message></Error>`))
+			}
+			return
+		}
+		for name, values := range object.header {
+			w.Header()[name] = values
+		}
+		w.Header().Set("Last-Modified", object.modTime.UTC().Format(http.TimeFormat))
+		w.Header().Set("ETag", `"etag"`)
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(object.body))
+	case "DELETE":
+		delete(m.objects, r.URL.Path)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.WriteHeader(http.StatusNotImplemented)
+	}
+}
+
+// Decode a body signed in chunks, ignoring their signatures
+func decodeAWSChunks(body []byte) []byte {
+	var decoded []byte
+	for len(body) > 0 {
+		line, rest, _ := bytes.Cut(body, []byte("\r\n"))
+		size, _ := strconv.ParseInt(string(bytes.SplitN(line, []byte(";"), 2)[0]), 16, 64)
+		if size == 0 || int(size) > len(rest) {
+			break
+		}
+		decoded = append(decoded, rest[:size]...)
+		body = bytes.TrimPrefix(rest[size:], []byte("\r\n"))
+	}
+	return decoded
+}
+
+// Create a client of a mock S3 endpoint
+func newMockS3Client(t *testing.T) *minio.Client {
+	t.Helper()
+	ts := httptest.NewServer(&mockS3{objects: map[string]mockObject{}})
+	t.Cleanup(ts.Close)
+	client, err := minio.New(strings.TrimPrefix(ts.URL, "http://"), &minio.Options{
+		Creds:  credentials.NewStaticV4("access", "secret", ""),
+		Region: "us-east-1",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return client
+}
+
+// Create a cache storing its objects in a mock S3 endpoint
+func newTestS3Cache(t *testing.T) *S3Cache {
+	t.Helper()
+	// The errors are not kept in redis by these tests
+	return NewS3Cache(newMockS3Client(t), "images", nil, "")
+}
+
+func TestS3CacheRoundTrip(t *testing.T) {
+	c := newTestS3Cache(t)
+	key := cacheKey("http://example.com/a.png", "orig")
+	body := []byte("original")
+
+	if _, _, ok := c.Get(key); ok {
+		t.Fatal("found before being saved")
+	}
+
+	c.Set(key, Headers{ContentType: "image/png", CacheControl: "max-age=60", LastModified: testLastModified, ETag: `"abc"`}, body)
+	headers, cached, ok := c.Get(key)
+	if !ok || !bytes.Equal(cached, body) {
+		t.Fatalf("get: ok=%v body=%q", ok, cached)
+	}
+	if headers.ContentType != "image/png" || headers.CacheControl != "max-age=60" || headers.LastModified != testLastModified || headers.ETag != `"abc"` {
+		t.Errorf("headers = %+v", headers)
+	}
+
+	if _, _, ok = c.Get(cacheKey("http://example.com/b.png", "orig")); ok {
+		t.Error("another image was found")
+	}
+}
@@ -0,0 +1,459 @@
+// Package resize implements an image resizing proxy. The original and the
+// resized images are cached, by default on disk with their metadata in redis.
+package resize
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"github.com/bmizerany/pat"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"golang.org/x/net/http/httpproxy"
+	"golang.org/x/sync/singleflight"
+	"golang.org/x/time/rate"
+	"image"
+	"image/png"
+	"net"
+	"net/http"
+	"net/http/pprof"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// HTTP headers struct
+type Headers struct {
+	ContentType  string
+	LastModified string
+	CacheControl string
+
+	// The entity tag sent by the distant server, for revalidation
+	ETag string
+
+	// When the image was fetched from, or revalidated with, the distant server
+	FetchedAt time.Time
+
+	// Whether the image comes from cache (HIT), possibly after a revalidation
+	// with the distant server (REVALIDATED) or despite its failure (STALE), or
+	// not (MISS). It is not cached.
+	CacheStatus string
+
+	// Whether the image was encoded in another format than the requested one,
+	// as its encoder failed. It is not cached, nor the image.
+	Fallback bool
+}
+
+// The URL for the default avatar
+const DefaultAvatarUrl = "https://linuxfr.org/images/default-avatar.png"
+
+// The default User-Agent of the fetches on the distant servers
+const DefaultUserAgent = "goresize (+https://github.com/arnaud-lb/goresize)"
+
+// The maximal size for an image is 5MB
+const maxSize = 5 * (1 << 20)
+
+// The maximal width or height of a resized image, unless configured
+const maxDimension = 10000
+
+// The maximal ratio of the size of an image to its original one
+const maxScale = 4
+
+// The default width and height of the thumbnails
+const defaultThumbSize = 150
+
+// The default quality used when encoding resized JPEG images
+const defaultQuality = 85
+
+// The default max-age of the responses, in seconds
+const defaultMaxAge = 600
+
+// The default number of workers saving in cache, and of saves waiting for them
+const defaultCacheWorkers = 4
+const defaultCacheQueueSize = 1000
+
+// The default time a resize waits for its turn
+const defaultResizeQueueTimeout = 5 * time.Second
+
+// The default delay before retrying a fetch
+const defaultFetchRetryBackoff = 200 * time.Millisecond
+
+// Errors are cached for 10 minutes, but only for 1 minute on timeouts and
+// the other transient errors, and for 1 hour on missing images
+const errorTTL = 600
+const transientErrorTTL = 60
+const notFoundErrorTTL = 3600
+
+// The max-age of the images served from a stale original because the distant
+// server failed, so that the clients retry soon
+const staleIfErrorMaxAge = 60
+
+// The error returned when the bucket of the S3 cache doesn't exist
+var errBucketNotFound = errors.New("Bucket not found")
+
+// The configuration of a server
+type Config struct {
+	// The maximal duration of a fetch on the distant server
+	Timeout time.Duration
+
+	// Accept any certificate when fetching images in HTTPS
+	Insecure bool
+
+	// The schemes of the URLs images can be fetched from, http and https if empty
+	AllowedSchemes []string
+
+	// The hosts (and their subdomains) images can be fetched from, or all if empty
+	AllowedHosts []string
+
+	// The max-age of the original images, in seconds, shortened to the one
+	// of the distant server. 10 minutes if 0.
+	MaxAge int
+
+	// The max-age of the resized images, MaxAge if 0
+	ResizeMaxAge int
+
+	// The formats the images can be served in, among jpeg, png, gif, webp
+	// and avif, or all if empty
+	OutputFormats []string
+
+	// The maximal number of pixels of a resized image, or 0 for no limit
+	MaxPixels int64
+
+	// The maximal number of pixels of an original image, checked before
+	// decoding it, or 0 for no limit. The frames of an animated GIF count
+	// together.
+	MaxSourcePixels int64
+
+	// The maximal duration of the decoding of an image, or 0 for no limit
+	DecodeTimeout time.Duration
+
+	// The maximal width and height of a resized image, whatever its number
+	// of pixels, as resampling very thin images still takes a lot of memory.
+	// 10000 if 0.
+	MaxWidth  int
+	MaxHeight int
+
+	// The compression level of PNG images
+	PNGCompression png.CompressionLevel
+
+	// The maximal number of frames of an animated GIF to resize, beyond
+	// which only the first frame is kept
+	MaxFrames int
+
+	// The size of the images served by /thumb, and whether they fit, fill or
+	// are padded to this box. 150x150 and fill if 0 and empty.
+	ThumbWidth  int
+	ThumbHeight int
+	ThumbMode   string
+
+	// The presets, by name
+	Presets map[string]Preset
+
+	// The image served instead of avatars that can't be fetched, or empty
+	// to respond with an error
+	DefaultImage string
+
+	// The image drawn over the resized images asking for it, or nil
+	Watermark image.Image
+
+	// The secret used to sign the requests, or empty to accept unsigned requests
+	Secret string
+
+	// The proxies for fetching images in HTTP and HTTPS, and the hosts
+	// reached directly, in the format of the HTTP_PROXY, HTTPS_PROXY and
+	// NO_PROXY environment variables, used instead if they are all empty
+	HTTPProxy  string
+	HTTPSProxy string
+	NoProxy    string
+
+	// The User-Agent of the fetches, DefaultUserAgent if empty
+	UserAgent string
+
+	// The Authorization header sent to the distant hosts requiring one, by
+	// host name. It is sent to these hosts only, even after a redirect.
+	UpstreamAuth map[string]string
+
+	// The client used for fetching images, built from Timeout, Insecure and
+	// the proxies if nil. Its redirects are followed, and its addresses
+	// dialed, without checking them.
+	HTTPClient *http.Client
+
+	// The maximal number of images resized at the same time, or 0 for no
+	// limit, and how long a resize waits for its turn before failing, 5
+	// seconds if 0
+	MaxConcurrentResizes int
+	ResizeQueueTimeout   time.Duration
+
+	// Serve the profiles of net/http/pprof under /debug/pprof/
+	Pprof bool
+
+	// The number of workers saving in cache, and of saves waiting for them
+	// before new ones are dropped
+	CacheWorkers   int
+	CacheQueueSize int
+
+	// Save in cache before responding, rather than in the background, so
+	// that the next requests for the same images find them
+	SyncCache bool
+
+	// The maximal number of fetches per second on each distant host, or 0
+	// for no limit, and how many can be made at once above this rate
+	FetchRate  float64
+	FetchBurst int
+
+	// The number of consecutive failures of a distant host after which its
+	// fetches fail without being made, or 0 to always make them, and for
+	// how long before probing it again. 30 seconds if 0.
+	BreakerThreshold int
+	BreakerCooldown  time.Duration
+
+	// The number of times a fetch failing with a transient error is retried,
+	// and the delay before the first retry, doubled for each next one
+	FetchRetries      int
+	FetchRetryBackoff time.Duration
+
+	// For how long, in seconds, an original older than its max-age is still
+	// served while it is revalidated in the background, or 0 to wait for
+	// the revalidation
+	StaleWhileRevalidate int
+
+	// Stream the fresh originals served by /proxy/ from the files of the
+	// cache, when it can open them, rather than reading them in memory
+	StreamOriginals bool
+}
+
+// The options of the images served by /preset/:name, in place of the ones
+// of the requests. The empty ones are taken from the requests, and the
+// format is negotiated if it is empty.
+type Preset struct {
+	Width   int    `json:"width"`
+	Height  int    `json:"height"`
+	Mode    string `json:"mode"`
+	Gravity string `json:"gravity"`
+	Filter  string `json:"filter"`
+	Format  string `json:"format"`
+	Quality int    `json:"quality"`
+}
+
+// The image resizing proxy
+type Server struct {
+	config Config
+
+	// The cache for the images and the errors
+	cache Cache
+
+	// The client used for fetching images, shared to reuse connections
+	httpClient *http.Client
+
+	// Concurrent requests for the same variation of an image share the work
+	resizeGroup singleflight.Group
+
+	// Concurrent revalidations of the same original are only made once
+	revalidateGroup singleflight.Group
+
+	// A slot for each image being resized, if their number is limited
+	resizeSlots chan struct{}
+
+	// The saves in cache waiting for a worker
+	saveQueue chan func()
+
+	// The saves in cache queued or running in the background
+	saves sync.WaitGroup
+
+	// The rate limiters of the fetches, by distant host
+	fetchLimiters   map[string]*rate.Limiter
+	fetchLimitersMu sync.Mutex
+
+	// The circuit breakers of the failing hosts
+	breakers   map[string]*breaker
+	breakersMu sync.Mutex
+
+	// The jobs warming the cache, the oldest first
+	warmJobs   []*warmJob
+	warmJobsMu sync.Mutex
+}
+
+// Create a server caching the images in the given cache
+func NewServer(config Config, cache Cache) *Server {
+	s := &Server{config: config, cache: cache, fetchLimiters: map[string]*rate.Limiter{}, breakers: map[string]*breaker{}}
+
+	if s.config.MaxAge <= 0 {
+		s.config.MaxAge = defaultMaxAge
+	}
+	if s.config.ResizeMaxAge <= 0 {
+		s.config.ResizeMaxAge = s.config.MaxAge
+	}
+	if s.config.UserAgent == "" {
+		s.config.UserAgent = DefaultUserAgent
+	}
+	if s.config.ThumbWidth <= 0 {
+		s.config.ThumbWidth = defaultThumbSize
+	}
+	if s.config.ThumbHeight <= 0 {
+		s.config.ThumbHeight = defaultThumbSize
+	}
+	if s.config.ThumbMode == "" {
+		s.config.ThumbMode = "fill"
+	}
+	if s.config.MaxWidth <= 0 {
+		s.config.MaxWidth = maxDimension
+	}
+	if s.config.MaxHeight <= 0 {
+		s.config.MaxHeight = maxDimension
+	}
+
+	s.httpClient = config.HTTPClient
+	if s.httpClient == nil {
+		s.httpClient = newHTTPClient(config)
+		s.httpClient.CheckRedirect = s.checkRedirect
+	}
+
+	if config.MaxConcurrentResizes > 0 {
+		s.resizeSlots = make(chan struct{}, config.MaxConcurrentResizes)
+	}
+	if s.config.ResizeQueueTimeout <= 0 {
+		s.config.ResizeQueueTimeout = defaultResizeQueueTimeout
+	}
+
+	workers := config.CacheWorkers
+	if workers <= 0 {
+		workers = defaultCacheWorkers
+	}
+	queueSize := config.CacheQueueSize
+	if queueSize <= 0 {
+		queueSize = defaultCacheQueueSize
+	}
+	s.saveQueue = make(chan func(), queueSize)
+	for i := 0; i < workers; i++ {
+		go s.saveWorker()
+	}
+
+	return s
+}
+
+// Create the client for fetching images, with the timeout, the proxies, and
+// the verification of the certificates of the configuration, refusing to
+// connect to the private addresses
+func newHTTPClient(config Config) *http.Client {
+	timeout := config.Timeout
+	cfg := &tls.Config{InsecureSkipVerify: config.Insecure}
+
+	// The proxies may be private, but not the distant servers
+	var proxies sync.Map
+	proxy := proxyFunc(config)
+	trackProxies := func(req *http.Request) (*url.URL, error) {
+		u, err := proxy(req)
+		if u != nil {
+			proxies.Store(proxyAddr(u), true)
+		}
+		return u, err
+	}
+	dialer := &net.Dialer{Timeout: timeout}
+	checkedDialer := &net.Dialer{Timeout: timeout, Control: checkDialedAddress}
+	dial := func(ctx context.Context, network, addr string) (net.Conn, error) {
+		if _, ok := proxies.Load(addr); ok {
+			return dialer.DialContext(ctx, network, addr)
+		}
+		return checkedDialer.DialContext(ctx, network, addr)
+	}
+
+	tr := &http.Transport{
+		Proxy:               trackProxies,
+		TLSClientConfig:     cfg,
+		DialContext:         dial,
+		TLSHandshakeTimeout: timeout,
+		MaxIdleConnsPerHost: 16,
+		IdleConnTimeout:     90 * time.Second,
+	}
+	return &http.Client{Transport: tr, Timeout: timeout}
+}
+
+// Return the address dialed to connect to a proxy
+func proxyAddr(u *url.URL) string {
+	port := u.Port()
+	if port == "" {
+		switch u.Scheme {
+		case "https":
+			port = "443"
+		case "socks5":
+			port = "1080"
+		default:
+			port = "80"
+		}
+	}
+	return net.JoinHostPort(u.Hostname(), port)
+}
+
+// Return the function choosing the proxy of a request: the configured ones,
+// or the ones of the environment if none is
+func proxyFunc(config Config) func(*http.Request) (*url.URL, error) {
+	if config.HTTPProxy == "" && config.HTTPSProxy == "" && config.NoProxy == "" {
+		return http.ProxyFromEnvironment
+	}
+
+	proxies := httpproxy.Config{
+		HTTPProxy:  config.HTTPProxy,
+		HTTPSProxy: config.HTTPSProxy,
+		NoProxy:    config.NoProxy,
+	}
+	proxy := proxies.ProxyFunc()
+	return func(req *http.Request) (*url.URL, error) {
+		return proxy(req.URL)
+	}
+}
+
+// Return the handler routing all the requests to the server, but the cache
+// warming of the admin handler
+func (s *Server) Handler() http.Handler {
+	m := pat.New()
+	s.routePublic(m)
+	s.routeAdmin(m)
+	return withRequestIDs(withCompression(m))
+}
+
+// Return the handler for the images only, when the operational endpoints
+// are served by the admin handler on another listener
+func (s *Server) PublicHandler() http.Handler {
+	m := pat.New()
+	m.Get("/status", http.HandlerFunc(s.Status))
+	s.routePublic(m)
+	return withRequestIDs(withCompression(m))
+}
+
+// Return the handler for the operational endpoints: status, health,
+// metrics, cache warming and pprof. The cache warming is not signed, so it is
+// only served here.
+func (s *Server) AdminHandler() http.Handler {
+	m := pat.New()
+	s.routeAdmin(m)
+	m.Post("/warm", http.HandlerFunc(s.Warm))
+	m.Get("/warm/:id", http.HandlerFunc(s.WarmStatus))
+	return withRequestIDs(withCompression(m))
+}
+
+// Route the requests for the images
+func (s *Server) routePublic(m *pat.PatternServeMux) {
+	m.Get("/resize/:encoded_url/:width/:height", http.HandlerFunc(s.Img))
+	m.Post("/resize/:width/:height", http.HandlerFunc(s.Post))
+	m.Get("/avatar/:encoded_url/:width/:height", http.HandlerFunc(s.Avatar))
+	m.Get("/thumb/:encoded_url", http.HandlerFunc(s.Thumb))
+	m.Get("/preset/:name/:encoded_url", http.HandlerFunc(s.Preset))
+	m.Get("/proxy/:encoded_url", http.HandlerFunc(s.Proxy))
+	m.Get("/info/:encoded_url", http.HandlerFunc(s.Info))
+	m.Get("/validate/:encoded_url", http.HandlerFunc(s.Validate))
+	m.Del("/cache/:encoded_url", http.HandlerFunc(s.Purge))
+}
+
+// Route the requests for the operational endpoints
+func (s *Server) routeAdmin(m *pat.PatternServeMux) {
+	m.Get("/status", http.HandlerFunc(s.Status))
+	m.Get("/health", http.HandlerFunc(s.Health))
+	m.Get("/metrics", promhttp.Handler())
+	if s.config.Pprof {
+		m.Get("/debug/pprof/cmdline", http.HandlerFunc(pprof.Cmdline))
+		m.Get("/debug/pprof/profile", http.HandlerFunc(pprof.Profile))
+		m.Get("/debug/pprof/symbol", http.HandlerFunc(pprof.Symbol))
+		m.Post("/debug/pprof/symbol", http.HandlerFunc(pprof.Symbol))
+		m.Get("/debug/pprof/trace", http.HandlerFunc(pprof.Trace))
+		m.Get("/debug/pprof/", http.HandlerFunc(pprof.Index))
+	}
+}
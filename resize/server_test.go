@@ -0,0 +1,142 @@
+package resize
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestServersAreIndependent(t *testing.T) {
+	ts, requests := newUpstream(t, "image/png", pngImage(t, 40, 20))
+	opts := ResizeOptions{Width: 10, Height: 10, Quality: defaultQuality}
+
+	first := newTestServer(Config{MaxPixels: 1 << 20}, newTestDiskCache(t))
+	if _, _, err := first.FetchResized(context.Background(), ts.URL, opts); err != nil {
+		t.Fatal(err)
+	}
+	first.WaitForSaves(context.Background())
+
+	// Nothing is shared with the first server, not even its cache
+	second := newTestServer(Config{MaxPixels: 1 << 20}, newTestDiskCache(t))
+	headers, _, err := second.FetchResized(context.Background(), ts.URL, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if headers.CacheStatus != "MISS" || *requests != 2 {
+		t.Errorf("X-Cache = %s after %d requests, want MISS after 2", headers.CacheStatus, *requests)
+	}
+}
+
+func TestGracefulShutdown(t *testing.T) {
+	png := pngImage(t, 40, 20)
+	started := make(chan struct{})
+	slow := roundTripFunc(func(r *http.Request) (*http.Response, error) {
+		close(started)
+		time.Sleep(200 * time.Millisecond)
+		return &http.Response{StatusCode: 200, Header: http.Header{"Content-Type": {"image/png"}}, Body: io.NopCloser(bytes.NewReader(png)), Request: r}, nil
+	})
+	c := newMemoryCache()
+	s := NewServer(Config{MaxPixels: 1 << 20, HTTPClient: &http.Client{Transport: slow}}, c)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	httpServer := &http.Server{Handler: s.Handler()}
+	go httpServer.Serve(listener)
+
+	uri := testOrigin + "/a.png"
+	responses := make(chan *http.Response, 1)
+	go func() {
+		res, err := http.Get("http://" + listener.Addr().String() + "/resize/" + encodeURL(uri) + "/10/10")
+		if err != nil {
+			t.Error(err)
+		}
+		responses <- res
+	}()
+
+	// Shut down while the request is in flight
+	<-started
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := httpServer.Shutdown(ctx); err != nil {
+		t.Fatalf("shutdown: %s", err)
+	}
+	if err := s.WaitForSaves(ctx); err != nil {
+		t.Fatalf("saves: %s", err)
+	}
+
+	res := <-responses
+	if res == nil {
+		return
+	}
+	defer res.Body.Close()
+	body, _ := io.ReadAll(res.Body)
+	if res.StatusCode != 200 {
+		t.Fatalf("status = %d", res.StatusCode)
+	}
+	decodeImage(t, body, "png")
+	if _, _, ok := c.Get(cacheKey(uri, "orig")); !ok {
+		t.Error("the original was not saved before the shutdown")
+	}
+}
+
+func TestPprof(t *testing.T) {
+	off := NewServer(Config{}, newMemoryCache())
+	on := NewServer(Config{Pprof: true}, newMemoryCache())
+
+	for _, path := range []string{"/debug/pprof/", "/debug/pprof/cmdline"} {
+		if w := serve(off.Handler(), "GET", path); w.Code != 404 {
+			t.Errorf("%s off: status = %d, want 404", path, w.Code)
+		}
+		if w := serve(on.Handler(), "GET", path); w.Code != 200 {
+			t.Errorf("%s on: status = %d, want 200", path, w.Code)
+		}
+		if w := serve(on.AdminHandler(), "GET", path); w.Code != 200 {
+			t.Errorf("%s on the admin handler: status = %d, want 200", path, w.Code)
+		}
+		if w := serve(on.PublicHandler(), "GET", path); w.Code != 404 {
+			t.Errorf("%s on the public handler: status = %d, want 404", path, w.Code)
+		}
+	}
+}
+
+func TestAdminListener(t *testing.T) {
+	c := newMemoryCache()
+	s := NewServer(Config{MaxPixels: 1 << 20}, c)
+	uri := testOrigin + "/a.png"
+	cacheOriginal(c, uri, "image/png", pngImage(t, 40, 20))
+	public := httptest.NewServer(s.PublicHandler())
+	defer public.Close()
+	admin := httptest.NewServer(s.AdminHandler())
+	defer admin.Close()
+
+	tests := []struct {
+		server *httptest.Server
+		path   string
+		status int
+	}{
+		{admin, "/metrics", 200},
+		{admin, "/health", 200},
+		{admin, "/resize/" + encodeURL(uri) + "/10/10", 404},
+		{public, "/metrics", 404},
+		{public, "/health", 404},
+		{public, "/status", 200},
+		{public, "/resize/" + encodeURL(uri) + "/10/10", 200},
+	}
+	for _, test := range tests {
+		res, err := http.Get(test.server.URL + test.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		if res.StatusCode != test.status {
+			t.Errorf("%s on %s: status = %d, want %d", test.path, test.server.URL, res.StatusCode, test.status)
+		}
+	}
+}
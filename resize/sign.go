@@ -0,0 +1,51 @@
+package resize
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/url"
+	"strings"
+)
+
+// Compute the signature of the parameters of a request, which is the
+// hex-encoded HMAC-SHA256 of the parameters joined with slashes
+func Sign(secret string, params ...string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(strings.Join(params, "/")))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Check the signature of the parameters of a request.
+// Always valid when no secret is configured.
+func (s *Server) checkSignature(sig string, params ...string) bool {
+	if s.config.Secret == "" {
+		return true
+	}
+
+	expected := Sign(s.config.Secret, params...)
+	return hmac.Equal([]byte(sig), []byte(expected))
+}
+
+// Append the parameters of the query to the signed ones, sorted by name and
+// URL-encoded as name=value joined with "&", but without the signature nor
+// the parameters of the path. Nothing is appended for the requests without
+// them, so that their signatures are unchanged.
+func withQuery(query url.Values, params ...string) []string {
+	signed := url.Values{}
+	for name, values := range query {
+		if name != "sig" && !strings.HasPrefix(name, ":") {
+			signed[name] = values
+		}
+	}
+	if len(signed) > 0 {
+		params = append(params, signed.Encode())
+	}
+	return params
+}
+
+// Compute the hash of the body of a request, signed with its parameters
+func bodyHash(body []byte) string {
+	sum := sha256.Sum256(body)
+	return hex.EncodeToString(sum[:])
+}
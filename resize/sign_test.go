@@ -0,0 +1,109 @@
+package resize
+
+import (
+	"bytes"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestSignedRequests(t *testing.T) {
+	c := newMemoryCache()
+	s := NewServer(Config{MaxPixels: 1 << 20, Secret: "secret"}, c)
+	uri := testOrigin + "/a.png"
+	cacheOriginal(c, uri, "image/png", pngImage(t, 400, 200))
+	encoded := encodeURL(uri)
+	sig := Sign("secret", encoded, "100", "50")
+
+	tests := []struct {
+		name   string
+		path   string
+		status int
+	}{
+		{"valid signature", "/resize/" + encoded + "/100/50?sig=" + sig, 200},
+		{"tampered width", "/resize/" + encoded + "/101/50?sig=" + sig, 403},
+		{"missing signature", "/resize/" + encoded + "/100/50", 403},
+	}
+	for _, test := range tests {
+		if w := serve(s.Handler(), "GET", test.path); w.Code != test.status {
+			t.Errorf("%s: status = %d, want %d", test.name, w.Code, test.status)
+		}
+	}
+}
+
+func TestUnsignedRequests(t *testing.T) {
+	c := newMemoryCache()
+	s := NewServer(Config{MaxPixels: 1 << 20}, c)
+	uri := testOrigin + "/a.png"
+	cacheOriginal(c, uri, "image/png", pngImage(t, 400, 200))
+
+	if w := serve(s.Handler(), "GET", "/resize/"+encodeURL(uri)+"/100/50"); w.Code != 200 {
+		t.Errorf("status = %d without a secret", w.Code)
+	}
+}
+
+func TestSignedQuery(t *testing.T) {
+	c := newMemoryCache()
+	s := NewServer(Config{MaxPixels: 1 << 20, Secret: "secret"}, c)
+	uri := testOrigin + "/a.png"
+	cacheOriginal(c, uri, "image/png", pngImage(t, 400, 200))
+	encoded := encodeURL(uri)
+	path := "/resize/" + encoded + "/100/50?"
+
+	tests := []struct {
+		name   string
+		query  string
+		status int
+	}{
+		{"signed dpr", "dpr=2&sig=" + Sign("secret", encoded, "100", "50", "dpr=2"), 200},
+		{"signed scale", "scale=0.5&sig=" + Sign("secret", encoded, "100", "50", "scale=0.5"), 200},
+		// Sorted by name
+		{"signed scale and dpr", "scale=0.5&dpr=2&sig=" + Sign("secret", encoded, "100", "50", "dpr=2&scale=0.5"), 200},
+		{"signed options", "quality=50&mode=fill&format=jpeg&sig=" + Sign("secret", encoded, "100", "50", "format=jpeg&mode=fill&quality=50"), 200},
+		// Escaped, not to be confused with the slashes between the parameters
+		{"escaped values", "v=1/2&sig=" + Sign("secret", encoded, "100", "50", "v=1%2F2"), 200},
+		{"added dpr", "dpr=3&sig=" + Sign("secret", encoded, "100", "50"), 403},
+		{"tampered dpr", "dpr=3&sig=" + Sign("secret", encoded, "100", "50", "dpr=2"), 403},
+		{"added scale", "scale=4&sig=" + Sign("secret", encoded, "100", "50"), 403},
+		{"added quality", "quality=95&sig=" + Sign("secret", encoded, "100", "50"), 403},
+		{"added blur", "mode=fill&blur=5&sig=" + Sign("secret", encoded, "100", "50", "mode=fill"), 403},
+		{"tampered format", "format=webp&sig=" + Sign("secret", encoded, "100", "50", "format=jpeg"), 403},
+	}
+	for _, test := range tests {
+		if w := serve(s.Handler(), "GET", path+test.query); w.Code != test.status {
+			t.Errorf("%s: status = %d, want %d", test.name, w.Code, test.status)
+		}
+	}
+
+	// Nor for the originals
+	proxy := "/proxy/" + encoded + "?"
+	if w := serve(s.Handler(), "GET", proxy+"sig="+Sign("secret", encoded)); w.Code != 200 {
+		t.Errorf("proxy: status = %d, want 200", w.Code)
+	}
+	if w := serve(s.Handler(), "GET", proxy+"v=2&sig="+Sign("secret", encoded)); w.Code != 403 {
+		t.Errorf("proxy with an added parameter: status = %d, want 403", w.Code)
+	}
+}
+
+func TestSignedPost(t *testing.T) {
+	s := NewServer(Config{MaxPixels: 1 << 20, Secret: "secret"}, newMemoryCache())
+	png := pngImage(t, 400, 200)
+	post := func(body []byte, query string) int {
+		r := httptest.NewRequest("POST", "/resize/100/50?"+query, bytes.NewReader(body))
+		w := httptest.NewRecorder()
+		s.Handler().ServeHTTP(w, r)
+		return w.Code
+	}
+
+	if status := post(png, "sig="+Sign("secret", "100", "50", bodyHash(png))); status != 200 {
+		t.Errorf("signed body: status = %d, want 200", status)
+	}
+	if status := post(pngImage(t, 40, 20), "sig="+Sign("secret", "100", "50", bodyHash(png))); status != 403 {
+		t.Errorf("another body: status = %d, want 403", status)
+	}
+	if status := post(png, "sig="+Sign("secret", "100", "50")); status != 403 {
+		t.Errorf("unsigned body: status = %d, want 403", status)
+	}
+	if status := post(png, "quality=10&sig="+Sign("secret", "100", "50", bodyHash(png))); status != 403 {
+		t.Errorf("added quality: status = %d, want 403", status)
+	}
+}
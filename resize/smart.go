@@ -0,0 +1,66 @@
+package resize
+
+import (
+	"image"
+	"image/draw"
+)
+
+// Move a crop rectangle along the axis where it is smaller than the image,
+// to the position keeping the most details. The details are measured by the
+// gradients of the luminance. The crop is kept if the image is uniform.
+func smartCrop(m image.Image, crop image.Rectangle) image.Rectangle {
+	bounds := m.Bounds()
+	horizontal := crop.Dx() < bounds.Dx()
+	if !horizontal && crop.Dy() >= bounds.Dy() {
+		return crop
+	}
+
+	gray := image.NewGray(bounds)
+	draw.Draw(gray, bounds, m, bounds.Min, draw.Src)
+
+	// Sum the details of each column, or row
+	n, size := bounds.Dy(), crop.Dy()
+	if horizontal {
+		n, size = bounds.Dx(), crop.Dx()
+	}
+	details := make([]int, n)
+	for y := bounds.Min.Y; y < bounds.Max.Y-1; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X-1; x++ {
+			v := int(gray.GrayAt(x, y).Y)
+			d := abs(v-int(gray.GrayAt(x+1, y).Y)) + abs(v-int(gray.GrayAt(x, y+1).Y))
+			if horizontal {
+				details[x-bounds.Min.X] += d
+			} else {
+				details[y-bounds.Min.Y] += d
+			}
+		}
+	}
+
+	// Slide the window to find the one with the most details
+	best, bestSum, sum := 0, 0, 0
+	for i := 0; i < n; i++ {
+		sum += details[i]
+		if i >= size {
+			sum -= details[i-size]
+		}
+		if i >= size-1 && sum > bestSum {
+			best, bestSum = i-size+1, sum
+		}
+	}
+	if bestSum == 0 {
+		return crop
+	}
+
+	if horizontal {
+		return crop.Add(image.Pt(bounds.Min.X+best-crop.Min.X, 0))
+	}
+	return crop.Add(image.Pt(0, bounds.Min.Y+best-crop.Min.Y))
+}
+
+// Return the absolute value of an integer
+func abs(v int) int {
+	if v < 0 {
+		return -v
+	}
+	return v
+}
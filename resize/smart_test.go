@@ -0,0 +1,27 @@
+package resize
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+	"testing"
+)
+
+func TestSmartCrop(t *testing.T) {
+	// A uniform image, but for a detailed area on its right
+	m := image.NewGray(image.Rect(0, 0, 300, 100))
+	draw.Draw(m, m.Bounds(), image.NewUniform(color.Gray{128}), image.Point{}, draw.Src)
+	detail := image.Rect(220, 20, 280, 80)
+	draw.Draw(m, detail, checkerboard(60, 4), image.Point{}, draw.Src)
+
+	center := cropRect(m.Bounds(), 100, 100, "center")
+	if crop := smartCrop(m, center); !detail.In(crop) || crop.Size() != center.Size() {
+		t.Errorf("crop = %v, want %v of the same size as %v", crop, detail, center)
+	}
+
+	// Kept centered without details
+	uniform := image.NewGray(m.Bounds())
+	if crop := smartCrop(uniform, center); crop != center {
+		t.Errorf("uniform: crop = %v, want %v", crop, center)
+	}
+}
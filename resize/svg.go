@@ -0,0 +1,105 @@
+package resize
+
+import (
+	"context"
+	"github.com/srwiley/oksvg"
+	"github.com/srwiley/rasterx"
+	"image"
+	"math"
+	"strings"
+	"time"
+)
+
+// Check if a body is an SVG image, which can start with an XML declaration,
+// comments or a doctype
+func isSVG(body string) bool {
+	if len(body) > 1024 {
+		body = body[:1024]
+	}
+	body = strings.TrimSpace(body)
+	return strings.HasPrefix(body, "<") && strings.Contains(body, "<svg")
+}
+
+// Parse an SVG image, skipping the elements that are not supported, and
+// return its size
+func decodeSVG(body string) (icon *oksvg.SvgIcon, width, height int, err error) {
+	icon, err = oksvg.ReadIconStream(strings.NewReader(body), oksvg.IgnoreErrorMode)
+	if err != nil {
+		return
+	}
+
+	width = int(math.Ceil(icon.ViewBox.W))
+	height = int(math.Ceil(icon.ViewBox.H))
+	if width <= 0 || height <= 0 {
+		err = errInvalidImage
+	}
+	return
+}
+
+// Rasterize an SVG image to the given size, keeping only the crop area of
+// its view box
+func rasterizeSVG(icon *oksvg.SvgIcon, crop image.Rectangle, width, height int) image.Image {
+	sx := float64(width) / float64(crop.Dx())
+	sy := float64(height) / float64(crop.Dy())
+	icon.SetTarget(-float64(crop.Min.X)*sx, -float64(crop.Min.Y)*sy, icon.ViewBox.W*sx, icon.ViewBox.H*sy)
+
+	m := image.NewRGBA(image.Rect(0, 0, width, height))
+	scanner := rasterx.NewScannerGV(width, height, m, m.Bounds())
+	icon.Draw(rasterx.NewDasher(width, height, scanner), 1)
+	return m
+}
+
+// Rasterize an SVG image at the requested size. It is never served as is,
+// as it could run scripts in the browsers.
+func (s *Server) resizeSVG(ctx context.Context, uri, origBody string, origHeaders Headers, opts ResizeOptions) (headers Headers, body []byte, err error) {
+	icon, origWidth, origHeight, err := decodeSVG(origBody)
+	if err != nil {
+		return
+	}
+
+	// Vector images have no resolution to lose
+	opts.Upscale = true
+	bounds := image.Rect(0, 0, origWidth, origHeight)
+	crop, newWidth, newHeight, _ := opts.geometry(bounds)
+	if err = s.checkPixels(newWidth, newHeight); err != nil {
+		return
+	}
+
+	err = s.acquireResize(ctx)
+	if err != nil {
+		return
+	}
+	defer s.releaseResize()
+
+	start := time.Now()
+
+	logger(ctx).Info("Rasterize", "uri", uri, "width", opts.Width, "height", opts.Height,
+		"orig_width", origWidth, "orig_height", origHeight, "crop", crop.String(),
+		"new_width", newWidth, "new_height", newHeight)
+
+	m := rasterizeSVG(icon, crop, newWidth, newHeight)
+	if padWidth, padHeight, ok := opts.padding(); ok {
+		m = padImage(m, padWidth, padHeight, opts.background())
+	}
+	m = applyEffects(m, opts)
+	if opts.Watermark != "" && s.config.Watermark != nil {
+		m = overlay(m, s.config.Watermark, opts.Watermark, opts.WatermarkOpacity)
+	}
+
+	writter := getBuffer()
+	defer putBuffer(writter)
+	contentType, fallback, err := s.encodeOutput(ctx, uri, writter, m, "png", opts)
+	if err != nil {
+		return
+	}
+
+	resizeDuration.Observe(time.Since(start).Seconds())
+
+	body = append([]byte(nil), writter.Bytes()...)
+
+	headers = origHeaders
+	headers.ContentType = contentType
+	headers.Fallback = fallback
+
+	return
+}
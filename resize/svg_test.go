@@ -0,0 +1,36 @@
+package resize
+
+import (
+	"context"
+	"testing"
+)
+
+// A red rectangle, twice as wide as high
+const testSVG = `<svg xmlns="http://www.w3.org/2000/svg" width="100" height="50" viewBox="0 0 100 50">
+<rect x="0" y="0" width="100" height="50" fill="#ff0000"/>
+</svg>`
+
+func TestResizeSVG(t *testing.T) {
+	s := newTestServer(Config{MaxPixels: 1 << 20}, newMemoryCache())
+
+	for _, size := range []int{40, 400} {
+		headers, body := resizeFrom(t, s, "image/svg+xml", []byte(testSVG), ResizeOptions{Width: size, Height: size, Quality: defaultQuality})
+		if headers.ContentType != "image/png" {
+			t.Errorf("Content-Type = %s, want image/png", headers.ContentType)
+		}
+		m := decodeImage(t, body, "png")
+		if m.Bounds().Dx() != size || m.Bounds().Dy() != size/2 {
+			t.Errorf("size = %v, want %dx%d", m.Bounds(), size, size/2)
+		}
+		if r, g, _, _ := m.At(size/2, size/4).RGBA(); r>>8 < 250 || g>>8 > 5 {
+			t.Errorf("center = %v, want red", m.At(size/2, size/4))
+		}
+	}
+
+	// Within the limit of pixels
+	s = newTestServer(Config{MaxPixels: 1000}, newMemoryCache())
+	ts, _ := newUpstream(t, "image/svg+xml", []byte(testSVG))
+	if _, _, err := s.FetchResized(context.Background(), ts.URL, ResizeOptions{Width: 100, Height: 100, Quality: defaultQuality}); err == nil {
+		t.Error("no error for a rasterized image larger than the limit")
+	}
+}
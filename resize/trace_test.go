@@ -0,0 +1,61 @@
+package resize
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"regexp"
+	"testing"
+)
+
+// Capture the logs of the default logger as JSON until the end of the test
+func captureLogs(t *testing.T) *bytes.Buffer {
+	var buf bytes.Buffer
+	previous := slog.Default()
+	slog.SetDefault(slog.New(slog.NewJSONHandler(&buf, nil)))
+	t.Cleanup(func() { slog.SetDefault(previous) })
+	return &buf
+}
+
+// Return the request IDs of the log lines with a message
+func loggedRequestIDs(t *testing.T, logs *bytes.Buffer, msg string) (ids []string) {
+	t.Helper()
+	for _, line := range bytes.Split(bytes.TrimSpace(logs.Bytes()), []byte("\n")) {
+		var record struct {
+			Msg       string `json:"msg"`
+			RequestID string `json:"request_id"`
+		}
+		if err := json.Unmarshal(line, &record); err != nil {
+			t.Fatalf("invalid JSON log line %q: %s", line, err)
+		}
+		if record.Msg == msg {
+			ids = append(ids, record.RequestID)
+		}
+	}
+	return
+}
+
+func TestRequestID(t *testing.T) {
+	logs := captureLogs(t)
+	s := NewServer(Config{MaxPixels: 1 << 20, HTTPClient: &http.Client{Transport: respondWithImage(pngImage(t, 40, 20), "")}}, newMemoryCache())
+	path := "/resize/" + encodeURL(testOrigin+"/a.png") + "/10/10"
+
+	w := serve(s.Handler(), "GET", path, "X-Request-ID: abc-123")
+	if id := w.Header().Get("X-Request-ID"); id != "abc-123" {
+		t.Errorf("X-Request-ID = %s, want abc-123", id)
+	}
+	if ids := loggedRequestIDs(t, logs, "Fetch"); len(ids) != 1 || ids[0] != "abc-123" {
+		t.Errorf("request IDs of the fetch log = %v, want abc-123", ids)
+	}
+
+	// Generated when the client didn't send one
+	w = serve(s.Handler(), "GET", "/resize/"+encodeURL(testOrigin+"/b.png")+"/10/10")
+	id := w.Header().Get("X-Request-ID")
+	if !regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`).MatchString(id) {
+		t.Errorf("generated X-Request-ID = %q, want an UUID", id)
+	}
+	if ids := loggedRequestIDs(t, logs, "Fetch"); len(ids) != 2 || ids[1] != id {
+		t.Errorf("request IDs of the fetch logs = %v, want %s last", ids, id)
+	}
+}
@@ -0,0 +1,77 @@
+package resize
+
+import (
+	"image"
+	"image/color"
+)
+
+// The maximal difference of each channel with the color of the border, out
+// of 255, for a pixel to be part of the border: enough for the noise of
+// scans and JPEG artifacts
+const trimTolerance = 24
+
+// The maximal part of each dimension removed from each side, which bounds
+// the pixels scanned
+const maxTrimRatio = 3
+
+// Remove the uniform border of an image, of the color of its top left
+// corner. The image is returned unchanged if its corners aren't all of the
+// same color.
+func trimBorder(m image.Image) image.Image {
+	bounds := m.Bounds()
+	if bounds.Dx() < 3 || bounds.Dy() < 3 {
+		return m
+	}
+
+	border := m.At(bounds.Min.X, bounds.Min.Y)
+	if !similarColors(m.At(bounds.Max.X-1, bounds.Min.Y), border) ||
+		!similarColors(m.At(bounds.Min.X, bounds.Max.Y-1), border) ||
+		!similarColors(m.At(bounds.Max.X-1, bounds.Max.Y-1), border) {
+		return m
+	}
+
+	isBorder := func(x0, y0, x1, y1 int) bool {
+		for y := y0; y < y1; y++ {
+			for x := x0; x < x1; x++ {
+				if !similarColors(m.At(x, y), border) {
+					return false
+				}
+			}
+		}
+		return true
+	}
+
+	maxX, maxY := bounds.Dx()/maxTrimRatio, bounds.Dy()/maxTrimRatio
+	trimmed := bounds
+	for trimmed.Min.Y-bounds.Min.Y < maxY && isBorder(trimmed.Min.X, trimmed.Min.Y, trimmed.Max.X, trimmed.Min.Y+1) {
+		trimmed.Min.Y++
+	}
+	for bounds.Max.Y-trimmed.Max.Y < maxY && isBorder(trimmed.Min.X, trimmed.Max.Y-1, trimmed.Max.X, trimmed.Max.Y) {
+		trimmed.Max.Y--
+	}
+	for trimmed.Min.X-bounds.Min.X < maxX && isBorder(trimmed.Min.X, trimmed.Min.Y, trimmed.Min.X+1, trimmed.Max.Y) {
+		trimmed.Min.X++
+	}
+	for bounds.Max.X-trimmed.Max.X < maxX && isBorder(trimmed.Max.X-1, trimmed.Min.Y, trimmed.Max.X, trimmed.Max.Y) {
+		trimmed.Max.X--
+	}
+
+	if trimmed == bounds {
+		return m
+	}
+	if sub, ok := m.(interface {
+		SubImage(image.Rectangle) image.Image
+	}); ok {
+		return sub.SubImage(trimmed)
+	}
+	return m
+}
+
+// Check if two colors differ by at most the trim tolerance on each channel
+func similarColors(a, b color.Color) bool {
+	r1, g1, b1, a1 := a.RGBA()
+	r2, g2, b2, a2 := b.RGBA()
+	const tolerance = trimTolerance * 0x101
+	return abs(int(r1)-int(r2)) <= tolerance && abs(int(g1)-int(g2)) <= tolerance &&
+		abs(int(b1)-int(b2)) <= tolerance && abs(int(a1)-int(a2)) <= tolerance
+}
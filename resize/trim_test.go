@@ -0,0 +1,46 @@
+package resize
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"testing"
+)
+
+// A gradient within a white border, slightly noisy like a scan
+func bordered(width, height, border int) *image.NRGBA {
+	m := image.NewNRGBA(image.Rect(0, 0, width+2*border, height+2*border))
+	for y := 0; y < m.Bounds().Dy(); y++ {
+		for x := 0; x < m.Bounds().Dx(); x++ {
+			shade := uint8(255 - (x+y)%8)
+			m.SetNRGBA(x, y, color.NRGBA{shade, shade, shade, 255})
+		}
+	}
+	draw.Draw(m, image.Rect(border, border, border+width, border+height), gradient(width, height), image.Point{}, draw.Src)
+	return m
+}
+
+func TestTrimBorder(t *testing.T) {
+	if bounds := trimBorder(bordered(60, 30, 10)).Bounds(); bounds.Dx() != 60 || bounds.Dy() != 30 {
+		t.Errorf("trimmed size = %v, want 60x30", bounds)
+	}
+
+	// Nothing to trim
+	m := gradient(60, 30)
+	if bounds := trimBorder(m).Bounds(); bounds != m.Bounds() {
+		t.Errorf("trimmed size = %v without a border", bounds)
+	}
+
+	// And when resizing
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, bordered(60, 30, 10)); err != nil {
+		t.Fatal(err)
+	}
+	s := newTestServer(Config{MaxPixels: 1 << 20}, newMemoryCache())
+	_, body := resizeFrom(t, s, "image/png", buf.Bytes(), ResizeOptions{Width: 100, Height: 100, Quality: defaultQuality, Trim: true})
+	if bounds := decodeImage(t, body, "png").Bounds(); bounds.Dx() != 60 || bounds.Dy() != 30 {
+		t.Errorf("resized size = %v, want 60x30", bounds)
+	}
+}
@@ -0,0 +1,204 @@
+package resize
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+)
+
+// The maximal number of images warmed by a request, how many are fetched
+// and resized at the same time, and how many jobs are remembered
+const maxWarmEntries = 100
+const warmConcurrency = 4
+const maxWarmJobs = 100
+
+// An image to warm the cache with
+type warmEntry struct {
+	URL    string `json:"url"`
+	Width  int    `json:"width"`
+	Height int    `json:"height"`
+
+	// The format negotiated with the clients: webp, avif, or empty for the
+	// one of the original
+	Format string `json:"format,omitempty"`
+}
+
+// The result of the warming of an image, without status while it is pending
+type warmResult struct {
+	warmEntry
+	Status int    `json:"status,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+// A batch of images warmed in the background
+type warmJob struct {
+	id string
+
+	mu      sync.Mutex
+	results []warmResult
+	pending int
+}
+
+// The progress of a warm job, and the results of its images
+type warmStatus struct {
+	ID      string       `json:"id"`
+	Done    bool         `json:"done"`
+	Pending int          `json:"pending"`
+	Warmed  int          `json:"warmed"`
+	Failed  int          `json:"failed"`
+	Results []warmResult `json:"results"`
+}
+
+// Return the progress of a job
+func (job *warmJob) status() warmStatus {
+	job.mu.Lock()
+	defer job.mu.Unlock()
+
+	status := warmStatus{ID: job.id, Done: job.pending == 0, Pending: job.pending}
+	status.Results = append(status.Results, job.results...)
+	for _, result := range job.results {
+		if result.Error != "" {
+			status.Failed++
+		} else if result.Status != 0 {
+			status.Warmed++
+		}
+	}
+	return status
+}
+
+// Receive a JSON list of images, and fetch and resize them in the
+// background so that they are cached. It responds right away with the job
+// warming them, whose progress is served at /warm/:id.
+func (s *Server) Warm(w http.ResponseWriter, r *http.Request) {
+	var entries []warmEntry
+	err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20)).Decode(&entries)
+	if err != nil || len(entries) > maxWarmEntries {
+		logger(r.Context()).Warn("Invalid warm request", "error", err, "entries", len(entries))
+		httpError(w, r, "Invalid parameters", 400)
+		return
+	}
+
+	id := make([]byte, 8)
+	rand.Read(id)
+	job := &warmJob{id: hex.EncodeToString(id), results: make([]warmResult, len(entries)), pending: len(entries)}
+	for i, entry := range entries {
+		job.results[i].warmEntry = entry
+	}
+	if !s.addWarmJob(job) {
+		logger(r.Context()).Warn("Too many warm jobs")
+		httpError(w, r, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+		return
+	}
+	logger(r.Context()).Info("Warm", "job", job.id, "entries", len(entries))
+
+	// The job outlives the request, but keeps its logger
+	go s.runWarmJob(context.WithoutCancel(r.Context()), job, entries)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Location", "/warm/"+job.id)
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(job.status())
+}
+
+// Receive an HTTP request for the progress of a warm job, and respond with
+// it in JSON
+func (s *Server) WarmStatus(w http.ResponseWriter, r *http.Request) {
+	job := s.warmJob(r.URL.Query().Get(":id"))
+	if job == nil {
+		httpError(w, r, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(job.status())
+}
+
+// Remember a job, forgetting the oldest finished one when there are too
+// many. It returns false when they are all still running.
+func (s *Server) addWarmJob(job *warmJob) bool {
+	s.warmJobsMu.Lock()
+	defer s.warmJobsMu.Unlock()
+
+	if len(s.warmJobs) >= maxWarmJobs {
+		i := 0
+		for i < len(s.warmJobs) && !s.warmJobs[i].status().Done {
+			i++
+		}
+		if i == len(s.warmJobs) {
+			return false
+		}
+		s.warmJobs = append(s.warmJobs[:i], s.warmJobs[i+1:]...)
+	}
+	s.warmJobs = append(s.warmJobs, job)
+	return true
+}
+
+// Find a job by its id, or return nil if it is unknown or forgotten
+func (s *Server) warmJob(id string) *warmJob {
+	s.warmJobsMu.Lock()
+	defer s.warmJobsMu.Unlock()
+
+	for _, job := range s.warmJobs {
+		if job.id == id {
+			return job
+		}
+	}
+	return nil
+}
+
+// Warm the images of a job, a few at the same time
+func (s *Server) runWarmJob(ctx context.Context, job *warmJob, entries []warmEntry) {
+	slots := make(chan struct{}, warmConcurrency)
+	var wg sync.WaitGroup
+	for i, entry := range entries {
+		wg.Add(1)
+		slots <- struct{}{}
+		go func(i int, entry warmEntry) {
+			defer wg.Done()
+			defer func() { <-slots }()
+			result := s.warm(ctx, entry)
+
+			job.mu.Lock()
+			job.results[i] = result
+			job.pending--
+			job.mu.Unlock()
+		}(i, entry)
+	}
+	wg.Wait()
+
+	status := job.status()
+	logger(ctx).Info("Warmed", "job", job.id, "warmed", status.Warmed, "failed", status.Failed)
+}
+
+// Fetch and resize an image like a request without options would
+func (s *Server) warm(ctx context.Context, entry warmEntry) warmResult {
+	result := warmResult{warmEntry: entry, Status: http.StatusOK}
+
+	// The options are parsed like the ones of the requests warmed, with the
+	// format as if the clients accepted it
+	query := url.Values{":width": {strconv.Itoa(entry.Width)}, ":height": {strconv.Itoa(entry.Height)}}
+	acceptable := func(mediaType string) bool { return mediaType == "image/"+entry.Format }
+	opts, err := s.optionsFromQuery(ctx, query, acceptable)
+	if err != nil {
+		err = &FetchError{http.StatusBadRequest, err.Error()}
+	} else if entry.Format != "" && ((entry.Format != "webp" && entry.Format != "avif") || !s.isAllowedFormat(entry.Format)) {
+		err = &FetchError{http.StatusBadRequest, "Invalid format"}
+	} else {
+		err = s.validateURL(ctx, entry.URL)
+	}
+	if err == nil {
+		_, _, err = s.FetchResized(ctx, entry.URL, opts)
+	}
+
+	if err != nil {
+		logger(ctx).Warn("Error while warming", "uri", entry.URL, "error", err)
+		result.Status = errorStatus(err)
+		result.Error = err.Error()
+	}
+	return result
+}
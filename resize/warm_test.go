@@ -0,0 +1,140 @@
+package resize
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Send a warm request with a JSON body to a handler
+func postWarm(h http.Handler, body string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest("POST", "/warm", strings.NewReader(body))
+	r.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	return w
+}
+
+// Wait for a warm job to be done, and return its status
+func waitForWarm(t *testing.T, h http.Handler, id string) warmStatus {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		var status warmStatus
+		w := serve(h, "GET", "/warm/"+id)
+		decodeJSON(t, w, &status)
+		if w.Code != 200 {
+			t.Fatalf("status of the job: %d", w.Code)
+		}
+		if status.Done {
+			return status
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("the job is still pending: %+v", status)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestWarm(t *testing.T) {
+	client := &http.Client{Transport: respondWithImage(pngImage(t, 40, 20), "")}
+	s := NewServer(Config{MaxPixels: 1 << 20, SyncCache: true, HTTPClient: client}, newMemoryCache())
+
+	w := postWarm(s.AdminHandler(), `[
+		{"url": "`+testOrigin+`/a.png", "width": 10, "height": 10},
+		{"url": "`+testOrigin+`/b.png", "width": 20, "height": 0},
+		{"url": "`+testOrigin+`/c.png", "width": 0, "height": 0}
+	]`)
+	var job warmStatus
+	decodeJSON(t, w, &job)
+	if w.Code != 202 || job.ID == "" || w.Header().Get("Location") != "/warm/"+job.ID {
+		t.Fatalf("status = %d, id = %q, Location = %q, want 202 with the job", w.Code, job.ID, w.Header().Get("Location"))
+	}
+
+	summary := waitForWarm(t, s.AdminHandler(), job.ID)
+	if summary.Warmed != 2 || summary.Failed != 1 || summary.Pending != 0 {
+		t.Fatalf("%d warmed and %d failed, want 2 and 1", summary.Warmed, summary.Failed)
+	}
+	if status := summary.Results[2].Status; status != 400 {
+		t.Errorf("invalid entry: status = %d, want 400", status)
+	}
+
+	for _, path := range []string{"/resize/" + encodeURL(testOrigin+"/a.png") + "/10/10", "/resize/" + encodeURL(testOrigin+"/b.png") + "/20/0"} {
+		w := serve(s.PublicHandler(), "GET", path)
+		if w.Code != 200 || w.Header().Get("X-Cache") != "HIT" {
+			t.Errorf("%s: %d with X-Cache = %q, want a HIT", path, w.Code, w.Header().Get("X-Cache"))
+		}
+	}
+
+	if w := serve(s.AdminHandler(), "GET", "/warm/unknown"); w.Code != 404 {
+		t.Errorf("unknown job: status = %d, want 404", w.Code)
+	}
+}
+
+func TestWarmInBackground(t *testing.T) {
+	release := make(chan struct{})
+	png := pngImage(t, 40, 20)
+	upstream := func(r *http.Request) (*http.Response, error) {
+		<-release
+		return respondWithImage(png, "").RoundTrip(r)
+	}
+	s := NewServer(Config{MaxPixels: 1 << 20, SyncCache: true, HTTPClient: &http.Client{Transport: roundTripFunc(upstream)}}, newMemoryCache())
+
+	// Answered before the image is fetched
+	w := postWarm(s.AdminHandler(), `[{"url": "`+testOrigin+`/a.png", "width": 10, "height": 10}]`)
+	var job warmStatus
+	decodeJSON(t, w, &job)
+	if w.Code != 202 || job.Done || job.Pending != 1 || job.Results[0].Status != 0 {
+		t.Fatalf("status = %d, job = %+v, want a pending job", w.Code, job)
+	}
+
+	close(release)
+	if summary := waitForWarm(t, s.AdminHandler(), job.ID); summary.Warmed != 1 {
+		t.Errorf("%d warmed, want 1", summary.Warmed)
+	}
+}
+
+// The options are parsed like the ones of the requests
+func TestWarmOptions(t *testing.T) {
+	client := &http.Client{Transport: respondWithImage(pngImage(t, 40, 20), "")}
+	s := NewServer(Config{MaxWidth: 100, MaxPixels: 1 << 20, SyncCache: true, HTTPClient: client}, newMemoryCache())
+
+	w := postWarm(s.AdminHandler(), `[
+		{"url": "`+testOrigin+`/a.png", "width": 10, "height": 10, "format": "webp"},
+		{"url": "`+testOrigin+`/a.png", "width": 200, "height": 10},
+		{"url": "`+testOrigin+`/a.png", "width": 10, "height": 10, "format": "gif"}
+	]`)
+	var job warmStatus
+	decodeJSON(t, w, &job)
+	summary := waitForWarm(t, s.AdminHandler(), job.ID)
+	for i, want := range []int{200, 400, 400} {
+		if status := summary.Results[i].Status; status != want {
+			t.Errorf("entry %d: status = %d, want %d", i, status, want)
+		}
+	}
+	if summary.Results[1].Error != "Requested width exceeds 100" {
+		t.Errorf("error = %q, want the one of the requests", summary.Results[1].Error)
+	}
+
+	path := "/resize/" + encodeURL(testOrigin+"/a.png") + "/10/10"
+	if w := serve(s.PublicHandler(), "GET", path, "Accept: image/webp"); w.Header().Get("X-Cache") != "HIT" || w.Header().Get("Content-Type") != "image/webp" {
+		t.Errorf("X-Cache = %q, Content-Type = %q, want a HIT in WebP", w.Header().Get("X-Cache"), w.Header().Get("Content-Type"))
+	}
+}
+
+func TestWarmOnlyOnTheAdminHandler(t *testing.T) {
+	client := &http.Client{Transport: respondWithImage(pngImage(t, 40, 20), "")}
+	s := NewServer(Config{MaxPixels: 1 << 20, HTTPClient: client}, newMemoryCache())
+	body := `[{"url": "` + testOrigin + `/a.png", "width": 10, "height": 10}]`
+
+	for name, h := range map[string]http.Handler{"handler": s.Handler(), "public handler": s.PublicHandler()} {
+		if w := postWarm(h, body); w.Code != 404 && w.Code != 405 {
+			t.Errorf("%s: status = %d, want the warming not to be served", name, w.Code)
+		}
+	}
+	if w := postWarm(s.AdminHandler(), body); w.Code != 202 {
+		t.Errorf("admin handler: status = %d, want 202", w.Code)
+	}
+}